@@ -9,17 +9,25 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"sync"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
 
 	"github.com/offchainlabs/nitro/arbutil"
 	"github.com/offchainlabs/nitro/daprovider"
 	"github.com/offchainlabs/nitro/solgen/go/bridgegen"
+	"github.com/offchainlabs/nitro/util/blobs"
+	"github.com/offchainlabs/nitro/util/containers"
+	"github.com/offchainlabs/nitro/util/headerreader"
 )
 
 var sequencerBridgeABI *abi.ABI
@@ -38,6 +46,15 @@ const (
 	BatchDataBlobHashes
 )
 
+// ErrBlobDataUnavailable is returned (wrapped) when decoding a BatchDataBlobHashes batch whose blobs have expired
+// from the beacon chain, as opposed to a transient fetch failure. Callers can fall back to another DA source.
+// Serialize itself only reads the blob hashes from the batch's transaction; the blobs are fetched by the blob reader.
+var ErrBlobDataUnavailable = headerreader.ErrBlobDataUnavailable
+
+func (l BatchDataLocation) IsKnown() bool {
+	return l <= BatchDataBlobHashes
+}
+
 func init() {
 	var err error
 	sequencerBridgeABI, err = bridgegen.SequencerInboxMetaData.GetAbi()
@@ -49,24 +66,87 @@ func init() {
 	addSequencerL2BatchFromOriginCallABI = sequencerBridgeABI.Methods["addSequencerL2BatchFromOrigin0"]
 }
 
+// SequencerInboxBackend is the parent chain client the sequencer inbox is read through.
+// It's implemented by *ethclient.Client, and by simulated.Client for tests.
+type SequencerInboxBackend interface {
+	bind.ContractBackend
+	ethereum.BlockNumberReader
+	arbutil.TransactionInBlockReader
+}
+
 type SequencerInbox struct {
 	con       *bridgegen.SequencerInbox
 	address   common.Address
 	fromBlock int64
-	client    *ethclient.Client
+	client    SequencerInboxBackend
+
+	// If set, batches with a data location this node doesn't understand (e.g. one added on-chain ahead of a
+	// client upgrade) are flagged with UnknownDataLocation and serialize without their data, instead of failing.
+	// The node will then disagree with up to date nodes about the batch's contents, so validators must leave this unset.
+	SkipUnknownDataLocations bool
+
+	// If non-zero, LookupBatchesInRange splits its block range into queries of at most this many blocks,
+	// for RPC providers that cap the range or number of results of eth_getLogs.
+	MaxBlockRangePerQuery uint64
+
+	// Used by GetBatchCount and GetAccumulator. Set it to NoReadRetries to fail fast.
+	ReadRetryPolicy ReadRetryPolicy
+
+	// If set, LookupBatchesInRange checks that each batch's parent chain block is still canonical,
+	// failing with a ReorgDetectedError if one was reorged out while its logs were being fetched.
+	CheckReorgs bool
+
+	// If set, LookupBatchesInRange serializes the batches it returns, fetching the data of up to
+	// EagerSerializeParallelism batches at once (or a default if that's zero), for callers about to serialize them all.
+	EagerSerialize            bool
+	EagerSerializeParallelism int
+
+	// If set, batch data is read from it before falling back to the parent chain. Data it returns is only used
+	// if it hashes into the batch's accumulator, so a stale or corrupted source can't change a batch's contents.
+	BatchDataSource BatchDataSource
+
+	logFilterer ethereum.LogFilterer // The client, except in tests
+
+	accCacheMutex         sync.Mutex
+	accCache              *containers.LruCache[uint64, cachedAccumulator]
+	accCacheFinalityDepth uint64
+
+	dataCache    *batchDataCache
+	blobVerifier daprovider.BlobReader
+}
+
+// BatchDataSource is a local store of batch data, like a DAS store or a file cache, that can spare
+// fetching batches' data from the parent chain.
+type BatchDataSource interface {
+	// GetBatchData returns the data of the batch with the given sequence number, as Serialize appends it after the
+	// batch header, and false if it doesn't have the batch.
+	GetBatchData(seqNum uint64) ([]byte, bool, error)
+}
+
+type cachedAccumulator struct {
+	acc         common.Hash
+	blockNumber uint64 // The parent chain block the accumulator was read at
 }
 
 func NewSequencerInbox(client *ethclient.Client, addr common.Address, fromBlock int64) (*SequencerInbox, error) {
+	return NewSequencerInboxWithBackend(client, addr, fromBlock)
+}
+
+// NewSequencerInboxWithBackend is like NewSequencerInbox, but reads the parent chain through any backend,
+// e.g. a simulated backend or one that fails over between several clients.
+func NewSequencerInboxWithBackend(client SequencerInboxBackend, addr common.Address, fromBlock int64) (*SequencerInbox, error) {
 	con, err := bridgegen.NewSequencerInbox(addr, client)
 	if err != nil {
 		return nil, err
 	}
 
 	return &SequencerInbox{
-		con:       con,
-		address:   addr,
-		fromBlock: fromBlock,
-		client:    client,
+		con:             con,
+		address:         addr,
+		fromBlock:       fromBlock,
+		client:          client,
+		ReadRetryPolicy: DefaultReadRetryPolicy,
+		logFilterer:     client,
 	}, nil
 }
 
@@ -78,7 +158,9 @@ func (i *SequencerInbox) GetBatchCount(ctx context.Context, blockNumber *big.Int
 		Context:     ctx,
 		BlockNumber: blockNumber,
 	}
-	count, err := i.con.BatchCount(opts)
+	count, err := retryRead(ctx, i.ReadRetryPolicy, "batchCount", func() (*big.Int, error) {
+		return i.con.BatchCount(opts)
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -88,13 +170,274 @@ func (i *SequencerInbox) GetBatchCount(ctx context.Context, blockNumber *big.Int
 	return count.Uint64(), nil
 }
 
+// GetBatchCountAtTag returns the batch count as of the parent chain block with the given tag: "latest", "safe", or
+// "finalized". The tag is resolved to a block number first, so like GetBatchCount, it returns 0 if that block is
+// before the inbox's fromBlock.
+func (i *SequencerInbox) GetBatchCountAtTag(ctx context.Context, tag string) (uint64, error) {
+	var blockNumber rpc.BlockNumber
+	if err := blockNumber.UnmarshalJSON([]byte(`"` + tag + `"`)); err != nil {
+		return 0, fmt.Errorf("invalid block tag %q: %w", tag, err)
+	}
+	switch blockNumber {
+	case rpc.LatestBlockNumber, rpc.SafeBlockNumber, rpc.FinalizedBlockNumber:
+	default:
+		return 0, fmt.Errorf("unsupported block tag %q, expected latest, safe, or finalized", tag)
+	}
+	header, err := i.client.HeaderByNumber(ctx, big.NewInt(blockNumber.Int64()))
+	if err != nil {
+		return 0, err
+	}
+	return i.GetBatchCount(ctx, header.Number)
+}
+
+// EnableAccumulatorCache makes GetAccumulator cache accumulators read at blocks at least finalityDepth blocks behind
+// the latest parent chain block. Those can't be reorged out, so later reads of the same sequence number at the same
+// or a later block are served from the cache. Reads closer to the head always query the contract.
+func (i *SequencerInbox) EnableAccumulatorCache(capacity int, finalityDepth uint64) {
+	i.accCacheMutex.Lock()
+	defer i.accCacheMutex.Unlock()
+	i.accCache = containers.NewLruCache[uint64, cachedAccumulator](capacity)
+	i.accCacheFinalityDepth = finalityDepth
+}
+
+// EnableBatchDataCache makes the batches returned by later LookupBatchesInRange calls share a cache of up to capacity
+// batches' data, so serializing the same batch again doesn't fetch its data from the parent chain again.
+// It must be called before the inbox is used concurrently.
+func (i *SequencerInbox) EnableBatchDataCache(capacity int) {
+	i.dataCache = &batchDataCache{
+		data: containers.NewLruCache[batchDataKey, []byte](capacity),
+	}
+}
+
+// EnableBlobVerification makes the blob batches returned by later lookups check, when they're serialized, that every
+// blob their transaction references can be fetched from blobReader and commits to the versioned hash it's referenced
+// by. Otherwise a batch poster could reference blobs that were never published, which is only noticed once the batch
+// is read from the blob hashes. It must be called before the inbox is used concurrently.
+func (i *SequencerInbox) EnableBlobVerification(blobReader daprovider.BlobReader) {
+	i.blobVerifier = blobReader
+}
+
+func (i *SequencerInbox) getCachedAccumulator(sequenceNumber uint64, blockNumber *big.Int) (common.Hash, bool) {
+	i.accCacheMutex.Lock()
+	defer i.accCacheMutex.Unlock()
+	if i.accCache == nil {
+		return common.Hash{}, false
+	}
+	cached, ok := i.accCache.Get(sequenceNumber)
+	if !ok {
+		return common.Hash{}, false
+	}
+	// A nil block number means the latest block, which is always after the cached read
+	if blockNumber != nil && (!blockNumber.IsUint64() || blockNumber.Uint64() < cached.blockNumber) {
+		return common.Hash{}, false
+	}
+	return cached.acc, true
+}
+
+func (i *SequencerInbox) maybeCacheAccumulator(ctx context.Context, sequenceNumber uint64, blockNumber *big.Int, acc common.Hash) {
+	i.accCacheMutex.Lock()
+	enabled := i.accCache != nil
+	finalityDepth := i.accCacheFinalityDepth
+	i.accCacheMutex.Unlock()
+	if !enabled || blockNumber == nil || !blockNumber.IsUint64() {
+		return
+	}
+	latest, err := i.client.BlockNumber(ctx)
+	if err != nil {
+		log.Debug("failed to get latest block number for accumulator cache", "err", err)
+		return
+	}
+	if blockNumber.Uint64()+finalityDepth > latest {
+		return
+	}
+	i.accCacheMutex.Lock()
+	defer i.accCacheMutex.Unlock()
+	i.accCache.Add(sequenceNumber, cachedAccumulator{acc: acc, blockNumber: blockNumber.Uint64()})
+}
+
 func (i *SequencerInbox) GetAccumulator(ctx context.Context, sequenceNumber uint64, blockNumber *big.Int) (common.Hash, error) {
+	if acc, ok := i.getCachedAccumulator(sequenceNumber, blockNumber); ok {
+		return acc, nil
+	}
 	opts := &bind.CallOpts{
 		Context:     ctx,
 		BlockNumber: blockNumber,
 	}
-	acc, err := i.con.InboxAccs(opts, new(big.Int).SetUint64(sequenceNumber))
-	return acc, err
+	acc, err := retryRead(ctx, i.ReadRetryPolicy, "inboxAccs", func() ([32]byte, error) {
+		return i.con.InboxAccs(opts, new(big.Int).SetUint64(sequenceNumber))
+	})
+	if err != nil {
+		return acc, err
+	}
+	i.maybeCacheAccumulator(ctx, sequenceNumber, blockNumber, acc)
+	return acc, nil
+}
+
+// rpcBatchCaller is implemented by backends that can send several RPC requests in a single round trip, like *ethclient.Client.
+type rpcBatchCaller interface {
+	Client() *rpc.Client
+}
+
+// AccumulatorReadError is returned by GetAccumulators when reading one of the accumulators failed, e.g. because
+// the call reverted. Index is the position of the failed sequence number in the input.
+type AccumulatorReadError struct {
+	Index          int
+	SequenceNumber uint64
+	Err            error
+}
+
+func (e *AccumulatorReadError) Error() string {
+	return fmt.Sprintf("failed to read accumulator of batch %v (index %v): %v", e.SequenceNumber, e.Index, e.Err)
+}
+
+func (e *AccumulatorReadError) Unwrap() error {
+	return e.Err
+}
+
+// GetAccumulators is like GetAccumulator for several sequence numbers, returning their accumulators in the same order.
+// If the client supports batched RPC requests, the accumulators that aren't cached are all read in one round trip;
+// otherwise they're read one by one. If any read fails, the whole call fails with an *AccumulatorReadError.
+func (i *SequencerInbox) GetAccumulators(ctx context.Context, seqNums []uint64, blockNumber *big.Int) ([]common.Hash, error) {
+	accs := make([]common.Hash, len(seqNums))
+	var missing []int
+	for index, seqNum := range seqNums {
+		if acc, ok := i.getCachedAccumulator(seqNum, blockNumber); ok {
+			accs[index] = acc
+		} else {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) == 0 {
+		return accs, nil
+	}
+	batcher, ok := i.client.(rpcBatchCaller)
+	if !ok || batcher.Client() == nil {
+		for _, index := range missing {
+			acc, err := i.GetAccumulator(ctx, seqNums[index], blockNumber)
+			if err != nil {
+				return nil, &AccumulatorReadError{Index: index, SequenceNumber: seqNums[index], Err: err}
+			}
+			accs[index] = acc
+		}
+		return accs, nil
+	}
+
+	block := "latest"
+	if blockNumber != nil {
+		block = hexutil.EncodeBig(blockNumber)
+	}
+	elems := make([]rpc.BatchElem, len(missing))
+	results := make([]hexutil.Bytes, len(missing))
+	for j, index := range missing {
+		data, err := sequencerBridgeABI.Pack("inboxAccs", new(big.Int).SetUint64(seqNums[index]))
+		if err != nil {
+			return nil, err
+		}
+		callArgs := map[string]interface{}{
+			"to":   i.address,
+			"data": hexutil.Bytes(data),
+		}
+		elems[j] = rpc.BatchElem{Method: "eth_call", Args: []interface{}{callArgs, block}, Result: &results[j]}
+	}
+	_, err := retryRead(ctx, i.ReadRetryPolicy, "inboxAccs batch", func() (struct{}, error) {
+		return struct{}{}, batcher.Client().BatchCallContext(ctx, elems)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for j, index := range missing {
+		if elems[j].Error != nil {
+			return nil, &AccumulatorReadError{Index: index, SequenceNumber: seqNums[index], Err: elems[j].Error}
+		}
+		out, err := sequencerBridgeABI.Unpack("inboxAccs", results[j])
+		if err != nil {
+			return nil, &AccumulatorReadError{Index: index, SequenceNumber: seqNums[index], Err: err}
+		}
+		acc := common.Hash(*abi.ConvertType(out[0], new([32]byte)).(*[32]byte))
+		accs[index] = acc
+		i.maybeCacheAccumulator(ctx, seqNums[index], blockNumber, acc)
+	}
+	return accs, nil
+}
+
+// VerifyBatchAccumulator reports whether the batch with the given sequence number exists as of the parent chain block
+// blockNumber and its after inbox accumulator is expectedAcc. It's a cheap way to check that a locally stored batch
+// wasn't reorged out or corrupted before re-fetching and re-executing it. A batch that doesn't exist yet doesn't match.
+func (i *SequencerInbox) VerifyBatchAccumulator(ctx context.Context, seqNum uint64, expectedAcc common.Hash, blockNumber *big.Int) (bool, error) {
+	count, err := i.GetBatchCount(ctx, blockNumber)
+	if err != nil {
+		return false, err
+	}
+	if seqNum >= count {
+		return false, nil
+	}
+	acc, err := i.GetAccumulator(ctx, seqNum, blockNumber)
+	if err != nil {
+		return false, err
+	}
+	return acc == expectedAcc, nil
+}
+
+// BatchHeaderLength is the length of the header Serialize writes before the batch data:
+// the min and max timestamps, the min and max block numbers, and the after delayed count, as big endian uint64s.
+const BatchHeaderLength = 40
+
+// ValidateSerializedLength checks that serialized batch data is at least long enough to contain its header.
+func ValidateSerializedLength(data []byte) error {
+	if len(data) < BatchHeaderLength {
+		return fmt.Errorf("serialized batch is %v bytes, shorter than the %v byte header", len(data), BatchHeaderLength)
+	}
+	return nil
+}
+
+// BatchHeader holds the header fields Serialize writes before the batch data.
+type BatchHeader struct {
+	MinTimestamp      uint64
+	MaxTimestamp      uint64
+	MinBlockNumber    uint64
+	MaxBlockNumber    uint64
+	AfterDelayedCount uint64
+}
+
+// ParseBatchHeader reads back the header of serialized batch data, the inverse of the header written by Serialize.
+func ParseBatchHeader(data []byte) (*BatchHeader, error) {
+	if err := ValidateSerializedLength(data); err != nil {
+		return nil, err
+	}
+	return &BatchHeader{
+		MinTimestamp:      binary.BigEndian.Uint64(data[0:8]),
+		MaxTimestamp:      binary.BigEndian.Uint64(data[8:16]),
+		MinBlockNumber:    binary.BigEndian.Uint64(data[16:24]),
+		MaxBlockNumber:    binary.BigEndian.Uint64(data[24:32]),
+		AfterDelayedCount: binary.BigEndian.Uint64(data[32:40]),
+	}, nil
+}
+
+// ParseSerializedBatchHeader splits a serialized batch, as returned by Serialize, back into the batch's time bounds,
+// its delayed message count, and the batch data that follows the header.
+func ParseSerializedBatchHeader(data []byte) (bridgegen.IBridgeTimeBounds, uint64, []byte, error) {
+	header, err := ParseBatchHeader(data)
+	if err != nil {
+		return bridgegen.IBridgeTimeBounds{}, 0, nil, err
+	}
+	timeBounds := bridgegen.IBridgeTimeBounds{
+		MinTimestamp:   header.MinTimestamp,
+		MaxTimestamp:   header.MaxTimestamp,
+		MinBlockNumber: header.MinBlockNumber,
+		MaxBlockNumber: header.MaxBlockNumber,
+	}
+	return timeBounds, header.AfterDelayedCount, data[BatchHeaderLength:], nil
+}
+
+// ComputeAfterInboxAcc computes the sequencer inbox accumulator after a batch, as the bridge contract does:
+// keccak256(beforeAcc ++ keccak256(serialized) ++ afterDelayedAcc).
+// serialized is the batch's serialized data (as returned by Serialize), which hashes the same as the data
+// the contract hashes for every data location: the header followed by the calldata, the blob hashes
+// with their header flag, or nothing for force inclusion. afterDelayedAcc is the delayed inbox accumulator
+// after the batch's last delayed message read, or the zero hash if none have been read.
+func ComputeAfterInboxAcc(beforeAcc common.Hash, serialized []byte, afterDelayedAcc common.Hash) common.Hash {
+	dataHash := crypto.Keccak256Hash(serialized)
+	return crypto.Keccak256Hash(beforeAcc[:], dataHash[:], afterDelayedAcc[:])
 }
 
 type SequencerInboxBatch struct {
@@ -110,9 +453,89 @@ type SequencerInboxBatch struct {
 	DataLocation           BatchDataLocation
 	BridgeAddress          common.Address
 	Serialized             []byte // nil if serialization isn't cached yet
+	UnknownDataLocation    bool   // set if the data location isn't understood and the batch data is being skipped
+
+	dataCache       *batchDataCache       // set by LookupBatchesInRange if the inbox has a batch data cache
+	dataSource      BatchDataSource       // set by LookupBatchesInRange if the inbox has a batch data source
+	blobVerifier    daprovider.BlobReader // set by LookupBatchesInRange if the inbox verifies blobs
+	compressedSizes map[int]uint64        // cached by EstimateCompressedSize, keyed by brotli level
+}
+
+// batchDataKey identifies a batch's data. Keying by the parent chain block hash means batches
+// from a reorged out block never hit the cache.
+type batchDataKey struct {
+	blockHash      common.Hash
+	sequenceNumber uint64
 }
 
-func (m *SequencerInboxBatch) getSequencerData(ctx context.Context, client *ethclient.Client) ([]byte, error) {
+// batchDataCache holds batch data fetched from the parent chain, shared by all the batches an inbox looks up.
+type batchDataCache struct {
+	mutex sync.Mutex
+	data  *containers.LruCache[batchDataKey, []byte]
+}
+
+func (c *batchDataCache) get(key batchDataKey) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.data.Get(key)
+}
+
+func (c *batchDataCache) add(key batchDataKey, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.data.Add(key, data)
+}
+
+// The returned data may be shared with the batch data cache, and must not be modified.
+func (m *SequencerInboxBatch) getSequencerData(ctx context.Context, client SequencerInboxBackend) ([]byte, error) {
+	if m.dataCache == nil {
+		return m.readSequencerData(ctx, client)
+	}
+	key := batchDataKey{blockHash: m.BlockHash, sequenceNumber: m.SequenceNumber}
+	if data, ok := m.dataCache.get(key); ok {
+		return data, nil
+	}
+	data, err := m.readSequencerData(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	m.dataCache.add(key, data)
+	return data, nil
+}
+
+// readSequencerData reads the batch's data from its data source if it has a valid copy, or else from the parent chain.
+func (m *SequencerInboxBatch) readSequencerData(ctx context.Context, client SequencerInboxBackend) ([]byte, error) {
+	if m.dataSource == nil || m.DataLocation == BatchDataNone || !m.DataLocation.IsKnown() {
+		return m.fetchSequencerData(ctx, client)
+	}
+	data, ok, err := m.dataSource.GetBatchData(m.SequenceNumber)
+	if err != nil {
+		log.Warn("failed to read batch data from data source, falling back to the parent chain", "batch", m.SequenceNumber, "err", err)
+	} else if ok {
+		if err := m.validateSourceData(data); err != nil {
+			log.Warn("ignoring invalid batch data from data source", "batch", m.SequenceNumber, "err", err)
+		} else {
+			return data, nil
+		}
+	}
+	return m.fetchSequencerData(ctx, client)
+}
+
+// validateSourceData checks that data from a batch data source has the header flag the batch's data location
+// implies, and that it hashes into the batch's after inbox accumulator.
+func (m *SequencerInboxBatch) validateSourceData(data []byte) error {
+	isBlobHashes := len(data) > 0 && daprovider.IsBlobHashesHeaderByte(data[0])
+	if isBlobHashes != (m.DataLocation == BatchDataBlobHashes) {
+		return fmt.Errorf("data doesn't match the batch's data location %v", m.DataLocation)
+	}
+	serialized := append(m.serializedHeader(), data...)
+	if acc := ComputeAfterInboxAcc(m.BeforeInboxAcc, serialized, m.AfterDelayedAcc); acc != m.AfterInboxAcc {
+		return fmt.Errorf("data hashes to accumulator %v instead of %v", acc, m.AfterInboxAcc)
+	}
+	return nil
+}
+
+func (m *SequencerInboxBatch) fetchSequencerData(ctx context.Context, client SequencerInboxBackend) ([]byte, error) {
 	switch m.DataLocation {
 	case BatchDataTxInput:
 		data, err := arbutil.GetLogEmitterTxData(ctx, client, m.RawLog)
@@ -141,14 +564,12 @@ func (m *SequencerInboxBatch) getSequencerData(ctx context.Context, client *ethc
 		if err != nil {
 			return nil, err
 		}
-		if len(logs) == 0 {
-			return nil, errors.New("expected to find sequencer batch data")
-		}
-		if len(logs) > 1 {
-			return nil, errors.New("expected to find only one matching sequencer batch data")
+		dataLog, err := selectBatchDataLog(logs, numberAsHash, m.RawLog.TxHash)
+		if err != nil {
+			return nil, err
 		}
 		event := new(bridgegen.SequencerInboxSequencerBatchData)
-		err = sequencerBridgeABI.UnpackIntoInterface(event, sequencerBatchDataEvent, logs[0].Data)
+		err = sequencerBridgeABI.UnpackIntoInterface(event, sequencerBatchDataEvent, dataLog.Data)
 		if err != nil {
 			return nil, err
 		}
@@ -164,24 +585,104 @@ func (m *SequencerInboxBatch) getSequencerData(ctx context.Context, client *ethc
 		if len(tx.BlobHashes()) == 0 {
 			return nil, fmt.Errorf("blob batch transaction %v has no blobs", tx.Hash())
 		}
+		if m.blobVerifier != nil {
+			if err := verifyBatchBlobs(ctx, m.blobVerifier, m.BlockHash, tx.BlobHashes()); err != nil {
+				return nil, fmt.Errorf("blob batch %v: %w", m.SequenceNumber, err)
+			}
+		}
 		data := []byte{daprovider.BlobHashesHeaderFlag}
 		for _, h := range tx.BlobHashes() {
 			data = append(data, h[:]...)
 		}
 		return data, nil
 	default:
+		if m.UnknownDataLocation {
+			return nil, nil
+		}
 		return nil, fmt.Errorf("batch has invalid data location %v", m.DataLocation)
 	}
 }
 
-func (m *SequencerInboxBatch) Serialize(ctx context.Context, client *ethclient.Client) ([]byte, error) {
+// ErrBlobHashMismatch is returned (wrapped) by blob verification when a fetched blob doesn't match the versioned hash
+// the batch's transaction references it by.
+var ErrBlobHashMismatch = errors.New("blob doesn't match its versioned hash")
+
+// verifyBatchBlobs fetches the blobs with the given versioned hashes and checks that each one's KZG commitment
+// hashes to its versioned hash.
+func verifyBatchBlobs(ctx context.Context, blobReader daprovider.BlobReader, batchBlockHash common.Hash, versionedHashes []common.Hash) error {
+	fetched, err := blobReader.GetBlobs(ctx, batchBlockHash, versionedHashes)
+	if err != nil {
+		return fmt.Errorf("failed to fetch blobs to verify them: %w", err)
+	}
+	if len(fetched) != len(versionedHashes) {
+		return fmt.Errorf("%w: fetched %v blobs for %v versioned hashes", ErrBlobHashMismatch, len(fetched), len(versionedHashes))
+	}
+	_, hashes, err := blobs.ComputeCommitmentsAndHashes(fetched)
+	if err != nil {
+		return err
+	}
+	for idx, hash := range hashes {
+		if hash != versionedHashes[idx] {
+			return fmt.Errorf("%w: blob %v has versioned hash %v but was referenced as %v", ErrBlobHashMismatch, idx, hash, versionedHashes[idx])
+		}
+	}
+	return nil
+}
+
+// selectBatchDataLog picks the batch data log for the batch with the given sequence number out of the logs
+// matching it in the batch's block. A node may return logs removed by a reorg or emitted by a tx that was
+// replaced, so only a log with exactly the batch's sequence number, from the tx that delivered the batch, counts.
+func selectBatchDataLog(logs []types.Log, numberAsHash common.Hash, batchTxHash common.Hash) (*types.Log, error) {
+	var found *types.Log
+	for idx := range logs {
+		ethLog := &logs[idx]
+		if ethLog.Removed || len(ethLog.Topics) < 2 || ethLog.Topics[1] != numberAsHash {
+			continue
+		}
+		if batchTxHash != (common.Hash{}) && ethLog.TxHash != batchTxHash {
+			continue
+		}
+		if found != nil {
+			return nil, errors.New("expected to find only one matching sequencer batch data")
+		}
+		found = ethLog
+	}
+	if found == nil {
+		return nil, errors.New("expected to find sequencer batch data")
+	}
+	return found, nil
+}
+
+// IsForceInclusion reports whether the batch was force included from the delayed inbox rather than posted by the
+// batch poster. Such batches carry no data, so they serialize to just their header.
+func (m *SequencerInboxBatch) IsForceInclusion() bool {
+	return m.DataLocation == BatchDataNone
+}
+
+// Serialize returns the batch as hashed into the inbox accumulator: a BatchHeaderLength byte header followed by the
+// batch data, fetching the data through client if the batch isn't serialized yet. A result of just the header is
+// valid and expected for force inclusion batches (see IsForceInclusion), which have no data; it isn't an error.
+func (m *SequencerInboxBatch) Serialize(ctx context.Context, client SequencerInboxBackend) ([]byte, error) {
 	if m.Serialized != nil {
 		return m.Serialized, nil
 	}
 
-	var fullData []byte
+	fullData := m.serializedHeader()
+
+	// Append the batch data
+	data, err := m.getSequencerData(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	fullData = append(fullData, data...)
+
+	m.Serialized = fullData
+	return fullData, nil
+}
 
-	// Serialize the header
+// serializedHeader returns the BatchHeaderLength byte header Serialize writes before the batch data.
+func (m *SequencerInboxBatch) serializedHeader() []byte {
+	header := make([]byte, 0, BatchHeaderLength)
 	headerVals := []uint64{
 		m.TimeBounds.MinTimestamp,
 		m.TimeBounds.MaxTimestamp,
@@ -192,69 +693,396 @@ func (m *SequencerInboxBatch) Serialize(ctx context.Context, client *ethclient.C
 	for _, bound := range headerVals {
 		var intData [8]byte
 		binary.BigEndian.PutUint64(intData[:], bound)
-		fullData = append(fullData, intData[:]...)
+		header = append(header, intData[:]...)
+	}
+	return header
+}
+
+// VerifyAccumulator checks that the batch's serialized data hashes into its AfterInboxAcc given its BeforeInboxAcc,
+// the same way the bridge contract accumulates it. This detects tampered or truncated batch data without any RPC calls.
+// The batch must already be serialized.
+func (m *SequencerInboxBatch) VerifyAccumulator() (bool, error) {
+	if m.Serialized == nil {
+		return false, fmt.Errorf("batch %v isn't serialized yet", m.SequenceNumber)
+	}
+	if m.UnknownDataLocation {
+		return false, fmt.Errorf("batch %v was serialized without its data, as its data location is unknown", m.SequenceNumber)
 	}
+	return ComputeAfterInboxAcc(m.BeforeInboxAcc, m.Serialized, m.AfterDelayedAcc) == m.AfterInboxAcc, nil
+}
 
-	// Append the batch data
-	data, err := m.getSequencerData(ctx, client)
+// ErrNonUint64SequenceNumber is returned when a batch delivered event's sequence number doesn't fit in a uint64.
+var ErrNonUint64SequenceNumber = errors.New("sequencer inbox event has non-uint64 sequence number")
+
+// ErrBatchesOutOfOrder is wrapped by BatchesOutOfOrderError.
+var ErrBatchesOutOfOrder = errors.New("sequencer batches out of order")
+
+// BatchesOutOfOrderError is returned when the batches found in a range aren't consecutive.
+// Unlike a failed RPC call, retrying won't help; the batches were read from conflicting views of the parent chain.
+type BatchesOutOfOrderError struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *BatchesOutOfOrderError) Error() string {
+	return fmt.Sprintf("%v; expected batch %v but got batch %v", ErrBatchesOutOfOrder, e.Expected, e.Actual)
+}
+
+func (e *BatchesOutOfOrderError) Unwrap() error {
+	return ErrBatchesOutOfOrder
+}
+
+// ErrReorgDetected is wrapped by ReorgDetectedError.
+var ErrReorgDetected = errors.New("parent chain reorg detected")
+
+// ReorgDetectedError is returned when a batch's log came from a parent chain block that's no longer canonical.
+// The caller should back off and query the range again.
+type ReorgDetectedError struct {
+	BlockNumber    uint64
+	LogBlockHash   common.Hash
+	CanonicalBlock common.Hash
+}
+
+func (e *ReorgDetectedError) Error() string {
+	return fmt.Sprintf("%v at block %v: log from block %v but the canonical block is %v", ErrReorgDetected, e.BlockNumber, e.LogBlockHash, e.CanonicalBlock)
+}
+
+func (e *ReorgDetectedError) Unwrap() error {
+	return ErrReorgDetected
+}
+
+// checkCanonical returns a ReorgDetectedError if the log's block is no longer the canonical block at its height.
+// canonical caches the block hashes already looked up.
+func (i *SequencerInbox) checkCanonical(ctx context.Context, ethLog types.Log, canonical map[uint64]common.Hash) error {
+	hash, ok := canonical[ethLog.BlockNumber]
+	if !ok {
+		header, err := i.client.HeaderByNumber(ctx, new(big.Int).SetUint64(ethLog.BlockNumber))
+		if err != nil {
+			return err
+		}
+		hash = header.Hash()
+		canonical[ethLog.BlockNumber] = hash
+	}
+	if hash != ethLog.BlockHash {
+		return &ReorgDetectedError{BlockNumber: ethLog.BlockNumber, LogBlockHash: ethLog.BlockHash, CanonicalBlock: hash}
+	}
+	return nil
+}
+
+// LookupBatchesInRange returns the batches posted between the from and to parent chain blocks, inclusive.
+// Like GetBatchCount, it treats blocks before the inbox's fromBlock as having no batches:
+// ranges ending before it are empty and ranges starting before it are clamped to start at it.
+func (i *SequencerInbox) LookupBatchesInRange(ctx context.Context, from, to *big.Int) ([]*SequencerInboxBatch, error) {
+	var batches []*SequencerInboxBatch
+	err := i.lookupBatchesInRange(ctx, from, to, func(batch *SequencerInboxBatch) error {
+		batches = append(batches, batch)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	fullData = append(fullData, data...)
+	if i.EagerSerialize {
+		if err := i.serializeBatches(ctx, batches); err != nil {
+			return nil, err
+		}
+	}
+	return batches, nil
+}
 
-	m.Serialized = fullData
-	return fullData, nil
+// serializeBatches serializes the batches concurrently, failing if any of them can't be serialized.
+func (i *SequencerInbox) serializeBatches(ctx context.Context, batches []*SequencerInboxBatch) error {
+	parallelism := i.EagerSerializeParallelism
+	if parallelism <= 0 {
+		parallelism = batchDataFetchParallelism
+	}
+	errs := forEachBatchConcurrently(ctx, batches, parallelism, func(ctx context.Context, _ int, batch *SequencerInboxBatch) error {
+		_, err := batch.Serialize(ctx, i.client)
+		return err
+	})
+	for idx, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to serialize batch %v: %w", batches[idx].SequenceNumber, err)
+		}
+	}
+	return nil
 }
 
-func (i *SequencerInbox) LookupBatchesInRange(ctx context.Context, from, to *big.Int) ([]*SequencerInboxBatch, error) {
+// ErrBatchNotFound is returned by LookupBatchBySequenceNumber when the batch hasn't been posted as of the latest
+// parent chain block.
+var ErrBatchNotFound = errors.New("sequencer batch not found")
+
+// LookupBatchBySequenceNumber returns the batch with the given sequence number. It binary searches for the parent
+// chain block the batch was posted in using GetBatchCount, so it only fetches that block's logs, but this needs
+// the parent chain node to serve calls at historical blocks back to the inbox's fromBlock.
+func (i *SequencerInbox) LookupBatchBySequenceNumber(ctx context.Context, seqNum uint64) (*SequencerInboxBatch, error) {
+	latest, err := i.client.BlockNumber(ctx)
+	if err != nil {
+		return nil, err
+	}
+	count, err := i.GetBatchCount(ctx, new(big.Int).SetUint64(latest))
+	if err != nil {
+		return nil, err
+	}
+	if count <= seqNum {
+		return nil, fmt.Errorf("%w: batch %v, as the inbox only has %v batches", ErrBatchNotFound, seqNum, count)
+	}
+
+	// Find the first block with more than seqNum batches
+	var low uint64
+	if i.fromBlock > 0 {
+		low = uint64(i.fromBlock)
+	}
+	high := latest
+	for low < high {
+		mid := low + (high-low)/2
+		count, err := i.GetBatchCount(ctx, new(big.Int).SetUint64(mid))
+		if err != nil {
+			return nil, err
+		}
+		if count > seqNum {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+
+	blockNumber := new(big.Int).SetUint64(low)
+	batches, err := i.LookupBatchesInRange(ctx, blockNumber, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	for _, batch := range batches {
+		if batch.SequenceNumber == seqNum {
+			return batch, nil
+		}
+	}
+	// This can happen if the parent chain reorged during the search
+	return nil, fmt.Errorf("%w: batch %v should have been posted in parent chain block %v but wasn't found there", ErrBatchNotFound, seqNum, low)
+}
+
+// LookupBatchesInRangeStream is like LookupBatchesInRange, but sends each batch on the returned batch channel
+// as soon as it's parsed, so processing can start before the whole range is fetched.
+// The batch channel is closed when the lookup is done. The error channel then yields the error that stopped
+// the lookup, if any, and is closed; batches sent before an error are still valid.
+func (i *SequencerInbox) LookupBatchesInRangeStream(ctx context.Context, from, to *big.Int) (<-chan *SequencerInboxBatch, <-chan error) {
+	batches := make(chan *SequencerInboxBatch)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		err := i.lookupBatchesInRange(ctx, from, to, func(batch *SequencerInboxBatch) error {
+			select {
+			case batches <- batch:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		close(batches)
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return batches, errs
+}
+
+// lookupBatchesInRange calls handle on each batch in the range in order, stopping at the first error.
+func (i *SequencerInbox) lookupBatchesInRange(ctx context.Context, from, to *big.Int, handle func(*SequencerInboxBatch) error) error {
+	if to != nil && to.IsInt64() && to.Int64() < i.fromBlock {
+		return nil
+	}
+	if from != nil && from.IsInt64() && from.Int64() < i.fromBlock {
+		from = big.NewInt(i.fromBlock)
+	}
+	var lastSeqNum *uint64
+	canonical := make(map[uint64]common.Hash)
+	return i.filterBatchDeliveredLogs(ctx, from, to, func(logs []types.Log) error {
+		for _, ethLog := range logs {
+			if i.CheckReorgs {
+				if err := i.checkCanonical(ctx, ethLog, canonical); err != nil {
+					return err
+				}
+			}
+			batch, err := i.parseBatchDeliveredLog(ethLog)
+			if err != nil {
+				return err
+			}
+			seqNum := batch.SequenceNumber
+			if lastSeqNum != nil {
+				if seqNum != *lastSeqNum+1 {
+					return &BatchesOutOfOrderError{Expected: *lastSeqNum + 1, Actual: seqNum}
+				}
+			}
+			lastSeqNum = &seqNum
+			if err := handle(batch); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (i *SequencerInbox) parseBatchDeliveredLog(ethLog types.Log) (*SequencerInboxBatch, error) {
+	if ethLog.Topics[0] != batchDeliveredID {
+		return nil, errors.New("unexpected log selector")
+	}
+	parsedLog, err := i.con.ParseSequencerBatchDelivered(ethLog)
+	if err != nil {
+		return nil, err
+	}
+	if !parsedLog.BatchSequenceNumber.IsUint64() {
+		return nil, fmt.Errorf("%w: %v", ErrNonUint64SequenceNumber, parsedLog.BatchSequenceNumber)
+	}
+	if !parsedLog.AfterDelayedMessagesRead.IsUint64() {
+		return nil, errors.New("sequencer inbox event has non-uint64 delayed messages read")
+	}
+	seqNum := parsedLog.BatchSequenceNumber.Uint64()
+	batch := &SequencerInboxBatch{
+		BlockHash:              ethLog.BlockHash,
+		ParentChainBlockNumber: ethLog.BlockNumber,
+		SequenceNumber:         seqNum,
+		BeforeInboxAcc:         parsedLog.BeforeAcc,
+		AfterInboxAcc:          parsedLog.AfterAcc,
+		AfterDelayedAcc:        parsedLog.DelayedAcc,
+		AfterDelayedCount:      parsedLog.AfterDelayedMessagesRead.Uint64(),
+		RawLog:                 ethLog,
+		TimeBounds:             parsedLog.TimeBounds,
+		DataLocation:           BatchDataLocation(parsedLog.DataLocation),
+		BridgeAddress:          ethLog.Address,
+		dataCache:              i.dataCache,
+		dataSource:             i.BatchDataSource,
+		blobVerifier:           i.blobVerifier,
+	}
+	if !batch.DataLocation.IsKnown() && i.SkipUnknownDataLocations {
+		log.Warn("skipping data of sequencer batch with unknown data location", "batch", seqNum, "dataLocation", batch.DataLocation)
+		batch.UnknownDataLocation = true
+	}
+	return batch, nil
+}
+
+// filterBatchDeliveredLogs fetches the batch delivered logs in the block range and passes them to handle in order.
+// If MaxBlockRangePerQuery is set and both ends of the range are known, the range is fetched in chunks,
+// and handle is called on each chunk's logs before the next chunk is fetched.
+func (i *SequencerInbox) filterBatchDeliveredLogs(ctx context.Context, from, to *big.Int, handle func([]types.Log) error) error {
 	query := ethereum.FilterQuery{
 		FromBlock: from,
 		ToBlock:   to,
 		Addresses: []common.Address{i.address},
 		Topics:    [][]common.Hash{{batchDeliveredID}},
 	}
-	logs, err := i.client.FilterLogs(ctx, query)
-	if err != nil {
-		return nil, err
+	if i.MaxBlockRangePerQuery == 0 || from == nil || to == nil || !from.IsUint64() || !to.IsUint64() {
+		logs, err := i.logFilterer.FilterLogs(ctx, query)
+		if err != nil {
+			return err
+		}
+		return handle(logs)
 	}
-	messages := make([]*SequencerInboxBatch, 0, len(logs))
-	var lastSeqNum *uint64
-	for _, log := range logs {
-		if log.Topics[0] != batchDeliveredID {
-			return nil, errors.New("unexpected log selector")
+	for start := from.Uint64(); start <= to.Uint64(); {
+		end := to.Uint64()
+		if end-start >= i.MaxBlockRangePerQuery {
+			end = start + i.MaxBlockRangePerQuery - 1
 		}
-		parsedLog, err := i.con.ParseSequencerBatchDelivered(log)
+		query.FromBlock = new(big.Int).SetUint64(start)
+		query.ToBlock = new(big.Int).SetUint64(end)
+		logs, err := i.logFilterer.FilterLogs(ctx, query)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("error fetching batch logs in blocks %v to %v: %w", start, end, err)
 		}
-		if !parsedLog.BatchSequenceNumber.IsUint64() {
-			return nil, errors.New("sequencer inbox event has non-uint64 sequence number")
+		if err := handle(logs); err != nil {
+			return err
 		}
-		if !parsedLog.AfterDelayedMessagesRead.IsUint64() {
-			return nil, errors.New("sequencer inbox event has non-uint64 delayed messages read")
+		if end == to.Uint64() {
+			break
 		}
+		start = end + 1
+	}
+	return nil
+}
 
-		seqNum := parsedLog.BatchSequenceNumber.Uint64()
-		if lastSeqNum != nil {
-			if seqNum != *lastSeqNum+1 {
-				return nil, fmt.Errorf("sequencer batches out of order; after batch %v got batch %v", *lastSeqNum, seqNum)
+// DedupBatches removes exact duplicates (same sequence number and parent chain block hash) from batches,
+// which show up when the results of lookups over overlapping block ranges are merged.
+// The order of first occurrences is preserved.
+// Two batches with the same sequence number but different block hashes are a genuine conflict
+// (i.e. a parent chain reorg happened between the lookups), which is returned as an error.
+func DedupBatches(batches []*SequencerInboxBatch) ([]*SequencerInboxBatch, error) {
+	seen := make(map[uint64]common.Hash, len(batches))
+	deduped := make([]*SequencerInboxBatch, 0, len(batches))
+	for _, batch := range batches {
+		if blockHash, ok := seen[batch.SequenceNumber]; ok {
+			if blockHash != batch.BlockHash {
+				return nil, fmt.Errorf("conflicting sequencer batches with sequence number %v: found in blocks %v and %v", batch.SequenceNumber, blockHash, batch.BlockHash)
 			}
+			continue
 		}
-		lastSeqNum = &seqNum
-		batch := &SequencerInboxBatch{
-			BlockHash:              log.BlockHash,
-			ParentChainBlockNumber: log.BlockNumber,
-			SequenceNumber:         seqNum,
-			BeforeInboxAcc:         parsedLog.BeforeAcc,
-			AfterInboxAcc:          parsedLog.AfterAcc,
-			AfterDelayedAcc:        parsedLog.DelayedAcc,
-			AfterDelayedCount:      parsedLog.AfterDelayedMessagesRead.Uint64(),
-			RawLog:                 log,
-			TimeBounds:             parsedLog.TimeBounds,
-			DataLocation:           BatchDataLocation(parsedLog.DataLocation),
-			BridgeAddress:          log.Address,
-		}
-		messages = append(messages, batch)
-	}
-	return messages, nil
+		seen[batch.SequenceNumber] = batch.BlockHash
+		deduped = append(deduped, batch)
+	}
+	return deduped, nil
+}
+
+// The maximum number of batches whose data is fetched from the parent chain at once
+const batchDataFetchParallelism = 8
+
+// forEachBatchConcurrently calls fn on each batch with at most parallelism calls in flight,
+// returning each call's error at the batch's index. Batches not yet started when ctx is done get ctx's error.
+func forEachBatchConcurrently(ctx context.Context, batches []*SequencerInboxBatch, parallelism int, fn func(ctx context.Context, idx int, batch *SequencerInboxBatch) error) []error {
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for idx, batch := range batches {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			for j := idx; j < len(batches); j++ {
+				errs[j] = ctx.Err()
+			}
+			wg.Wait()
+			return errs
+		}
+		wg.Add(1)
+		go func(idx int, batch *SequencerInboxBatch) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[idx] = fn(ctx, idx, batch)
+		}(idx, batch)
+	}
+	wg.Wait()
+	return errs
+}
+
+type BatchWithSize struct {
+	Batch *SequencerInboxBatch
+	// The length of the serialized batch (header and data), as used by the inbox accumulator
+	Size int
+	// Set if the batch's data couldn't be fetched, in which case Size is zero
+	Err error
+}
+
+// LookupBatchesWithSizes looks up the batches in the range and fetches their data concurrently to report their serialized sizes.
+// A failure to fetch one batch's data is reported in that batch's Err and doesn't fail the others.
+func (i *SequencerInbox) LookupBatchesWithSizes(ctx context.Context, from, to *big.Int) ([]BatchWithSize, error) {
+	batches, err := i.LookupBatchesInRange(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]int, len(batches))
+	errs := forEachBatchConcurrently(ctx, batches, batchDataFetchParallelism, func(ctx context.Context, idx int, batch *SequencerInboxBatch) error {
+		data, err := batch.Serialize(ctx, i.client)
+		if err != nil {
+			return err
+		}
+		sizes[idx] = len(data)
+		return nil
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	results := make([]BatchWithSize, len(batches))
+	for idx, batch := range batches {
+		results[idx] = BatchWithSize{
+			Batch: batch,
+			Size:  sizes[idx],
+			Err:   errs[idx],
+		}
+	}
+	return results, nil
 }
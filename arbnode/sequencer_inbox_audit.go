@@ -0,0 +1,97 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbnode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/offchainlabs/nitro/daprovider"
+)
+
+// BatchAudit holds the running totals of an AuditBatches scan.
+type BatchAudit struct {
+	Batches           uint64
+	SequencerMessages uint64
+	DelayedMessages   uint64
+	// The last parent chain block that has been fully scanned
+	ScannedToBlock uint64
+
+	lastAcc common.Hash
+}
+
+// TotalMessages is the number of messages the batches scanned so far produce.
+func (a *BatchAudit) TotalMessages() uint64 {
+	return a.SequencerMessages + a.DelayedMessages
+}
+
+func (a *BatchAudit) addBatch(ctx context.Context, client SequencerInboxBackend, batch *SequencerInboxBatch, dapReaders []daprovider.Reader) error {
+	if batch.SequenceNumber != a.Batches {
+		return fmt.Errorf("expected batch %v but got batch %v", a.Batches, batch.SequenceNumber)
+	}
+	if batch.BeforeInboxAcc != a.lastAcc {
+		return fmt.Errorf("batch %v has before accumulator %v but the previous batch ended with %v", batch.SequenceNumber, batch.BeforeInboxAcc, a.lastAcc)
+	}
+	if batch.AfterDelayedCount < a.DelayedMessages {
+		return fmt.Errorf("batch %v delayed message count went backwards from %v to %v", batch.SequenceNumber, a.DelayedMessages, batch.AfterDelayedCount)
+	}
+	seqMsg, err := batch.ParsePayload(ctx, client, dapReaders)
+	if err != nil {
+		return fmt.Errorf("failed to parse batch %v: %w", batch.SequenceNumber, err)
+	}
+	l2Messages, delayedReads := CountSegmentMessages(seqMsg.Segments)
+	if a.DelayedMessages+delayedReads > batch.AfterDelayedCount {
+		return fmt.Errorf("batch %v reads %v delayed messages past its delayed message count %v", batch.SequenceNumber, a.DelayedMessages+delayedReads-batch.AfterDelayedCount, batch.AfterDelayedCount)
+	}
+	a.Batches++
+	a.SequencerMessages += l2Messages
+	// Any delayed messages not explicitly read by a segment are read at the end of the batch
+	a.DelayedMessages = batch.AfterDelayedCount
+	a.lastAcc = batch.AfterInboxAcc
+	// Don't keep the batch data around, the scan may cover the whole chain
+	batch.Serialized = nil
+	return nil
+}
+
+// AuditBatches scans every batch from the inbox deployment up to toBlock, counting the sequencer and
+// delayed messages they produce and checking that sequence numbers, accumulators, and delayed message
+// counts are consistent from one batch to the next.
+// Batches are looked up blocksPerQuery parent chain blocks at a time so memory use doesn't grow with the chain.
+// If progress is non-nil, it's called with the running totals after each range is scanned.
+func (i *SequencerInbox) AuditBatches(ctx context.Context, toBlock *big.Int, blocksPerQuery uint64, dapReaders []daprovider.Reader, progress func(*BatchAudit)) (*BatchAudit, error) {
+	if blocksPerQuery == 0 {
+		return nil, errors.New("blocksPerQuery must be positive")
+	}
+	audit := &BatchAudit{}
+	from := big.NewInt(i.fromBlock)
+	step := new(big.Int).SetUint64(blocksPerQuery - 1)
+	for from.Cmp(toBlock) <= 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		to := new(big.Int).Add(from, step)
+		if to.Cmp(toBlock) > 0 {
+			to.Set(toBlock)
+		}
+		batches, err := i.LookupBatchesInRange(ctx, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, batch := range batches {
+			if err := audit.addBatch(ctx, i.client, batch, dapReaders); err != nil {
+				return nil, err
+			}
+		}
+		audit.ScannedToBlock = to.Uint64()
+		if progress != nil {
+			progress(audit)
+		}
+		from = to.Add(to, common.Big1)
+	}
+	return audit, nil
+}
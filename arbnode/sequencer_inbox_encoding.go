@@ -0,0 +1,206 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbnode
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// batchEncodingVersion is the first byte of a binary encoded SequencerInboxBatch.
+// It must be bumped whenever the encoding changes.
+const batchEncodingVersion byte = 1
+
+const (
+	batchFlagUnknownDataLocation byte = 1 << iota
+	batchFlagSerialized
+	batchFlagLogRemoved
+)
+
+// MarshalBinary encodes the batch compactly, including its raw log and cached serialized data if present,
+// for passing batches between processes. Variable length fields are prefixed with their uvarint length.
+func (m *SequencerInboxBatch) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(batchEncodingVersion)
+	writeUint64 := func(v uint64) {
+		var data [8]byte
+		binary.BigEndian.PutUint64(data[:], v)
+		buf.Write(data[:])
+	}
+	writeBytes := func(data []byte) {
+		buf.Write(binary.AppendUvarint(nil, uint64(len(data))))
+		buf.Write(data)
+	}
+
+	buf.Write(m.BlockHash[:])
+	writeUint64(m.ParentChainBlockNumber)
+	writeUint64(m.SequenceNumber)
+	buf.Write(m.BeforeInboxAcc[:])
+	buf.Write(m.AfterInboxAcc[:])
+	buf.Write(m.AfterDelayedAcc[:])
+	writeUint64(m.AfterDelayedCount)
+	writeUint64(m.TimeBounds.MinTimestamp)
+	writeUint64(m.TimeBounds.MaxTimestamp)
+	writeUint64(m.TimeBounds.MinBlockNumber)
+	writeUint64(m.TimeBounds.MaxBlockNumber)
+	buf.WriteByte(byte(m.DataLocation))
+	buf.Write(m.BridgeAddress[:])
+
+	var flags byte
+	if m.UnknownDataLocation {
+		flags |= batchFlagUnknownDataLocation
+	}
+	if m.Serialized != nil {
+		flags |= batchFlagSerialized
+	}
+	if m.RawLog.Removed {
+		flags |= batchFlagLogRemoved
+	}
+	buf.WriteByte(flags)
+
+	buf.Write(m.RawLog.Address[:])
+	writeUint64(m.RawLog.BlockNumber)
+	buf.Write(m.RawLog.TxHash[:])
+	writeUint64(uint64(m.RawLog.TxIndex))
+	buf.Write(m.RawLog.BlockHash[:])
+	writeUint64(uint64(m.RawLog.Index))
+	buf.Write(binary.AppendUvarint(nil, uint64(len(m.RawLog.Topics))))
+	for _, topic := range m.RawLog.Topics {
+		buf.Write(topic[:])
+	}
+	writeBytes(m.RawLog.Data)
+
+	if m.Serialized != nil {
+		writeBytes(m.Serialized)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a batch encoded by MarshalBinary.
+func (m *SequencerInboxBatch) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty batch encoding")
+	}
+	if data[0] != batchEncodingVersion {
+		return fmt.Errorf("unsupported batch encoding version %v", data[0])
+	}
+	rd := bytes.NewReader(data[1:])
+	var err error
+	read := func(out []byte) {
+		if err == nil {
+			_, err = io.ReadFull(rd, out)
+		}
+	}
+	readUint64 := func() uint64 {
+		var data [8]byte
+		read(data[:])
+		return binary.BigEndian.Uint64(data[:])
+	}
+	readLength := func() int {
+		if err != nil {
+			return 0
+		}
+		var length uint64
+		length, err = binary.ReadUvarint(rd)
+		if err == nil && length > uint64(rd.Len()) {
+			err = fmt.Errorf("batch encoding has length %v but only %v bytes remain", length, rd.Len())
+		}
+		return int(length) // #nosec G115
+	}
+	readBytes := func() []byte {
+		out := make([]byte, readLength())
+		read(out)
+		return out
+	}
+	readByte := func() byte {
+		var b [1]byte
+		read(b[:])
+		return b[0]
+	}
+
+	var batch SequencerInboxBatch
+	read(batch.BlockHash[:])
+	batch.ParentChainBlockNumber = readUint64()
+	batch.SequenceNumber = readUint64()
+	read(batch.BeforeInboxAcc[:])
+	read(batch.AfterInboxAcc[:])
+	read(batch.AfterDelayedAcc[:])
+	batch.AfterDelayedCount = readUint64()
+	batch.TimeBounds.MinTimestamp = readUint64()
+	batch.TimeBounds.MaxTimestamp = readUint64()
+	batch.TimeBounds.MinBlockNumber = readUint64()
+	batch.TimeBounds.MaxBlockNumber = readUint64()
+	batch.DataLocation = BatchDataLocation(readByte())
+	read(batch.BridgeAddress[:])
+	flags := readByte()
+	batch.UnknownDataLocation = flags&batchFlagUnknownDataLocation != 0
+	batch.RawLog.Removed = flags&batchFlagLogRemoved != 0
+
+	read(batch.RawLog.Address[:])
+	batch.RawLog.BlockNumber = readUint64()
+	read(batch.RawLog.TxHash[:])
+	batch.RawLog.TxIndex = uint(readUint64()) // #nosec G115
+	read(batch.RawLog.BlockHash[:])
+	batch.RawLog.Index = uint(readUint64()) // #nosec G115
+	topics := readLength()
+	if err == nil && topics*common.HashLength > rd.Len() {
+		err = fmt.Errorf("batch encoding has %v topics but only %v bytes remain", topics, rd.Len())
+	}
+	if err == nil && topics > 0 {
+		batch.RawLog.Topics = make([]common.Hash, topics)
+		for i := range batch.RawLog.Topics {
+			read(batch.RawLog.Topics[i][:])
+		}
+	}
+	batch.RawLog.Data = readBytes()
+
+	if flags&batchFlagSerialized != 0 {
+		batch.Serialized = readBytes()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode batch: %w", err)
+	}
+	if rd.Len() != 0 {
+		return fmt.Errorf("batch encoding has %v trailing bytes", rd.Len())
+	}
+	*m = batch
+	return nil
+}
+
+// BatchIndexEntry locates a batch's serialized data within a blob built by SerializeRange.
+type BatchIndexEntry struct {
+	SequenceNumber uint64
+	Offset         uint64
+	Length         uint64
+}
+
+// SerializeRange serializes the batches and concatenates them into one blob, for archiving them compactly,
+// with an index entry per batch, in the same order, giving where its serialized data is within the blob.
+// It stops with ctx's error if ctx is done between batches.
+func (i *SequencerInbox) SerializeRange(ctx context.Context, batches []*SequencerInboxBatch) ([]byte, []BatchIndexEntry, error) {
+	var blob []byte
+	index := make([]BatchIndexEntry, 0, len(batches))
+	for _, batch := range batches {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		serialized, err := batch.Serialize(ctx, i.client)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to serialize batch %v: %w", batch.SequenceNumber, err)
+		}
+		index = append(index, BatchIndexEntry{
+			SequenceNumber: batch.SequenceNumber,
+			Offset:         uint64(len(blob)),
+			Length:         uint64(len(serialized)),
+		})
+		blob = append(blob, serialized...)
+	}
+	return blob, index, nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbnode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/offchainlabs/nitro/arbcompress"
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+	"github.com/offchainlabs/nitro/arbstate"
+	"github.com/offchainlabs/nitro/daprovider"
+)
+
+// ParsePayload serializes the batch (if it isn't already) and decodes it into its segments,
+// the same way the inbox multiplexer would. dapReaders are needed to decode batches whose data
+// isn't posted to the parent chain directly (e.g. blobs or DAS); keysets aren't validated.
+func (m *SequencerInboxBatch) ParsePayload(ctx context.Context, client SequencerInboxBackend, dapReaders []daprovider.Reader) (*arbstate.SequencerMessage, error) {
+	data, err := m.Serialize(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	return arbstate.ParseSequencerMessage(ctx, m.SequenceNumber, m.BlockHash, data, dapReaders, daprovider.KeysetDontValidate)
+}
+
+// DecodeMessages decodes the batch into the messages it sequences, the same way the inbox multiplexer does during
+// replay, so they can be passed to arbos.ProduceBlock in order, each with its DelayedMessagesRead.
+// delayedMessagesRead is the delayed message count before the batch, i.e. the previous batch's AfterDelayedCount.
+// readDelayed returns the delayed message with the given index for each one the batch reads, and may be nil if the
+// batch doesn't read any. Like ParsePayload, dapReaders are needed for batches posted elsewhere than the parent chain.
+func (m *SequencerInboxBatch) DecodeMessages(
+	ctx context.Context,
+	client SequencerInboxBackend,
+	dapReaders []daprovider.Reader,
+	delayedMessagesRead uint64,
+	readDelayed func(seqNum uint64) (*arbostypes.L1IncomingMessage, error),
+) ([]*arbostypes.MessageWithMetadata, error) {
+	data, err := m.Serialize(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	backend := &singleBatchInboxBackend{
+		batchNum:    m.SequenceNumber,
+		blockHash:   m.BlockHash,
+		data:        data,
+		readDelayed: readDelayed,
+	}
+	multiplexer := arbstate.NewInboxMultiplexer(backend, delayedMessagesRead, dapReaders, daprovider.KeysetDontValidate)
+	var messages []*arbostypes.MessageWithMetadata
+	for !backend.done {
+		msg, err := multiplexer.Pop(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode message %v of batch %v: %w", len(messages), m.SequenceNumber, err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// singleBatchInboxBackend feeds a single batch to the inbox multiplexer.
+type singleBatchInboxBackend struct {
+	batchNum    uint64
+	blockHash   common.Hash
+	data        []byte
+	position    uint64
+	done        bool
+	readDelayed func(seqNum uint64) (*arbostypes.L1IncomingMessage, error)
+}
+
+func (b *singleBatchInboxBackend) PeekSequencerInbox() ([]byte, common.Hash, error) {
+	if b.done {
+		return nil, common.Hash{}, fmt.Errorf("no batch after batch %v", b.batchNum)
+	}
+	return b.data, b.blockHash, nil
+}
+
+func (b *singleBatchInboxBackend) GetSequencerInboxPosition() uint64 {
+	return b.batchNum
+}
+
+func (b *singleBatchInboxBackend) AdvanceSequencerInbox() {
+	b.done = true
+}
+
+func (b *singleBatchInboxBackend) GetPositionWithinMessage() uint64 {
+	return b.position
+}
+
+func (b *singleBatchInboxBackend) SetPositionWithinMessage(pos uint64) {
+	b.position = pos
+}
+
+func (b *singleBatchInboxBackend) ReadDelayedInbox(seqNum uint64) (*arbostypes.L1IncomingMessage, error) {
+	if b.readDelayed == nil {
+		return nil, fmt.Errorf("batch %v reads delayed message %v, but no delayed messages are available", b.batchNum, seqNum)
+	}
+	return b.readDelayed(seqNum)
+}
+
+// ErrBatchMessageCountMismatch is returned by ParseBatchMessages when a batch doesn't contain the expected number of L2 messages.
+var ErrBatchMessageCountMismatch = errors.New("batch L2 message count mismatch")
+
+// ParseBatchMessages decodes the batch's payload like ParsePayload and counts its L2 messages.
+// If expectedL2Messages is non-nil, e.g. a count from an independent source, it also checks the batch
+// contains exactly that many, to catch truncated payloads or decoding bugs.
+func (m *SequencerInboxBatch) ParseBatchMessages(ctx context.Context, client SequencerInboxBackend, dapReaders []daprovider.Reader, expectedL2Messages *uint64) (*arbstate.SequencerMessage, uint64, error) {
+	msg, err := m.ParsePayload(ctx, client, dapReaders)
+	if err != nil {
+		return nil, 0, err
+	}
+	l2Messages, _ := CountSegmentMessages(msg.Segments)
+	if expectedL2Messages != nil && l2Messages != *expectedL2Messages {
+		return nil, 0, fmt.Errorf("%w: batch %v has %v L2 messages but expected %v", ErrBatchMessageCountMismatch, m.SequenceNumber, l2Messages, *expectedL2Messages)
+	}
+	return msg, l2Messages, nil
+}
+
+// ErrSegmentsUnavailable is returned by SegmentCount for batches whose data isn't posted to the parent chain directly.
+var ErrSegmentsUnavailable = errors.New("batch segments unavailable without fetching its data")
+
+// SegmentCount returns how many segments the batch's payload decompresses to, as a cheap estimate of how much work
+// executing the batch takes, without decoding the L2 messages in them. Force inclusions and empty batches have no
+// segments, so they return 0. Blob and DAS batches would need their data fetched first, so they return ErrSegmentsUnavailable.
+func (m *SequencerInboxBatch) SegmentCount(ctx context.Context, client SequencerInboxBackend) (int, error) {
+	if _, err := m.Serialize(ctx, client); err != nil {
+		return 0, err
+	}
+	switch contentType := m.ContentType(); contentType {
+	case BatchContentForceInclusion, BatchContentEmpty:
+		return 0, nil
+	case BatchContentBlob, BatchContentDACertificate:
+		return 0, fmt.Errorf("%w: batch %v has %v content", ErrSegmentsUnavailable, m.SequenceNumber, contentType)
+	}
+	msg, err := m.ParsePayload(ctx, client, nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg.Segments), nil
+}
+
+// CountSegmentMessages counts the L2 messages and the explicit delayed message reads in a batch's segments.
+// Note that the inbox multiplexer also reads any remaining delayed messages up to the batch's
+// AfterDelayedMessages after the last segment, so delayedMessages is a lower bound.
+func CountSegmentMessages(segments [][]byte) (l2Messages uint64, delayedMessages uint64) {
+	for _, segment := range segments {
+		if len(segment) == 0 {
+			continue
+		}
+		switch segment[0] {
+		case arbstate.BatchSegmentKindL2Message, arbstate.BatchSegmentKindL2MessageBrotli:
+			l2Messages++
+		case arbstate.BatchSegmentKindDelayedMessages:
+			delayedMessages++
+		}
+	}
+	return l2Messages, delayedMessages
+}
+
+// BatchContentType classifies what a batch's data is, independent of where it was posted.
+type BatchContentType uint8
+
+const (
+	BatchContentUnknown BatchContentType = iota
+	BatchContentCompressedMessages
+	BatchContentBlob
+	BatchContentDACertificate
+	BatchContentForceInclusion
+	BatchContentEmpty
+)
+
+func (c BatchContentType) String() string {
+	switch c {
+	case BatchContentCompressedMessages:
+		return "compressed messages"
+	case BatchContentBlob:
+		return "blob"
+	case BatchContentDACertificate:
+		return "data availability certificate"
+	case BatchContentForceInclusion:
+		return "force inclusion"
+	case BatchContentEmpty:
+		return "empty"
+	default:
+		return "unknown"
+	}
+}
+
+// ContentType classifies the batch's serialized data.
+// It returns BatchContentUnknown if the batch hasn't been serialized yet.
+func (m *SequencerInboxBatch) ContentType() BatchContentType {
+	if len(m.Serialized) < BatchHeaderLength {
+		return BatchContentUnknown
+	}
+	if m.IsForceInclusion() {
+		return BatchContentForceInclusion
+	}
+	payload := m.Serialized[BatchHeaderLength:]
+	if len(payload) == 0 {
+		return BatchContentEmpty
+	}
+	switch {
+	case daprovider.IsBlobHashesHeaderByte(payload[0]):
+		return BatchContentBlob
+	case daprovider.IsDASMessageHeaderByte(payload[0]):
+		return BatchContentDACertificate
+	case daprovider.IsBrotliMessageHeaderByte(payload[0]):
+		return BatchContentCompressedMessages
+	default:
+		return BatchContentUnknown
+	}
+}
+
+// CompressionStats returns the size of the batch's compressed payload as posted on-chain (excluding the header)
+// and the size it decompresses to. Their ratio tracks how efficiently the batch poster uses data availability.
+// Only batches posted directly to the parent chain can be measured; blob and DAS batches return an error.
+func (m *SequencerInboxBatch) CompressionStats(ctx context.Context, client SequencerInboxBackend) (compressed int, decompressed int, err error) {
+	if _, err := m.Serialize(ctx, client); err != nil {
+		return 0, 0, err
+	}
+	switch contentType := m.ContentType(); contentType {
+	case BatchContentForceInclusion, BatchContentEmpty:
+		return 0, 0, nil
+	case BatchContentCompressedMessages:
+		payload := m.Serialized[BatchHeaderLength:]
+		data, err := arbcompress.Decompress(payload[1:], arbstate.MaxDecompressedLen)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to decompress batch %v: %w", m.SequenceNumber, err)
+		}
+		return len(payload), len(data), nil
+	default:
+		return 0, 0, fmt.Errorf("can't compute compression stats for batch %v with %v content", m.SequenceNumber, contentType)
+	}
+}
+
+// EstimateCompressedSize returns how many bytes the serialized batch takes up once brotli compressed at the given
+// level, the same way L1 pricing estimates the data availability cost of a tx. client is only used if the batch
+// isn't serialized yet. Results are cached per level, so estimating the same batch again is free.
+func (m *SequencerInboxBatch) EstimateCompressedSize(ctx context.Context, client SequencerInboxBackend, level int) (uint64, error) {
+	if level < 0 || level > arbcompress.LEVEL_WELL {
+		return 0, fmt.Errorf("invalid brotli compression level %v (max %v)", level, arbcompress.LEVEL_WELL)
+	}
+	if size, ok := m.compressedSizes[level]; ok {
+		return size, nil
+	}
+	serialized, err := m.Serialize(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+	compressed, err := arbcompress.CompressLevel(serialized, uint64(level))
+	if err != nil {
+		return 0, fmt.Errorf("failed to compress batch %v: %w", m.SequenceNumber, err)
+	}
+	if m.compressedSizes == nil {
+		m.compressedSizes = make(map[int]uint64)
+	}
+	m.compressedSizes[level] = uint64(len(compressed))
+	return uint64(len(compressed)), nil
+}
+
+// DelayedMessagesReadInRange returns how many delayed messages the consecutive batches read in total,
+// given the delayed message count before the first of them (the previous batch's AfterDelayedCount).
+func DelayedMessagesReadInRange(batches []*SequencerInboxBatch, startDelayedCount uint64) (uint64, error) {
+	if len(batches) == 0 {
+		return 0, nil
+	}
+	prevCount := startDelayedCount
+	for i, batch := range batches {
+		if i > 0 && batch.SequenceNumber != batches[i-1].SequenceNumber+1 {
+			return 0, fmt.Errorf("batches aren't consecutive: batch %v follows batch %v", batch.SequenceNumber, batches[i-1].SequenceNumber)
+		}
+		if batch.AfterDelayedCount < prevCount {
+			return 0, fmt.Errorf("batch %v has delayed count %v, less than the previous count %v", batch.SequenceNumber, batch.AfterDelayedCount, prevCount)
+		}
+		prevCount = batch.AfterDelayedCount
+	}
+	return prevCount - startDelayedCount, nil
+}
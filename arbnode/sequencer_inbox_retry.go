@@ -0,0 +1,95 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbnode
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ReadRetryPolicy controls how the SequencerInbox retries contract reads (GetBatchCount and GetAccumulator)
+// that fail with a transient error, like a dropped connection or a rate limit. Reverts are never retried.
+type ReadRetryPolicy struct {
+	MaxAttempts int           // Including the first attempt; 0 or 1 disables retries
+	BaseBackoff time.Duration // The wait before the first retry, doubled before each later one
+	Jitter      float64       // Up to this fraction of each wait is randomly added to it, to spread out retries
+}
+
+var DefaultReadRetryPolicy = ReadRetryPolicy{
+	MaxAttempts: 4,
+	BaseBackoff: 250 * time.Millisecond,
+	Jitter:      0.2,
+}
+
+// NoReadRetries makes reads fail on the first error.
+var NoReadRetries = ReadRetryPolicy{}
+
+var transientReadErrorRegexp = regexp.MustCompile(`(?i)rate limit|too many requests|connection reset|connection refused|broken pipe|i/o timeout|unexpected EOF|websocket: close`)
+
+// isRetryableReadError reports whether err is likely a transient provider or network failure,
+// as opposed to the call itself failing, e.g. because the contract reverted.
+func isRetryableReadError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	// Reverts carry their revert data
+	var dataErr rpc.DataError
+	if errors.As(err, &dataErr) || strings.Contains(err.Error(), "execution reverted") {
+		return false
+	}
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == 429 || httpErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	return transientReadErrorRegexp.MatchString(err.Error())
+}
+
+func (p ReadRetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.BaseBackoff << retry
+	if backoff < p.BaseBackoff {
+		// Overflowed
+		backoff = p.BaseBackoff
+	}
+	if p.Jitter > 0 {
+		backoff += time.Duration(rand.Float64() * p.Jitter * float64(backoff)) // #nosec G404
+	}
+	return backoff
+}
+
+// retryRead calls read until it succeeds, fails with an error that isn't retryable, or the policy's attempts run out.
+// It stops waiting as soon as ctx is done, returning the last error from read.
+func retryRead[T any](ctx context.Context, policy ReadRetryPolicy, name string, read func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := read()
+		if err == nil || attempt >= policy.MaxAttempts || !isRetryableReadError(err) {
+			return result, err
+		}
+		backoff := policy.backoff(attempt - 1)
+		log.Debug("retrying sequencer inbox read", "read", name, "attempt", attempt, "backoff", backoff, "err", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		case <-timer.C:
+		}
+	}
+}
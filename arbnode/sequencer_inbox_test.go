@@ -0,0 +1,1116 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbnode
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/offchainlabs/nitro/arbcompress"
+	"github.com/offchainlabs/nitro/arbos"
+	"github.com/offchainlabs/nitro/arbos/arbosState"
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+	"github.com/offchainlabs/nitro/arbstate"
+	"github.com/offchainlabs/nitro/cmd/chaininfo"
+	"github.com/offchainlabs/nitro/daprovider"
+	"github.com/offchainlabs/nitro/solgen/go/bridgegen"
+	"github.com/offchainlabs/nitro/util/blobs"
+	"github.com/offchainlabs/nitro/util/testhelpers"
+)
+
+func TestDedupBatches(t *testing.T) {
+	hashA := common.HexToHash("0xa")
+	hashB := common.HexToHash("0xb")
+	batches := []*SequencerInboxBatch{
+		{SequenceNumber: 1, BlockHash: hashA},
+		{SequenceNumber: 2, BlockHash: hashA},
+		{SequenceNumber: 2, BlockHash: hashA},
+		{SequenceNumber: 3, BlockHash: hashB},
+		{SequenceNumber: 1, BlockHash: hashA},
+	}
+	deduped, err := DedupBatches(batches)
+	Require(t, err)
+	if len(deduped) != 3 {
+		Fail(t, "expected 3 batches after dedup, got", len(deduped))
+	}
+	for i, batch := range deduped {
+		// #nosec G115
+		if batch.SequenceNumber != uint64(i+1) {
+			Fail(t, "unexpected batch order", i, batch.SequenceNumber)
+		}
+	}
+
+	batches = append(batches, &SequencerInboxBatch{SequenceNumber: 3, BlockHash: hashA})
+	if _, err := DedupBatches(batches); err == nil {
+		Fail(t, "expected conflicting batches to error")
+	}
+}
+
+func TestCountSegmentMessages(t *testing.T) {
+	segments := [][]byte{
+		{arbstate.BatchSegmentKindAdvanceTimestamp, 1},
+		{arbstate.BatchSegmentKindL2Message, 1, 2, 3},
+		{},
+		{arbstate.BatchSegmentKindDelayedMessages},
+		{arbstate.BatchSegmentKindL2MessageBrotli, 4},
+		{arbstate.BatchSegmentKindAdvanceL1BlockNumber, 1},
+		{arbstate.BatchSegmentKindDelayedMessages},
+	}
+	l2Messages, delayedMessages := CountSegmentMessages(segments)
+	if l2Messages != 2 || delayedMessages != 2 {
+		Fail(t, "unexpected message counts", l2Messages, delayedMessages)
+	}
+}
+
+func TestSerializeUnknownDataLocation(t *testing.T) {
+	ctx := context.Background()
+	batch := &SequencerInboxBatch{DataLocation: BatchDataBlobHashes + 1}
+	if _, err := batch.Serialize(ctx, nil); err == nil {
+		Fail(t, "expected unknown data location to fail serialization by default")
+	}
+	batch.UnknownDataLocation = true
+	data, err := batch.Serialize(ctx, nil)
+	Require(t, err)
+	if len(data) != BatchHeaderLength {
+		Fail(t, "expected skipped batch to serialize to just its header, got length", len(data))
+	}
+}
+
+func TestSerializeForceInclusion(t *testing.T) {
+	batch := &SequencerInboxBatch{DataLocation: BatchDataNone, AfterDelayedCount: 5}
+	batch.TimeBounds = bridgegen.IBridgeTimeBounds{MinTimestamp: 1, MaxTimestamp: 2, MinBlockNumber: 3, MaxBlockNumber: 4}
+	if !batch.IsForceInclusion() {
+		Fail(t, "expected a batch without data to be a force inclusion")
+	}
+	data, err := batch.Serialize(context.Background(), nil)
+	Require(t, err)
+	if len(data) != BatchHeaderLength {
+		Fail(t, "expected force inclusion batch to serialize to just its header, got length", len(data))
+	}
+	timeBounds, afterDelayedCount, payload, err := ParseSerializedBatchHeader(data)
+	Require(t, err)
+	if timeBounds != batch.TimeBounds || afterDelayedCount != batch.AfterDelayedCount || len(payload) != 0 {
+		Fail(t, "unexpected header", timeBounds, afterDelayedCount, payload)
+	}
+	if (&SequencerInboxBatch{DataLocation: BatchDataTxInput}).IsForceInclusion() {
+		Fail(t, "expected a batch posted in tx input not to be a force inclusion")
+	}
+}
+
+func TestValidateSerializedLength(t *testing.T) {
+	Require(t, ValidateSerializedLength(make([]byte, BatchHeaderLength)))
+	if err := ValidateSerializedLength(make([]byte, BatchHeaderLength-1)); err == nil {
+		Fail(t, "expected truncated batch to be rejected")
+	}
+}
+
+func TestParseBatchHeader(t *testing.T) {
+	batch := &SequencerInboxBatch{
+		DataLocation:        BatchDataBlobHashes + 1,
+		UnknownDataLocation: true,
+		AfterDelayedCount:   5,
+	}
+	batch.TimeBounds.MinTimestamp = 1
+	batch.TimeBounds.MaxTimestamp = 2
+	batch.TimeBounds.MinBlockNumber = 3
+	batch.TimeBounds.MaxBlockNumber = 4
+	data, err := batch.Serialize(context.Background(), nil)
+	Require(t, err)
+	header, err := ParseBatchHeader(data)
+	Require(t, err)
+	expected := BatchHeader{MinTimestamp: 1, MaxTimestamp: 2, MinBlockNumber: 3, MaxBlockNumber: 4, AfterDelayedCount: 5}
+	if *header != expected {
+		Fail(t, "unexpected header", header)
+	}
+	if _, err := ParseBatchHeader(data[:BatchHeaderLength-1]); err == nil {
+		Fail(t, "expected truncated header to be rejected")
+	}
+}
+
+func TestBatchContentType(t *testing.T) {
+	header := make([]byte, BatchHeaderLength)
+	cases := []struct {
+		location BatchDataLocation
+		payload  []byte
+		expected BatchContentType
+	}{
+		{BatchDataNone, nil, BatchContentForceInclusion},
+		{BatchDataTxInput, nil, BatchContentEmpty},
+		{BatchDataTxInput, []byte{daprovider.BrotliMessageHeaderByte, 1}, BatchContentCompressedMessages},
+		{BatchDataBlobHashes, []byte{daprovider.BlobHashesHeaderFlag}, BatchContentBlob},
+		{BatchDataTxInput, []byte{daprovider.DASMessageHeaderFlag}, BatchContentDACertificate},
+	}
+	for _, c := range cases {
+		batch := &SequencerInboxBatch{
+			DataLocation: c.location,
+			Serialized:   append(append([]byte{}, header...), c.payload...),
+		}
+		if contentType := batch.ContentType(); contentType != c.expected {
+			Fail(t, "expected content type", c.expected, "got", contentType)
+		}
+	}
+	if contentType := (&SequencerInboxBatch{}).ContentType(); contentType != BatchContentUnknown {
+		Fail(t, "expected unserialized batch to have unknown content type, got", contentType)
+	}
+}
+
+func TestLookupBatchesBeforeFromBlock(t *testing.T) {
+	inbox := &SequencerInbox{fromBlock: 100}
+	batches, err := inbox.LookupBatchesInRange(context.Background(), big.NewInt(10), big.NewInt(99))
+	Require(t, err)
+	if len(batches) != 0 {
+		Fail(t, "expected no batches before the inbox's from block, got", len(batches))
+	}
+}
+
+func TestComputeAfterInboxAcc(t *testing.T) {
+	serialized := append(make([]byte, BatchHeaderLength), 1, 2, 3)
+	delayedAcc := common.HexToHash("0x02")
+	first := ComputeAfterInboxAcc(common.Hash{}, serialized, delayedAcc)
+	dataHash := crypto.Keccak256(serialized)
+	expected := crypto.Keccak256Hash(common.Hash{}.Bytes(), dataHash, delayedAcc.Bytes())
+	if first != expected {
+		Fail(t, "unexpected accumulator", first, "expected", expected)
+	}
+	if ComputeAfterInboxAcc(first, serialized, delayedAcc) == first {
+		Fail(t, "expected the accumulator to change with each batch")
+	}
+	if ComputeAfterInboxAcc(common.Hash{}, serialized, common.Hash{}) == first {
+		Fail(t, "expected the accumulator to depend on the delayed accumulator")
+	}
+}
+
+func TestVerifyAccumulator(t *testing.T) {
+	serialized := append(make([]byte, BatchHeaderLength), 1, 2, 3)
+	batch := &SequencerInboxBatch{
+		DataLocation:    BatchDataTxInput,
+		BeforeInboxAcc:  common.HexToHash("0x01"),
+		AfterDelayedAcc: common.HexToHash("0x02"),
+	}
+	if _, err := batch.VerifyAccumulator(); err == nil {
+		Fail(t, "expected verifying an unserialized batch to fail")
+	}
+	batch.Serialized = serialized
+	batch.AfterInboxAcc = ComputeAfterInboxAcc(batch.BeforeInboxAcc, serialized, batch.AfterDelayedAcc)
+	ok, err := batch.VerifyAccumulator()
+	Require(t, err)
+	if !ok {
+		Fail(t, "expected the known-good batch to verify")
+	}
+
+	batch.Serialized = append(append([]byte{}, serialized[:len(serialized)-1]...), 4)
+	ok, err = batch.VerifyAccumulator()
+	Require(t, err)
+	if ok {
+		Fail(t, "expected the mutated batch not to verify")
+	}
+	batch.Serialized = serialized[:len(serialized)-1]
+	ok, err = batch.VerifyAccumulator()
+	Require(t, err)
+	if ok {
+		Fail(t, "expected the truncated batch not to verify")
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	data := make([]byte, 1000)
+	compressedData, err := arbcompress.CompressWell(data)
+	Require(t, err)
+	serialized := make([]byte, BatchHeaderLength)
+	serialized = append(serialized, daprovider.BrotliMessageHeaderByte)
+	serialized = append(serialized, compressedData...)
+	batch := &SequencerInboxBatch{DataLocation: BatchDataTxInput, Serialized: serialized}
+	compressed, decompressed, err := batch.CompressionStats(context.Background(), nil)
+	Require(t, err)
+	if compressed != len(compressedData)+1 || decompressed != len(data) {
+		Fail(t, "unexpected compression stats", compressed, decompressed)
+	}
+}
+
+func TestEstimateCompressedSize(t *testing.T) {
+	serialized := make([]byte, BatchHeaderLength)
+	serialized = append(serialized, daprovider.BrotliMessageHeaderByte)
+	serialized = append(serialized, bytes.Repeat([]byte("nitro"), 200)...)
+	batch := &SequencerInboxBatch{DataLocation: BatchDataTxInput, Serialized: serialized}
+	var estimated uint64
+	for _, level := range []int{0, arbcompress.LEVEL_WELL} {
+		expected, err := arbcompress.CompressLevel(serialized, uint64(level))
+		Require(t, err)
+		size, err := batch.EstimateCompressedSize(context.Background(), nil, level)
+		Require(t, err)
+		if size != uint64(len(expected)) {
+			Fail(t, "level", level, "estimated", size, "bytes instead of", len(expected))
+		}
+		estimated = size
+	}
+
+	// Later estimates at the same level are served from the cache
+	batch.Serialized = serialized[:BatchHeaderLength]
+	size, err := batch.EstimateCompressedSize(context.Background(), nil, arbcompress.LEVEL_WELL)
+	Require(t, err)
+	if size != estimated {
+		Fail(t, "estimate wasn't cached", size)
+	}
+	if _, err := batch.EstimateCompressedSize(context.Background(), nil, arbcompress.LEVEL_WELL+1); err == nil {
+		Fail(t, "expected an invalid level to fail")
+	}
+}
+
+func TestCachedAccumulator(t *testing.T) {
+	inbox := &SequencerInbox{}
+	if _, ok := inbox.getCachedAccumulator(1, nil); ok {
+		Fail(t, "expected no cache hits with the cache disabled")
+	}
+	inbox.EnableAccumulatorCache(10, 64)
+	acc := common.HexToHash("0x01")
+	inbox.accCache.Add(1, cachedAccumulator{acc: acc, blockNumber: 100})
+	if cached, ok := inbox.getCachedAccumulator(1, big.NewInt(100)); !ok || cached != acc {
+		Fail(t, "expected a cache hit at the cached block")
+	}
+	if cached, ok := inbox.getCachedAccumulator(1, nil); !ok || cached != acc {
+		Fail(t, "expected a cache hit at the latest block")
+	}
+	if _, ok := inbox.getCachedAccumulator(1, big.NewInt(99)); ok {
+		Fail(t, "expected a cache miss before the cached block")
+	}
+}
+
+func TestDelayedMessagesReadInRange(t *testing.T) {
+	batches := []*SequencerInboxBatch{
+		{SequenceNumber: 3, AfterDelayedCount: 12},
+		{SequenceNumber: 4, AfterDelayedCount: 12},
+		{SequenceNumber: 5, AfterDelayedCount: 15},
+	}
+	read, err := DelayedMessagesReadInRange(batches, 10)
+	Require(t, err)
+	if read != 5 {
+		Fail(t, "expected 5 delayed messages read, got", read)
+	}
+	if _, err := DelayedMessagesReadInRange(batches, 13); err == nil {
+		Fail(t, "expected a start count after the first batch's count to be rejected")
+	}
+	if _, err := DelayedMessagesReadInRange([]*SequencerInboxBatch{batches[0], batches[2]}, 10); err == nil {
+		Fail(t, "expected non-consecutive batches to be rejected")
+	}
+}
+
+func TestSequencerInboxBatchBinaryEncoding(t *testing.T) {
+	batch := &SequencerInboxBatch{
+		BlockHash:              common.HexToHash("0x01"),
+		ParentChainBlockNumber: 2,
+		SequenceNumber:         3,
+		BeforeInboxAcc:         common.HexToHash("0x04"),
+		AfterInboxAcc:          common.HexToHash("0x05"),
+		AfterDelayedAcc:        common.HexToHash("0x06"),
+		AfterDelayedCount:      7,
+		DataLocation:           BatchDataSeparateEvent,
+		BridgeAddress:          common.HexToAddress("0x08"),
+		Serialized:             []byte{9, 10},
+	}
+	batch.TimeBounds.MaxTimestamp = 11
+	batch.RawLog.Address = common.HexToAddress("0x0c")
+	batch.RawLog.Topics = []common.Hash{common.HexToHash("0x0d"), common.HexToHash("0x0e")}
+	batch.RawLog.Data = []byte{15}
+	batch.RawLog.TxHash = common.HexToHash("0x10")
+	batch.RawLog.Index = 17
+
+	data, err := batch.MarshalBinary()
+	Require(t, err)
+	var decoded SequencerInboxBatch
+	Require(t, decoded.UnmarshalBinary(data))
+	if !reflect.DeepEqual(batch, &decoded) {
+		Fail(t, "decoded batch doesn't match", batch, &decoded)
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		Fail(t, "expected truncated encoding to be rejected")
+	}
+}
+
+func TestParseBatchMessagesExpectedCount(t *testing.T) {
+	var segments []byte
+	for _, data := range []byte{1, 2} {
+		segment, err := rlp.EncodeToBytes([]byte{arbstate.BatchSegmentKindL2Message, data})
+		Require(t, err)
+		segments = append(segments, segment...)
+	}
+	compressed, err := arbcompress.CompressWell(segments)
+	Require(t, err)
+	serialized := make([]byte, BatchHeaderLength)
+	serialized = append(serialized, daprovider.BrotliMessageHeaderByte)
+	serialized = append(serialized, compressed...)
+	batch := &SequencerInboxBatch{DataLocation: BatchDataTxInput, Serialized: serialized}
+
+	expected := uint64(2)
+	_, l2Messages, err := batch.ParseBatchMessages(context.Background(), nil, nil, &expected)
+	Require(t, err)
+	if l2Messages != expected {
+		Fail(t, "expected", expected, "L2 messages, got", l2Messages)
+	}
+	expected = 3
+	if _, _, err := batch.ParseBatchMessages(context.Background(), nil, nil, &expected); !errors.Is(err, ErrBatchMessageCountMismatch) {
+		Fail(t, "expected a message count mismatch, got", err)
+	}
+}
+
+func TestSegmentCount(t *testing.T) {
+	var segments []byte
+	for _, data := range []byte{1, 2, 3} {
+		segment, err := rlp.EncodeToBytes([]byte{arbstate.BatchSegmentKindL2Message, data})
+		Require(t, err)
+		segments = append(segments, segment...)
+	}
+	compressed, err := arbcompress.CompressWell(segments)
+	Require(t, err)
+	serialized := make([]byte, BatchHeaderLength)
+	serialized = append(serialized, daprovider.BrotliMessageHeaderByte)
+	serialized = append(serialized, compressed...)
+	batch := &SequencerInboxBatch{DataLocation: BatchDataTxInput, Serialized: serialized}
+	count, err := batch.SegmentCount(context.Background(), nil)
+	Require(t, err)
+	if count != 3 {
+		Fail(t, "expected 3 segments, got", count)
+	}
+
+	empty := &SequencerInboxBatch{DataLocation: BatchDataNone}
+	count, err = empty.SegmentCount(context.Background(), nil)
+	Require(t, err)
+	if count != 0 {
+		Fail(t, "expected no segments in a", empty.ContentType(), "batch, got", count)
+	}
+
+	for _, batch := range []*SequencerInboxBatch{
+		{DataLocation: BatchDataBlobHashes, Serialized: append(make([]byte, BatchHeaderLength), daprovider.BlobHashesHeaderFlag)},
+		{DataLocation: BatchDataTxInput, Serialized: append(make([]byte, BatchHeaderLength), daprovider.DASMessageHeaderFlag)},
+	} {
+		if _, err := batch.SegmentCount(context.Background(), nil); !errors.Is(err, ErrSegmentsUnavailable) {
+			Fail(t, "expected the segments of a", batch.ContentType(), "batch to be unavailable, got", err)
+		}
+	}
+}
+
+type batchReplayChainContext struct {
+	chainConfig *params.ChainConfig
+}
+
+func (c *batchReplayChainContext) Engine() consensus.Engine {
+	return arbos.Engine{}
+}
+
+func (c *batchReplayChainContext) GetHeader(common.Hash, uint64) *types.Header {
+	return nil
+}
+
+func (c *batchReplayChainContext) Config() *params.ChainConfig {
+	return c.chainConfig
+}
+
+func TestDecodeMessagesProducesBlocks(t *testing.T) {
+	chainConfig := chaininfo.ArbitrumDevTestChainConfig()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	to := testhelpers.RandomAddress()
+
+	requestId := common.HexToHash("0x01")
+	deposit := &arbostypes.L1IncomingMessage{
+		Header: &arbostypes.L1IncomingMessageHeader{
+			Kind:        arbostypes.L1MessageType_EthDeposit,
+			Poster:      testhelpers.RandomAddress(),
+			BlockNumber: 1,
+			Timestamp:   1,
+			RequestId:   &requestId,
+			L1BaseFee:   big.NewInt(0),
+		},
+		L2msg: append(from.Bytes(), common.BigToHash(big.NewInt(params.Ether)).Bytes()...),
+	}
+	tx, err := types.SignNewTx(key, types.LatestSignerForChainID(chainConfig.ChainID), &types.DynamicFeeTx{
+		ChainID:   chainConfig.ChainID,
+		Nonce:     0,
+		GasTipCap: big.NewInt(0),
+		GasFeeCap: big.NewInt(params.GWei),
+		Gas:       5_000_000,
+		To:        &to,
+		Value:     big.NewInt(1),
+	})
+	Require(t, err)
+	txData, err := tx.MarshalBinary()
+	Require(t, err)
+
+	// The batch first reads the deposit from the delayed inbox, then sequences the transfer
+	var segments []byte
+	for _, segment := range [][]byte{
+		{arbstate.BatchSegmentKindDelayedMessages},
+		append([]byte{arbstate.BatchSegmentKindL2Message, arbos.L2MessageKind_SignedTx}, txData...),
+	} {
+		encoded, err := rlp.EncodeToBytes(segment)
+		Require(t, err)
+		segments = append(segments, encoded...)
+	}
+	compressed, err := arbcompress.CompressWell(segments)
+	Require(t, err)
+	serialized := make([]byte, BatchHeaderLength)
+	binary.BigEndian.PutUint64(serialized[0:8], 1)
+	binary.BigEndian.PutUint64(serialized[8:16], math.MaxUint64)
+	binary.BigEndian.PutUint64(serialized[16:24], 1)
+	binary.BigEndian.PutUint64(serialized[24:32], math.MaxUint64)
+	binary.BigEndian.PutUint64(serialized[32:40], 1)
+	serialized = append(serialized, daprovider.BrotliMessageHeaderByte)
+	serialized = append(serialized, compressed...)
+	batch := &SequencerInboxBatch{SequenceNumber: 1, DataLocation: BatchDataTxInput, Serialized: serialized}
+
+	messages, err := batch.DecodeMessages(context.Background(), nil, nil, 0, func(seqNum uint64) (*arbostypes.L1IncomingMessage, error) {
+		if seqNum != 0 {
+			return nil, fmt.Errorf("unexpected delayed message %v", seqNum)
+		}
+		return deposit, nil
+	})
+	Require(t, err)
+	if len(messages) != 2 {
+		Fail(t, "expected 2 messages, got", len(messages))
+	}
+	if messages[0].Message != deposit || messages[0].DelayedMessagesRead != 1 || messages[1].DelayedMessagesRead != 1 {
+		Fail(t, "unexpected delayed message reads", messages[0].DelayedMessagesRead, messages[1].DelayedMessagesRead)
+	}
+
+	_, statedb := arbosState.NewArbosMemoryBackedArbOSState()
+	lastBlockHeader := arbosState.MakeGenesisBlock(common.Hash{}, 0, 0, statedb.IntermediateRoot(true), chainConfig).Header()
+	chainContext := &batchReplayChainContext{chainConfig}
+	var receipts types.Receipts
+	for _, msg := range messages {
+		var block *types.Block
+		block, receipts, err = arbos.ProduceBlock(msg.Message, msg.DelayedMessagesRead, lastBlockHeader, statedb, chainContext, false, core.NewMessageReplayContext())
+		Require(t, err)
+		lastBlockHeader = block.Header()
+	}
+	last := receipts[len(receipts)-1]
+	if last.TxHash != tx.Hash() || last.Status != types.ReceiptStatusSuccessful {
+		Fail(t, "transfer wasn't applied successfully", last.TxHash, last.Status)
+	}
+	if statedb.GetBalance(to).Uint64() != 1 {
+		Fail(t, "transfer recipient has balance", statedb.GetBalance(to))
+	}
+}
+
+func TestSerializeRange(t *testing.T) {
+	inbox := &SequencerInbox{}
+	var batches []*SequencerInboxBatch
+	for seqNum := uint64(1); seqNum <= 3; seqNum++ {
+		serialized := append(make([]byte, BatchHeaderLength), bytes.Repeat([]byte{byte(seqNum)}, int(seqNum))...)
+		batches = append(batches, &SequencerInboxBatch{SequenceNumber: seqNum, DataLocation: BatchDataTxInput, Serialized: serialized})
+	}
+	blob, index, err := inbox.SerializeRange(context.Background(), batches)
+	Require(t, err)
+	if len(index) != len(batches) {
+		Fail(t, "expected an index entry per batch, got", len(index))
+	}
+	for i, entry := range index {
+		if entry.SequenceNumber != batches[i].SequenceNumber {
+			Fail(t, "index entry", i, "is for batch", entry.SequenceNumber)
+		}
+		if !bytes.Equal(blob[entry.Offset:entry.Offset+entry.Length], batches[i].Serialized) {
+			Fail(t, "index entry", i, "doesn't locate the batch's serialized data")
+		}
+	}
+	if last := index[len(index)-1]; last.Offset+last.Length != uint64(len(blob)) {
+		Fail(t, "blob has trailing data")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := inbox.SerializeRange(ctx, batches); !errors.Is(err, context.Canceled) {
+		Fail(t, "expected a canceled context to stop serialization, got", err)
+	}
+}
+
+func TestBatchesOutOfOrderError(t *testing.T) {
+	var err error = fmt.Errorf("looking up batches: %w", &BatchesOutOfOrderError{Expected: 5, Actual: 7})
+	if !errors.Is(err, ErrBatchesOutOfOrder) {
+		Fail(t, "expected the error to wrap ErrBatchesOutOfOrder")
+	}
+	var outOfOrder *BatchesOutOfOrderError
+	if !errors.As(err, &outOfOrder) || outOfOrder.Expected != 5 || outOfOrder.Actual != 7 {
+		Fail(t, "expected to recover the sequence numbers from the error", err)
+	}
+}
+
+// fakeLogFilterer serves a fixed set of logs, refusing queries over more than maxRange blocks like some RPC providers.
+type fakeLogFilterer struct {
+	logs     []types.Log
+	maxRange uint64
+	queries  int
+}
+
+func (f *fakeLogFilterer) FilterLogs(_ context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	f.queries++
+	from, to := query.FromBlock.Uint64(), query.ToBlock.Uint64()
+	if to-from+1 > f.maxRange {
+		return nil, fmt.Errorf("query over %v blocks exceeds the limit of %v", to-from+1, f.maxRange)
+	}
+	var logs []types.Log
+	for _, ethLog := range f.logs {
+		if ethLog.BlockNumber >= from && ethLog.BlockNumber <= to {
+			logs = append(logs, ethLog)
+		}
+	}
+	return logs, nil
+}
+
+func (f *fakeLogFilterer) SubscribeFilterLogs(context.Context, ethereum.FilterQuery, chan<- types.Log) (ethereum.Subscription, error) {
+	return nil, errors.New("subscriptions aren't supported")
+}
+
+func batchDeliveredLog(t testing.TB, address common.Address, blockNumber uint64, seqNum uint64) types.Log {
+	t.Helper()
+	return batchDeliveredLogWithLocation(t, address, blockNumber, seqNum, BatchDataTxInput)
+}
+
+func batchDeliveredLogWithLocation(t testing.TB, address common.Address, blockNumber uint64, seqNum uint64, location BatchDataLocation) types.Log {
+	t.Helper()
+	data, err := sequencerBridgeABI.Events["SequencerBatchDelivered"].Inputs.NonIndexed().Pack(
+		common.Hash{},
+		new(big.Int),
+		bridgegen.IBridgeTimeBounds{},
+		uint8(location),
+	)
+	testhelpers.RequireImpl(t, err)
+	return types.Log{
+		Address:     address,
+		Topics:      []common.Hash{batchDeliveredID, common.BigToHash(new(big.Int).SetUint64(seqNum)), {}, {}},
+		Data:        data,
+		BlockNumber: blockNumber,
+	}
+}
+
+func newFakeSequencerInbox(t *testing.T, filterer ethereum.LogFilterer) *SequencerInbox {
+	t.Helper()
+	address := common.HexToAddress("0x1234")
+	con, err := bridgegen.NewSequencerInbox(address, nil)
+	Require(t, err)
+	return &SequencerInbox{
+		con:         con,
+		address:     address,
+		logFilterer: filterer,
+	}
+}
+
+func TestLookupBatchesInRangeChunked(t *testing.T) {
+	address := common.HexToAddress("0x1234")
+	filterer := &fakeLogFilterer{maxRange: 10}
+	for seqNum := uint64(0); seqNum < 5; seqNum++ {
+		filterer.logs = append(filterer.logs, batchDeliveredLog(t, address, 3+seqNum*7, seqNum))
+	}
+	inbox := newFakeSequencerInbox(t, filterer)
+	ctx := context.Background()
+
+	if _, err := inbox.LookupBatchesInRange(ctx, big.NewInt(0), big.NewInt(40)); err == nil {
+		Fail(t, "expected an unchunked query over 41 blocks to fail")
+	}
+
+	inbox.MaxBlockRangePerQuery = 10
+	filterer.queries = 0
+	batches, err := inbox.LookupBatchesInRange(ctx, big.NewInt(0), big.NewInt(40))
+	Require(t, err)
+	if filterer.queries != 5 {
+		Fail(t, "expected 5 queries, got", filterer.queries)
+	}
+	if len(batches) != 5 {
+		Fail(t, "expected 5 batches, got", len(batches))
+	}
+	for i, batch := range batches {
+		if batch.SequenceNumber != uint64(i) {
+			Fail(t, "batch", i, "has sequence number", batch.SequenceNumber)
+		}
+	}
+
+	// The sequence number check still applies across chunk boundaries
+	filterer.logs = append(filterer.logs[:2], filterer.logs[3:]...)
+	_, err = inbox.LookupBatchesInRange(ctx, big.NewInt(0), big.NewInt(40))
+	var outOfOrder *BatchesOutOfOrderError
+	if !errors.As(err, &outOfOrder) || outOfOrder.Expected != 2 || outOfOrder.Actual != 3 {
+		Fail(t, "expected an out of order error for the missing batch, got", err)
+	}
+}
+
+// slowBatchDataBackend serves the data of separate event batches after a delay, like a remote parent chain node.
+// Its other methods aren't implemented.
+type slowBatchDataBackend struct {
+	SequencerInboxBackend
+	delay func(seqNum uint64) time.Duration
+}
+
+func (b *slowBatchDataBackend) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	numberAsHash := query.Topics[1][0]
+	seqNum := new(big.Int).SetBytes(numberAsHash[:]).Uint64()
+	select {
+	case <-time.After(b.delay(seqNum)):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	data, err := sequencerBatchDataABI.Inputs.NonIndexed().Pack([]byte{byte(seqNum)})
+	if err != nil {
+		return nil, err
+	}
+	return []types.Log{{Topics: []common.Hash{sequencerBatchDataABI.ID, numberAsHash}, Data: data}}, nil
+}
+
+func newSlowSequencerInbox(t testing.TB, batches uint64, delay func(seqNum uint64) time.Duration) *SequencerInbox {
+	t.Helper()
+	address := common.HexToAddress("0x1234")
+	filterer := &fakeLogFilterer{maxRange: math.MaxUint64}
+	for seqNum := uint64(0); seqNum < batches; seqNum++ {
+		filterer.logs = append(filterer.logs, batchDeliveredLogWithLocation(t, address, 10+seqNum, seqNum, BatchDataSeparateEvent))
+	}
+	con, err := bridgegen.NewSequencerInbox(address, nil)
+	testhelpers.RequireImpl(t, err)
+	return &SequencerInbox{
+		con:         con,
+		address:     address,
+		client:      &slowBatchDataBackend{delay: delay},
+		logFilterer: filterer,
+	}
+}
+
+func TestLookupBatchesInRangeEagerSerialize(t *testing.T) {
+	// Earlier batches take longer to fetch, so they finish serializing out of order
+	const batches = 10
+	inbox := newSlowSequencerInbox(t, batches, func(seqNum uint64) time.Duration {
+		return time.Duration(batches-seqNum) * time.Millisecond
+	})
+	inbox.EagerSerialize = true
+	inbox.EagerSerializeParallelism = 4
+	result, err := inbox.LookupBatchesInRange(context.Background(), big.NewInt(0), big.NewInt(100))
+	Require(t, err)
+	if len(result) != batches {
+		Fail(t, "expected", batches, "batches, got", len(result))
+	}
+	for i, batch := range result {
+		if batch.SequenceNumber != uint64(i) {
+			Fail(t, "batch", i, "has sequence number", batch.SequenceNumber)
+		}
+		if len(batch.Serialized) != BatchHeaderLength+1 || batch.Serialized[BatchHeaderLength] != byte(i) {
+			Fail(t, "batch", i, "wasn't serialized with its own data:", batch.Serialized)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := inbox.LookupBatchesInRange(ctx, big.NewInt(0), big.NewInt(100)); !errors.Is(err, context.Canceled) {
+		Fail(t, "expected a canceled lookup to fail, got", err)
+	}
+}
+
+func BenchmarkLookupBatchesInRangeSerialize(b *testing.B) {
+	const batches = 100
+	delay := func(uint64) time.Duration { return time.Millisecond }
+	b.Run("lazy", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			inbox := newSlowSequencerInbox(b, batches, delay)
+			result, err := inbox.LookupBatchesInRange(context.Background(), big.NewInt(0), big.NewInt(200))
+			testhelpers.RequireImpl(b, err)
+			for _, batch := range result {
+				_, err := batch.Serialize(context.Background(), inbox.client)
+				testhelpers.RequireImpl(b, err)
+			}
+		}
+	})
+	b.Run("eager", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			inbox := newSlowSequencerInbox(b, batches, delay)
+			inbox.EagerSerialize = true
+			_, err := inbox.LookupBatchesInRange(context.Background(), big.NewInt(0), big.NewInt(200))
+			testhelpers.RequireImpl(b, err)
+		}
+	})
+}
+
+// fakeHeaderBackend serves the canonical headers of a fake parent chain, resolving block tags through tags.
+// Its other methods aren't implemented.
+type fakeHeaderBackend struct {
+	SequencerInboxBackend
+	headers map[uint64]*types.Header
+	tags    map[rpc.BlockNumber]uint64
+}
+
+func (b *fakeHeaderBackend) HeaderByNumber(_ context.Context, number *big.Int) (*types.Header, error) {
+	if number.Sign() < 0 {
+		tagged, ok := b.tags[rpc.BlockNumber(number.Int64())]
+		if !ok {
+			return nil, fmt.Errorf("no block for tag %v", rpc.BlockNumber(number.Int64()))
+		}
+		number = new(big.Int).SetUint64(tagged)
+	}
+	header, ok := b.headers[number.Uint64()]
+	if !ok {
+		return nil, fmt.Errorf("no header for block %v", number)
+	}
+	return header, nil
+}
+
+func TestLookupBatchesInRangeCheckReorgs(t *testing.T) {
+	address := common.HexToAddress("0x1234")
+	filterer := &fakeLogFilterer{maxRange: math.MaxUint64}
+	backend := &fakeHeaderBackend{headers: make(map[uint64]*types.Header)}
+	for seqNum := uint64(0); seqNum < 3; seqNum++ {
+		blockNumber := 10 + seqNum
+		header := &types.Header{Number: new(big.Int).SetUint64(blockNumber)}
+		backend.headers[blockNumber] = header
+		ethLog := batchDeliveredLog(t, address, blockNumber, seqNum)
+		ethLog.BlockHash = header.Hash()
+		filterer.logs = append(filterer.logs, ethLog)
+	}
+	inbox := newFakeSequencerInbox(t, filterer)
+	inbox.client = backend
+	inbox.CheckReorgs = true
+	ctx := context.Background()
+
+	batches, err := inbox.LookupBatchesInRange(ctx, big.NewInt(0), big.NewInt(20))
+	Require(t, err)
+	if len(batches) != 3 {
+		Fail(t, "expected 3 batches, got", len(batches))
+	}
+
+	// The second batch's block gets reorged out after its log was indexed
+	backend.headers[11] = &types.Header{Number: big.NewInt(11), Time: 1}
+	_, err = inbox.LookupBatchesInRange(ctx, big.NewInt(0), big.NewInt(20))
+	var reorgErr *ReorgDetectedError
+	if !errors.Is(err, ErrReorgDetected) || !errors.As(err, &reorgErr) || reorgErr.BlockNumber != 11 {
+		Fail(t, "expected a reorg to be detected at block 11, got", err)
+	}
+
+	inbox.CheckReorgs = false
+	if _, err := inbox.LookupBatchesInRange(ctx, big.NewInt(0), big.NewInt(20)); err != nil {
+		Fail(t, "expected the reorg to go unnoticed without the check, got", err)
+	}
+}
+
+func TestGetBatchCountAtTag(t *testing.T) {
+	backend := &fakeHeaderBackend{
+		headers: map[uint64]*types.Header{5: {Number: big.NewInt(5)}},
+		tags:    map[rpc.BlockNumber]uint64{rpc.FinalizedBlockNumber: 5},
+	}
+	inbox := &SequencerInbox{client: backend, fromBlock: 10}
+	ctx := context.Background()
+
+	// The finalized block is before the inbox was deployed, so the contract isn't called
+	count, err := inbox.GetBatchCountAtTag(ctx, "finalized")
+	Require(t, err)
+	if count != 0 {
+		Fail(t, "expected no batches before fromBlock, got", count)
+	}
+	if _, err := inbox.GetBatchCountAtTag(ctx, "pending"); err == nil {
+		Fail(t, "expected the pending tag to be rejected")
+	}
+	if _, err := inbox.GetBatchCountAtTag(ctx, "final"); err == nil {
+		Fail(t, "expected an invalid tag to be rejected")
+	}
+}
+
+func TestBatchDataCache(t *testing.T) {
+	inbox := &SequencerInbox{}
+	inbox.EnableBatchDataCache(2)
+	batch := &SequencerInboxBatch{
+		BlockHash:      common.HexToHash("0x01"),
+		SequenceNumber: 3,
+		DataLocation:   BatchDataSeparateEvent,
+		dataCache:      inbox.dataCache,
+	}
+	data := []byte{daprovider.BrotliMessageHeaderByte, 1, 2, 3}
+	inbox.dataCache.add(batchDataKey{blockHash: batch.BlockHash, sequenceNumber: batch.SequenceNumber}, data)
+
+	// The data is served from the cache, so the batch can be serialized without a client
+	serialized, err := batch.Serialize(context.Background(), nil)
+	Require(t, err)
+	if !bytes.Equal(serialized[BatchHeaderLength:], data) {
+		Fail(t, "unexpected serialized data", serialized[BatchHeaderLength:])
+	}
+
+	// The same sequence number in a different block is a different batch
+	if _, ok := inbox.dataCache.get(batchDataKey{blockHash: common.HexToHash("0x02"), sequenceNumber: batch.SequenceNumber}); ok {
+		Fail(t, "expected a cache miss for a batch from a different block")
+	}
+}
+
+type fakeBatchDataSource struct {
+	data  map[uint64][]byte
+	reads []uint64
+}
+
+func (s *fakeBatchDataSource) GetBatchData(seqNum uint64) ([]byte, bool, error) {
+	s.reads = append(s.reads, seqNum)
+	data, ok := s.data[seqNum]
+	return data, ok, nil
+}
+
+func TestBatchDataSource(t *testing.T) {
+	// The parent chain serves each batch's sequence number as its data
+	client := &slowBatchDataBackend{delay: func(uint64) time.Duration { return 0 }}
+	newBatch := func(seqNum uint64, source BatchDataSource) *SequencerInboxBatch {
+		batch := &SequencerInboxBatch{
+			SequenceNumber:    seqNum,
+			BeforeInboxAcc:    common.Hash{byte(seqNum)},
+			AfterDelayedCount: seqNum,
+			DataLocation:      BatchDataSeparateEvent,
+			dataSource:        source,
+		}
+		serialized := append(batch.serializedHeader(), byte(seqNum))
+		batch.AfterInboxAcc = ComputeAfterInboxAcc(batch.BeforeInboxAcc, serialized, batch.AfterDelayedAcc)
+		return batch
+	}
+
+	source := &fakeBatchDataSource{data: map[uint64][]byte{
+		// Matches the parent chain
+		1: {1},
+		// Doesn't hash into the batch's accumulator
+		2: {42},
+		// Claims to be a blob batch
+		3: {daprovider.BlobHashesHeaderFlag},
+	}}
+	for seqNum := uint64(1); seqNum <= 4; seqNum++ {
+		batch := newBatch(seqNum, source)
+		serialized, err := batch.Serialize(context.Background(), client)
+		Require(t, err)
+		if !bytes.Equal(serialized[BatchHeaderLength:], []byte{byte(seqNum)}) {
+			Fail(t, "batch", seqNum, "has unexpected data", serialized[BatchHeaderLength:])
+		}
+		matches, err := batch.VerifyAccumulator()
+		Require(t, err)
+		if !matches {
+			Fail(t, "batch", seqNum, "doesn't match its accumulator")
+		}
+	}
+	if !reflect.DeepEqual(source.reads, []uint64{1, 2, 3, 4}) {
+		Fail(t, "unexpected data source reads", source.reads)
+	}
+
+	// A batch served from the data source doesn't need the parent chain
+	if _, err := newBatch(1, source).Serialize(context.Background(), nil); err != nil {
+		Fail(t, "expected the batch to be read from the data source, got", err)
+	}
+}
+
+func TestLookupBatchesInRangeStream(t *testing.T) {
+	address := common.HexToAddress("0x1234")
+	filterer := &fakeLogFilterer{maxRange: 100}
+	for _, seqNum := range []uint64{0, 1, 3} {
+		filterer.logs = append(filterer.logs, batchDeliveredLog(t, address, 10+seqNum, seqNum))
+	}
+	inbox := newFakeSequencerInbox(t, filterer)
+
+	batches, errs := inbox.LookupBatchesInRangeStream(context.Background(), big.NewInt(0), big.NewInt(50))
+	var received []uint64
+	for batch := range batches {
+		received = append(received, batch.SequenceNumber)
+	}
+	if !reflect.DeepEqual(received, []uint64{0, 1}) {
+		Fail(t, "expected the batches before the gap to be streamed, got", received)
+	}
+	err := <-errs
+	if !errors.Is(err, ErrBatchesOutOfOrder) {
+		Fail(t, "expected an out of order error, got", err)
+	}
+	if _, ok := <-errs; ok {
+		Fail(t, "expected the error channel to be closed after the error")
+	}
+}
+
+func TestSelectBatchDataLog(t *testing.T) {
+	var numberAsHash common.Hash
+	numberAsHash[31] = 7
+	batchTx := common.HexToHash("0x01")
+	uncledTx := common.HexToHash("0x02")
+	logs := []types.Log{
+		{Topics: []common.Hash{sequencerBatchDataABI.ID, numberAsHash}, TxHash: uncledTx, Data: []byte{1}},
+		{Topics: []common.Hash{sequencerBatchDataABI.ID, numberAsHash}, TxHash: batchTx, Data: []byte{2}},
+	}
+	dataLog, err := selectBatchDataLog(logs, numberAsHash, batchTx)
+	Require(t, err)
+	if !bytes.Equal(dataLog.Data, []byte{2}) {
+		Fail(t, "selected the log from the wrong tx")
+	}
+
+	logs[1].Removed = true
+	if _, err := selectBatchDataLog(logs, numberAsHash, batchTx); err == nil {
+		Fail(t, "expected an error when the only matching log was removed")
+	}
+
+	logs[1].Removed = false
+	logs = append(logs, logs[1])
+	if _, err := selectBatchDataLog(logs, numberAsHash, batchTx); err == nil {
+		Fail(t, "expected an error when the batch's tx has two matching logs")
+	}
+}
+
+func TestParseSerializedBatchHeader(t *testing.T) {
+	inbox := &SequencerInbox{}
+	inbox.EnableBatchDataCache(1)
+	batch := &SequencerInboxBatch{
+		DataLocation:      BatchDataTxInput,
+		AfterDelayedCount: 9,
+		TimeBounds:        bridgegen.IBridgeTimeBounds{MinTimestamp: 1, MaxTimestamp: 2, MinBlockNumber: 3, MaxBlockNumber: 4},
+		dataCache:         inbox.dataCache,
+	}
+	payload := []byte{daprovider.BrotliMessageHeaderByte, 5, 6}
+	inbox.dataCache.add(batchDataKey{}, payload)
+	data, err := batch.Serialize(context.Background(), nil)
+	Require(t, err)
+
+	timeBounds, afterDelayedCount, parsedPayload, err := ParseSerializedBatchHeader(data)
+	Require(t, err)
+	if timeBounds != batch.TimeBounds || afterDelayedCount != batch.AfterDelayedCount || !bytes.Equal(parsedPayload, payload) {
+		Fail(t, "round trip mismatch", timeBounds, afterDelayedCount, parsedPayload)
+	}
+	if _, _, _, err := ParseSerializedBatchHeader(data[:BatchHeaderLength-1]); err == nil {
+		Fail(t, "expected a truncated header to be rejected")
+	}
+}
+
+func TestIsRetryableReadError(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("read tcp 127.0.0.1:1234: connection reset by peer"), true},
+		{errors.New("429 Too Many Requests: rate limit exceeded"), true},
+		{rpc.HTTPError{StatusCode: 503, Status: "503 Service Unavailable"}, true},
+		{rpc.HTTPError{StatusCode: 400, Status: "400 Bad Request"}, false},
+		{fmt.Errorf("call failed: %w", io.ErrUnexpectedEOF), true},
+		{errors.New("execution reverted"), false},
+		{context.DeadlineExceeded, false},
+		{errors.New("no contract code at given address"), false},
+	}
+	for _, c := range cases {
+		if isRetryableReadError(c.err) != c.retryable {
+			Fail(t, "expected retryable", c.retryable, "for error", c.err)
+		}
+	}
+}
+
+func TestRetryRead(t *testing.T) {
+	policy := ReadRetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, Jitter: 0.5}
+	transient := errors.New("connection reset by peer")
+
+	attempts := 0
+	result, err := retryRead(context.Background(), policy, "test", func() (uint64, error) {
+		attempts++
+		if attempts < 3 {
+			return 0, transient
+		}
+		return 7, nil
+	})
+	if err != nil || result != 7 || attempts != 3 {
+		Fail(t, "expected success on the third attempt, got result", result, "err", err, "after", attempts, "attempts")
+	}
+
+	attempts = 0
+	_, err = retryRead(context.Background(), policy, "test", func() (uint64, error) {
+		attempts++
+		return 0, transient
+	})
+	if !errors.Is(err, transient) || attempts != 3 {
+		Fail(t, "expected the last error after 3 attempts, got", err, "after", attempts, "attempts")
+	}
+
+	reverted := errors.New("execution reverted")
+	attempts = 0
+	_, err = retryRead(context.Background(), policy, "test", func() (uint64, error) {
+		attempts++
+		return 0, reverted
+	})
+	if !errors.Is(err, reverted) || attempts != 1 {
+		Fail(t, "expected a revert not to be retried, got", err, "after", attempts, "attempts")
+	}
+
+	attempts = 0
+	_, err = retryRead(context.Background(), NoReadRetries, "test", func() (uint64, error) {
+		attempts++
+		return 0, transient
+	})
+	if !errors.Is(err, transient) || attempts != 1 {
+		Fail(t, "expected NoReadRetries to fail fast, got", err, "after", attempts, "attempts")
+	}
+
+	// A done context stops the retries instead of waiting out the backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	_, err = retryRead(ctx, ReadRetryPolicy{MaxAttempts: 5, BaseBackoff: time.Hour}, "test", func() (uint64, error) {
+		attempts++
+		return 0, transient
+	})
+	if !errors.Is(err, transient) || attempts != 1 {
+		Fail(t, "expected a canceled context to stop retrying, got", err, "after", attempts, "attempts")
+	}
+}
+
+type fakeBlobReader struct {
+	blobs []kzg4844.Blob
+}
+
+func (r *fakeBlobReader) GetBlobs(context.Context, common.Hash, []common.Hash) ([]kzg4844.Blob, error) {
+	return r.blobs, nil
+}
+
+func (r *fakeBlobReader) Initialize(context.Context) error {
+	return nil
+}
+
+func TestVerifyBatchBlobs(t *testing.T) {
+	ctx := context.Background()
+	encoded, err := blobs.EncodeBlobs([]byte("batch data"))
+	Require(t, err)
+	_, versionedHashes, err := blobs.ComputeCommitmentsAndHashes(encoded)
+	Require(t, err)
+
+	reader := &fakeBlobReader{blobs: encoded}
+	Require(t, verifyBatchBlobs(ctx, reader, common.Hash{}, versionedHashes))
+
+	// A blob that doesn't match its versioned hash
+	other, err := blobs.EncodeBlobs([]byte("other data"))
+	Require(t, err)
+	reader.blobs = other
+	if err := verifyBatchBlobs(ctx, reader, common.Hash{}, versionedHashes); !errors.Is(err, ErrBlobHashMismatch) {
+		Fail(t, "expected a blob hash mismatch, got", err)
+	}
+
+	// Fewer blobs than versioned hashes
+	reader.blobs = nil
+	if err := verifyBatchBlobs(ctx, reader, common.Hash{}, versionedHashes); !errors.Is(err, ErrBlobHashMismatch) {
+		Fail(t, "expected missing blobs to be a mismatch, got", err)
+	}
+}
+
+func TestSequencerInboxSimulatedBackend(t *testing.T) {
+	backend := simulated.NewBackend(types.GenesisAlloc{})
+	defer backend.Close()
+	backend.Commit()
+
+	seqInbox, err := NewSequencerInboxWithBackend(backend.Client(), common.HexToAddress("0x5e9"), 0)
+	Require(t, err)
+	batches, err := seqInbox.LookupBatchesInRange(context.Background(), common.Big0, common.Big1)
+	Require(t, err)
+	if len(batches) != 0 {
+		Fail(t, "expected no batches from an address without logs, got", len(batches))
+	}
+}
@@ -4,22 +4,31 @@
 package arbos
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"math/big"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/arbitrum_types"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/tracing"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 
+	"github.com/offchainlabs/nitro/arbcompress"
 	"github.com/offchainlabs/nitro/arbos/arbosState"
 	"github.com/offchainlabs/nitro/arbos/arbostypes"
 	"github.com/offchainlabs/nitro/arbos/l2pricing"
@@ -59,6 +68,14 @@ type L1Info struct {
 	l1Timestamp   uint64
 }
 
+func NewL1Info(poster common.Address, l1BlockNumber uint64, l1Timestamp uint64) *L1Info {
+	return &L1Info{
+		poster:        poster,
+		l1BlockNumber: l1BlockNumber,
+		l1Timestamp:   l1Timestamp,
+	}
+}
+
 func (info *L1Info) Equals(o *L1Info) bool {
 	return info.poster == o.poster && info.l1BlockNumber == o.l1BlockNumber && info.l1Timestamp == o.l1Timestamp
 }
@@ -67,7 +84,12 @@ func (info *L1Info) L1BlockNumber() uint64 {
 	return info.l1BlockNumber
 }
 
-func createNewHeader(prevHeader *types.Header, l1info *L1Info, state *arbosState.ArbosState, chainConfig *params.ChainConfig) *types.Header {
+// createNewHeader returns the header for the block after prevHeader, with the given geth block gas limit.
+// A gasLimit of 0 means l2pricing.GethBlockGasLimit, which is what every block outside of tests uses.
+func createNewHeader(prevHeader *types.Header, l1info *L1Info, state *arbosState.ArbosState, chainConfig *params.ChainConfig, gasLimit uint64) *types.Header {
+	if gasLimit == 0 {
+		gasLimit = l2pricing.GethBlockGasLimit
+	}
 	l2Pricing := state.L2PricingState()
 	baseFee, err := l2Pricing.BaseFeeWei()
 	state.Restrict(err)
@@ -101,7 +123,7 @@ func createNewHeader(prevHeader *types.Header, l1info *L1Info, state *arbosState
 		Bloom:       [256]byte{},   // Filled in later
 		Difficulty:  big.NewInt(1), // Eventually, Ethereum plans to require this to be zero
 		Number:      blockNumber,
-		GasLimit:    l2pricing.GethBlockGasLimit,
+		GasLimit:    gasLimit,
 		GasUsed:     0,
 		Time:        timestamp,
 		Extra:       extra,     // used by NewEVMBlockContext
@@ -112,6 +134,21 @@ func createNewHeader(prevHeader *types.Header, l1info *L1Info, state *arbosState
 	return header
 }
 
+// BuildNextHeader returns the header of the block after prevHeader without executing any txs,
+// e.g. to preview its BaseFee, Number, and Time. Fields that depend on the block's txs are left empty,
+// and statedb is only read from.
+func BuildNextHeader(prevHeader *types.Header, l1info *L1Info, statedb *state.StateDB, chainConfig *params.ChainConfig) (*types.Header, error) {
+	arbState, err := arbosState.OpenSystemArbosState(statedb, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	// createNewHeader only logs a failure to read the basefee, so check it here to return it instead
+	if _, err := arbState.L2PricingState().BaseFeeWei(); err != nil {
+		return nil, err
+	}
+	return createNewHeader(prevHeader, l1info, arbState, chainConfig, 0), nil
+}
+
 type ConditionalOptionsForTx []*arbitrum_types.ConditionalOptions
 
 type SequencingHooks struct {
@@ -121,20 +158,605 @@ type SequencingHooks struct {
 	PostTxFilter            func(*types.Header, *state.StateDB, *arbosState.ArbosState, *types.Transaction, common.Address, uint64, *core.ExecutionResult) error                                    // This has to be set
 	BlockFilter             func(*types.Header, *state.StateDB, types.Transactions, types.Receipts) error                                                                                           // This can be unset
 	ConditionalOptionsForTx []*arbitrum_types.ConditionalOptions                                                                                                                                    // This can be unset
+
+	// The fields below can all be left unset.
+
+	// Called after PostTxFilter with the tx's conditional options too.
+	PostTxFilterWithOptions func(*types.Header, *state.StateDB, *arbosState.ArbosState, *types.Transaction, *arbitrum_types.ConditionalOptions, common.Address, uint64, *core.ExecutionResult) error
+	// Like BlockFilter, but can name a tx to drop before retrying, see ProduceBlockAdvanced.
+	BlockFilterWithCulprit func(*types.Header, *state.StateDB, types.Transactions, types.Receipts) (int, error)
+	// The compute gas each sender's txs may use in the block, or 0 for no limit.
+	MaxComputeGasPerSender uint64
+	// Defaults to the system clock.
+	Clock Clock
+	// Starts a span around producing the block.
+	Tracer BlockTracer
+	// Whether Tracer also gets a span for each tx.
+	TraceEachTx bool
+	// Defaults to logging an error.
+	BalanceBurnPolicy BalanceBurnPolicy
+	// Whether the first user tx may exceed the per-block gas limit. Sequencer only: replay always allows it.
+	AllowOversizedFirstTx bool
+	// Whether to fill in Result.Snapshots and Result.Reverts.
+	RecordSnapshotStats bool
+	// Whether to fill in Result.BlockRLP.
+	EncodeBlockRLP bool
+	// Experimental and only allowed on chains in DebugMode, see BlockBuilder.SetGasLimit.
+	AdjustGasLimit func(header *types.Header, lastBlockHeader *types.Header) uint64
+	// Only for sequencing: replay must accept any poster the sequencer did.
+	RequireNonZeroPoster bool
+	// Whether to fill in Result.TxOutcomes.
+	RecordTxOutcomes bool
+	// Whether to fill in Result.TxOrder.
+	RecordTxOrder bool
+	// Whether to fill in Result.DropCounts.
+	CountDropReasons bool
+	// Whether to fill in Result.GasBreakdown.
+	RecordGasBreakdown bool
+	// Called for each redeem a tx schedules, in the order they will be processed.
+	OnScheduledTx func(parent *types.Transaction, scheduled *types.Transaction)
+	// How deep redeems may schedule further redeems, or 0 for no limit. Only allowed on chains in DebugMode.
+	MaxRedeemDepth uint64
+	// How long applying user txs may take, or 0 for no limit. Sequencer only, as it makes blocks timing dependent.
+	MaxBlockBuildDuration time.Duration
+	// Produces the block on a copy of the statedb and returns its receipts but a nil block.
+	DryRun bool
+	// Only allowed on chains in DebugMode.
+	InjectFailure *FailureInjection
+	// Overrides the MixDigest the start block tx sees. Consensus sensitive, so only allowed on chains in DebugMode.
+	MixDigestProvider func(*types.Header) common.Hash
+	// Called with the outbox state of each block ProduceBlockAdvanced returns.
+	OnBlockFinalized func(header *types.Header, sendRoot common.Hash, sendCount uint64)
+	// Called with the state changed by the txs of each block ProduceBlockAdvanced returns.
+	OnStateDiff func(diff StateDiff)
+	// Called when the start block tx upgrades ArbOS, e.g. to invalidate version dependent caches.
+	OnArbOSUpgrade func(oldVersion, newVersion uint64)
+	// Seconds the L1 timestamp may lag the parent block before a warning, or 0 for the default.
+	TimestampRegressionWarnThreshold uint64
+	// Whether a leftover statedb refund is logged and reset instead of failing the block.
+	ResetRefundOnMismatch bool
+	// Used for the EVM of every tx. Fields other than Tracer can change execution, so only set those in tests.
+	VMConfig vm.Config
+	// Installs a fresh tracer for each tx, overriding VMConfig.Tracer, and collects Result.TxTraces.
+	TxTracerFactory func(tx *types.Transaction) *TxTracer
+	// The ArbOS state already opened on the statedb, to reuse instead of opening it again. Must be backed by that statedb.
+	ArbosState *arbosState.ArbosState
+	// Omits the start block tx, for replay harnesses only. Only allowed on chains in DebugMode.
+	SkipStartBlockTx bool
+	// The user tx types to allow, or empty for all. Internal txs and redeems are never filtered.
+	AllowedTxTypes []byte
+	// Replaces GetPosterInfo in gas budgeting and Result, e.g. for a custom DA layer. Txs are charged as usual.
+	PosterCostFunc func(tx *types.Transaction, poster common.Address) (*big.Int, error)
+	// Called after each applied tx with a copy of the header and the receipts so far, which it must not modify.
+	ProgressCallback func(header *types.Header, receiptsSoFar types.Receipts)
+	// The most value the block may withdraw to L1, or nil for no limit. Redeems count but are never dropped.
+	MaxWithdrawalValuePerBlock *big.Int
+	// Produces the block into a copy of the statedb, which is left reusable if production fails or is canceled.
+	CopyStateDB bool
+
+	// Filled in by ProduceBlockAdvanced
+	Result BlockProductionResult
+}
+
+// Clock is the source of wall clock time for time-based sequencing policies.
+// It never affects replay, which only depends on the timestamps in the incoming messages.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (h *SequencingHooks) clock() Clock {
+	if h.Clock == nil {
+		return realClock{}
+	}
+	return h.Clock
+}
+
+// BalanceBurnPolicy decides what block production does when a block destroyed funds,
+// i.e. the total balance delta is less than deposits minus withdrawals.
+// Minting funds is always an error, as is any mismatch in DebugMode.
+//
+// Only the sequencer should pick a policy other than BalanceBurnLog: nodes replaying messages
+// must always produce the block, otherwise they'd get stuck on a block the sequencer already produced.
+// An erroring sequencer instead never produces the block, so this doesn't cause a divergence.
+type BalanceBurnPolicy uint8
+
+const (
+	BalanceBurnLog        BalanceBurnPolicy = iota // log an error and produce the block
+	BalanceBurnError                               // fail block production
+	BalanceBurnMetricOnly                          // only count the burn in a metric and produce the block
+)
+
+var (
+	// Counts the blocks whose total balance delta was below the expected one, i.e. funds were burnt
+	balanceBurntCounter = metrics.NewRegisteredCounter("arb/arbos/block/balance_burnt", nil)
+	// Counts the txs whose poster cost didn't fit in a uint64 of L2 gas, i.e. the basefee is pathologically low
+	posterCostOverflowCounter = metrics.NewRegisteredCounter("arb/arbos/block/poster_cost_overflow", nil)
+	// Counts the blocks whose L1 timestamp was behind their parent's timestamp by more than the warning threshold
+	timestampRegressionCounter = metrics.NewRegisteredCounter("arb/arbos/block/timestamp_regression", nil)
+
+	// Updated by ProduceBlockAdvanced for each block it produces, except in dry runs and prefetches
+	blockProductionTimer     = metrics.NewRegisteredTimer("arb/arbos/block/production", nil)
+	blockUserTxsHistogram    = metrics.NewRegisteredHistogram("arb/arbos/block/user_txs", nil, metrics.NewBoundedHistogramSample())
+	blockDroppedTxsHistogram = metrics.NewRegisteredHistogram("arb/arbos/block/dropped_txs", nil, metrics.NewBoundedHistogramSample())
+	blockRedeemsHistogram    = metrics.NewRegisteredHistogram("arb/arbos/block/redeems", nil, metrics.NewBoundedHistogramSample())
+	blockGasUsedHistogram    = metrics.NewRegisteredHistogram("arb/arbos/block/gas_used", nil, metrics.NewBoundedHistogramSample())
+)
+
+// FailureInjection makes block production fail at specific points, for chaos testing its error paths.
+// Block production refuses to run with it set unless the chain is in DebugMode, so it can't be enabled on a real chain.
+type FailureInjection struct {
+	AfterTxs           int         // Fail once this many txs (including the internal start block tx) are in the block, if non-zero
+	OnTxHash           common.Hash // Fail right before applying the tx with this hash, if non-zero
+	DuringFinalization bool        // Fail right before finalizing the block
+}
+
+var ErrInjectedFailure = errors.New("injected block production failure")
+
+// ErrBlockProductionCanceled is returned when the context passed to ProduceBlockAdvanced is canceled mid-block.
+var ErrBlockProductionCanceled = errors.New("block production canceled")
+
+var ErrRedeemDepthExceeded = errors.New("redeem depth exceeded")
+
+// RedeemDepthError describes a redeem that was skipped because the chain of redeems leading to it,
+// starting from the tx OriginTx, was longer than MaxRedeemDepth.
+type RedeemDepthError struct {
+	OriginTx common.Hash
+	TicketId common.Hash
+	Depth    uint64
+}
+
+func (e *RedeemDepthError) Error() string {
+	return fmt.Sprintf("%v: redeem of %v scheduled at depth %v by tx %v", ErrRedeemDepthExceeded, e.TicketId, e.Depth, e.OriginTx)
+}
+
+func (e *RedeemDepthError) Unwrap() error {
+	return ErrRedeemDepthExceeded
+}
+
+// maxBlockFilterCulprits bounds how many txs BlockFilterWithCulprit can drop from a single block before giving up.
+const maxBlockFilterCulprits = 8
+
+// BlockFilterCulpritError is the TxErrors entry of a user tx dropped because BlockFilterWithCulprit named it,
+// or a redeem it scheduled, as the culprit for rejecting the block.
+type BlockFilterCulpritError struct {
+	TxHash common.Hash
+	Err    error
+}
+
+func (e *BlockFilterCulpritError) Error() string {
+	return fmt.Sprintf("tx %v dropped by block filter: %v", e.TxHash, e.Err)
+}
+
+func (e *BlockFilterCulpritError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultTimestampRegressionWarnThreshold is how many seconds a block's L1 timestamp may be behind its parent's
+// timestamp before a warning is logged, unless SequencingHooks.TimestampRegressionWarnThreshold overrides it.
+// Smaller regressions are routine, as the L1 timestamps of consecutive messages aren't strictly ordered.
+const DefaultTimestampRegressionWarnThreshold uint64 = 60
+
+// ErrDelayedMessagesReadDecreased is returned when a block would read fewer delayed messages than its parent,
+// which is stored in the parent header's nonce.
+var ErrDelayedMessagesReadDecreased = errors.New("delayed messages read decreased")
+
+// ErrZeroPoster is returned when RequireNonZeroPoster is set and the message has no poster,
+// which would otherwise become the block's coinbase and the L1 pricing poster.
+var ErrZeroPoster = errors.New("incoming message header has a zero poster")
+
+// ErrNilChainConfig is returned when the chain context passed to block production has no chain config.
+var ErrNilChainConfig = errors.New("chain context has no chain config")
+
+// checkBlockProductionInputs checks the inputs block production would otherwise panic on deep inside,
+// like a missing chain config or parent header, so misconfigured callers get a descriptive error instead.
+func checkBlockProductionInputs(l1Header *arbostypes.L1IncomingMessageHeader, lastBlockHeader *types.Header, statedb *state.StateDB, chainContext core.ChainContext) error {
+	if chainContext == nil {
+		return errors.New("nil chain context")
+	}
+	chainConfig := chainContext.Config()
+	if chainConfig == nil {
+		return ErrNilChainConfig
+	}
+	if l1Header == nil {
+		return errors.New("nil incoming message header")
+	}
+	if statedb == nil {
+		return errors.New("nil statedb")
+	}
+	// The genesis block is created by MakeGenesisBlock, so every produced block has a parent
+	if lastBlockHeader == nil || lastBlockHeader.Number == nil {
+		return errors.New("missing parent block header: the genesis block can't be produced, only blocks after it")
+	}
+	if lastBlockHeader.Number.Uint64() < chainConfig.ArbitrumChainParams.GenesisBlockNum {
+		return fmt.Errorf("parent block %v is before the genesis block %v", lastBlockHeader.Number, chainConfig.ArbitrumChainParams.GenesisBlockNum)
+	}
+	return nil
+}
+
+// FinalizeBlockError is returned by ProduceBlockAdvanced when the block couldn't be finalized.
+// It holds the txs and receipts that were applied, so the partially built block can be diagnosed.
+type FinalizeBlockError struct {
+	Txs      types.Transactions
+	Receipts types.Receipts
+	Err      error
+}
+
+func (e *FinalizeBlockError) Error() string {
+	return fmt.Sprintf("failed to finalize block with %v txs: %v", len(e.Txs), e.Err)
+}
+
+func (e *FinalizeBlockError) Unwrap() error {
+	return e.Err
+}
+
+// BlockTracer starts tracing spans around block production, e.g. by adapting an OpenTelemetry tracer.
+// It's an interface so that ArbOS (which is also compiled for replay) doesn't depend on a tracing library.
+type BlockTracer interface {
+	StartSpan(name string) BlockSpan
 }
 
+type BlockSpan interface {
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+// BlockProductionResult holds information about a produced block that isn't part of the block itself.
+type BlockProductionResult struct {
+	// User txs that were skipped because their sender exceeded MaxComputeGasPerSender.
+	// They weren't invalid, so the caller can requeue them for a later block.
+	DeferredTxs types.Transactions
+
+	// The ArbOS rate limit that actually bounds the amount of work in the block.
+	// This is usually much smaller than GethBlockGasLimit, which only sizes the geth gas pool and header.GasLimit.
+	PerBlockGasLimit uint64
+	// The gas limit of the geth gas pool (and header.GasLimit), which is set high enough to never run out.
+	GethBlockGasLimit uint64
+	// The compute gas PerBlockGasLimit had left once the block was done. In practice this is the limit that bounds
+	// block size: a user tx is deferred to a later block with core.ErrGasLimitReached once its compute gas exceeds it.
+	PerBlockGasLeft uint64
+	// How much of GethBlockGasLimit the block's gas used, including L1 data gas, left. The geth gas pool is refilled
+	// for each tx, so GethBlockGasLimit only caps an individual tx's gas and only binds if it's been lowered below
+	// PerBlockGasLimit, e.g. by AdjustGasLimit; the block as a whole isn't checked against it.
+	GethGasLeft uint64
+
+	// The number of state snapshots taken and reverted while applying txs, if RecordSnapshotStats is set.
+	// Many reverts mean a lot of execution work was wasted on txs that didn't make it into the block.
+	Snapshots uint64
+	Reverts   uint64
+
+	// The gas used by the block's internal, user, and redeem txs. Gas a tx set aside for the redeems it scheduled
+	// is counted by the redeems, so these add up to the header's GasUsed minus any gas set aside for redeems that didn't run.
+	InternalGasUsed uint64
+	UserGasUsed     uint64
+	RedeemGasUsed   uint64
+
+	// Whether the block contains nothing but the internal start block tx.
+	// A long run of empty blocks can indicate a stuck mempool or upstream issue.
+	EmptyBlock bool
+
+	// The RLP encoding of the produced block, if EncodeBlockRLP is set.
+	BlockRLP []byte
+
+	// The outcome of each user tx passed to ProduceBlockAdvanced, in the same order, if RecordTxOutcomes is set.
+	TxOutcomes []TxOutcome
+
+	// The number of user txs dropped for each reason, if CountDropReasons is set. Deferred txs aren't counted.
+	DropCounts map[DropReason]uint64
+
+	// The order in which txs were processed, if RecordTxOrder is set.
+	// Redeems scheduled by a tx are processed before the next tx, in the order they were scheduled.
+	TxOrder []ProcessedTx
+
+	// The change in total ETH supply the block's txs were expected to cause, itemized, along with the actual change.
+	// This is filled in even if the two don't match, e.g. because funds were burnt.
+	BalanceDelta *BalanceDeltaBreakdown
+
+	// The trace of each tx in the block, in block order, if TxTracerFactory is set.
+	// Txs the factory returned no tracer for have no trace.
+	TxTraces []TxTrace
+
+	// The gas breakdown of each tx in the block, in block order, if RecordGasBreakdown is set.
+	GasBreakdown []TxGasBreakdown
+
+	// Redeems that weren't run because they were past MaxRedeemDepth.
+	// These aren't in TxErrors, as the txs that scheduled them were still included in the block,
+	// while the sequencer treats a TxErrors entry as meaning the tx was left out.
+	SkippedRedeems []*RedeemDepthError
+
+	// How many seconds the L1 timestamp was behind the parent block's timestamp, or 0 if it wasn't.
+	// When this is nonzero the block's timestamp was clamped up to its parent's.
+	TimestampRegression uint64
+}
+
+// BalanceDeltaBreakdown itemizes the change in total ETH supply a block's txs are expected to cause.
+type BalanceDeltaBreakdown struct {
+	Deposited          *big.Int // By L1->L2 deposits
+	RetryableDeposited *big.Int // By the deposit value of retryable submissions
+	Withdrawn          *big.Int // By L2->L1 withdrawals
+	Actual             *big.Int // The change the statedb actually saw, which is less than Expected if funds were burnt
+}
+
+// Expected is the total expected change, i.e. the deposits minus the withdrawals.
+func (d *BalanceDeltaBreakdown) Expected() *big.Int {
+	expected := new(big.Int).Add(d.Deposited, d.RetryableDeposited)
+	return expected.Sub(expected, d.Withdrawn)
+}
+
+// TxTracer traces the execution of a single tx. It has the same layout as geth's tracers.Tracer,
+// so one can be adapted with &TxTracer{Hooks: tracer.Hooks, GetResult: tracer.GetResult}.
+type TxTracer struct {
+	Hooks     *tracing.Hooks
+	GetResult func() (json.RawMessage, error)
+}
+
+// TxTrace is the result of tracing a tx with a TxTracer.
+type TxTrace struct {
+	TxHash common.Hash
+	Result json.RawMessage
+	Err    error // The error returned by the tracer's GetResult
+}
+
+// TxGasBreakdown splits the gas used by a tx into the L1 poster cost, expressed in L2 gas, and the L2 compute gas.
+// PosterCost is the L1 poster cost in wei, which DataGas is derived from by dividing by the basefee.
+type TxGasBreakdown struct {
+	TxHash     common.Hash
+	DataGas    uint64 // The poster cost from GetPosterInfo in L2 gas, which is only charged to txs that pay for gas
+	ComputeGas uint64 // Has a floor of params.TxGas, so DataGas + ComputeGas may exceed TotalGas
+	TotalGas   uint64 // Excludes gas set aside for any redeems the tx scheduled
+	PosterCost *big.Int
+	// Whether the poster cost was too large to convert to L2 gas at the block's basefee, in which case
+	// DataGas was clamped to the tx's gas limit
+	PosterCostOverflow bool
+}
+
+// TxOutcome summarizes what happened to a user tx during block production.
+type TxOutcome uint8
+
+const (
+	TxIncluded TxOutcome = iota
+	TxDroppedInvalid
+	TxDroppedGasLimit
+	TxDroppedPreFilter
+	TxDroppedPostFilter
+	TxDeferred
+	TxDroppedBlockFilter
+)
+
+func (o TxOutcome) String() string {
+	switch o {
+	case TxIncluded:
+		return "included"
+	case TxDroppedInvalid:
+		return "dropped (invalid)"
+	case TxDroppedGasLimit:
+		return "dropped (gas limit)"
+	case TxDroppedPreFilter:
+		return "dropped (pre-tx filter)"
+	case TxDroppedPostFilter:
+		return "dropped (post-tx filter)"
+	case TxDeferred:
+		return "deferred"
+	case TxDroppedBlockFilter:
+		return "dropped (block filter)"
+	default:
+		return fmt.Sprintf("unknown tx outcome %d", uint8(o))
+	}
+}
+
+// TxOutcomeFromError classifies a user tx's entry in SequencingHooks.TxErrors.
+func TxOutcomeFromError(err error) TxOutcome {
+	if err == nil {
+		return TxIncluded
+	}
+	var culpritErr *BlockFilterCulpritError
+	if errors.As(err, &culpritErr) {
+		return TxDroppedBlockFilter
+	}
+	if errors.Is(err, ErrSenderGasLimitReached) || errors.Is(err, ErrBlockTimeBudgetExceeded) {
+		return TxDeferred
+	}
+	if errors.Is(err, core.ErrGasLimitReached) {
+		return TxDroppedGasLimit
+	}
+	var filterErr *TxFilterError
+	if errors.As(err, &filterErr) {
+		switch filterErr.Stage {
+		case PreTxFilterStage, ExtraPreTxFilterStage:
+			return TxDroppedPreFilter
+		default:
+			return TxDroppedPostFilter
+		}
+	}
+	return TxDroppedInvalid
+}
+
+// DropReason categorizes why a user tx was left out of a block, for aggregate metrics.
+type DropReason uint8
+
+const (
+	DropReasonOther DropReason = iota
+	DropReasonIntrinsicGas
+	DropReasonGasLimitReached
+	DropReasonPreTxFilter
+	DropReasonPostTxFilter
+	DropReasonBlockFilter
+	DropReasonInvalidSignature
+	DropReasonNonce
+	DropReasonInsufficientFunds
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropReasonOther:
+		return "other"
+	case DropReasonIntrinsicGas:
+		return "intrinsic gas"
+	case DropReasonGasLimitReached:
+		return "gas limit reached"
+	case DropReasonPreTxFilter:
+		return "pre-tx filter"
+	case DropReasonPostTxFilter:
+		return "post-tx filter"
+	case DropReasonBlockFilter:
+		return "block filter"
+	case DropReasonInvalidSignature:
+		return "invalid signature"
+	case DropReasonNonce:
+		return "nonce"
+	case DropReasonInsufficientFunds:
+		return "insufficient funds"
+	default:
+		return fmt.Sprintf("unknown drop reason %d", uint8(r))
+	}
+}
+
+// DropReasonFromError categorizes a user tx's entry in SequencingHooks.TxErrors.
+// It returns false if the tx wasn't dropped, i.e. it was included or deferred to a later block.
+func DropReasonFromError(err error) (DropReason, bool) {
+	if err == nil || errors.Is(err, ErrSenderGasLimitReached) || errors.Is(err, ErrBlockTimeBudgetExceeded) {
+		return 0, false
+	}
+	var filterErr *TxFilterError
+	if errors.As(err, &filterErr) {
+		switch filterErr.Stage {
+		case PreTxFilterStage, ExtraPreTxFilterStage:
+			return DropReasonPreTxFilter, true
+		default:
+			return DropReasonPostTxFilter, true
+		}
+	}
+	var culpritErr *BlockFilterCulpritError
+	switch {
+	case errors.As(err, &culpritErr):
+		return DropReasonBlockFilter, true
+	case errors.Is(err, core.ErrIntrinsicGas):
+		return DropReasonIntrinsicGas, true
+	case errors.Is(err, core.ErrGasLimitReached):
+		return DropReasonGasLimitReached, true
+	case errors.Is(err, types.ErrInvalidSig), errors.Is(err, types.ErrInvalidChainId):
+		return DropReasonInvalidSignature, true
+	case errors.Is(err, core.ErrNonceTooLow), errors.Is(err, core.ErrNonceTooHigh), errors.Is(err, core.ErrNonceMax):
+		return DropReasonNonce, true
+	case errors.Is(err, core.ErrInsufficientFunds), errors.Is(err, core.ErrInsufficientFundsForTransfer):
+		return DropReasonInsufficientFunds, true
+	}
+	return DropReasonOther, true
+}
+
+func (r *BlockProductionResult) countDrop(reason DropReason) {
+	if r.DropCounts == nil {
+		r.DropCounts = make(map[DropReason]uint64)
+	}
+	r.DropCounts[reason]++
+}
+
+// ProcessedTx records a tx ProduceBlockAdvanced attempted to apply.
+type ProcessedTx struct {
+	TxHash   common.Hash
+	Kind     ProcessedTxKind
+	TicketId common.Hash // The retryable the tx redeemed, for redeems
+	Applied  bool        // Whether the tx made it into the block
+}
+
+type ProcessedTxKind uint8
+
+const (
+	ProcessedInternalTx ProcessedTxKind = iota
+	ProcessedUserTx
+	ProcessedRedeem
+)
+
+func (k ProcessedTxKind) String() string {
+	switch k {
+	case ProcessedInternalTx:
+		return "internal tx"
+	case ProcessedUserTx:
+		return "user tx"
+	case ProcessedRedeem:
+		return "redeem"
+	default:
+		return fmt.Sprintf("unknown processed tx kind %d", uint8(k))
+	}
+}
+
+var logGasLimitsOnce sync.Once
+
+// TxFilterStage identifies which transaction filter rejected a transaction.
+type TxFilterStage uint8
+
+const (
+	PreTxFilterStage TxFilterStage = iota
+	ExtraPreTxFilterStage
+	PostTxFilterStage
+	ExtraPostTxFilterStage
+)
+
+func (s TxFilterStage) String() string {
+	switch s {
+	case PreTxFilterStage:
+		return "PreTxFilter"
+	case ExtraPreTxFilterStage:
+		return "extraPreTxFilter"
+	case PostTxFilterStage:
+		return "PostTxFilter"
+	case ExtraPostTxFilterStage:
+		return "extraPostTxFilter"
+	default:
+		return fmt.Sprintf("TxFilterStage(%d)", uint8(s))
+	}
+}
+
+// TxFilterError is recorded in SequencingHooks.TxErrors when a transaction filter rejects a transaction.
+type TxFilterError struct {
+	Stage TxFilterStage
+	Err   error
+}
+
+func (e *TxFilterError) Error() string {
+	return fmt.Sprintf("transaction rejected by %v: %v", e.Stage, e.Err)
+}
+
+func (e *TxFilterError) Unwrap() error {
+	return e.Err
+}
+
+// ErrBlockTimeBudgetExceeded is the error for user txs that weren't attempted because the block had already taken
+// longer than MaxBlockBuildDuration to build. Like ErrSenderGasLimitReached, it wraps core.ErrGasLimitReached.
+var ErrBlockTimeBudgetExceeded = fmt.Errorf("%w: block build time budget exceeded", core.ErrGasLimitReached)
+
+// ErrInvalidRedeem is the error for a scheduled redeem whose sender can't be recovered. Redeems are created by ArbOS
+// rather than submitted, so this means a bug, and block production fails instead of silently dropping the redeem.
+var ErrInvalidRedeem = errors.New("invalid scheduled redeem")
+
+// ErrWithdrawalCapExceeded is the error for user txs whose L2->L1 withdrawals would push the block's total withdrawal
+// value past SequencingHooks.MaxWithdrawalValuePerBlock.
+var ErrWithdrawalCapExceeded = errors.New("block withdrawal value cap exceeded")
+
+// ErrTxTypeNotAllowed is the error for user txs whose type isn't in SequencingHooks.AllowedTxTypes.
+var ErrTxTypeNotAllowed = errors.New("transaction type not allowed")
+
+// ErrSenderGasLimitReached wraps core.ErrGasLimitReached so callers treating that as "retry in a later block" keep working.
+var ErrSenderGasLimitReached = fmt.Errorf("%w: sender exceeded its compute gas budget for this block", core.ErrGasLimitReached)
+
 func NoopSequencingHooks() *SequencingHooks {
 	return &SequencingHooks{
-		[]error{},
-		false,
-		func(*params.ChainConfig, *types.Header, *state.StateDB, *arbosState.ArbosState, *types.Transaction, *arbitrum_types.ConditionalOptions, common.Address, *L1Info) error {
+		TxErrors:               []error{},
+		DiscardInvalidTxsEarly: false,
+		AllowOversizedFirstTx:  true,
+		PreTxFilter: func(*params.ChainConfig, *types.Header, *state.StateDB, *arbosState.ArbosState, *types.Transaction, *arbitrum_types.ConditionalOptions, common.Address, *L1Info) error {
 			return nil
 		},
-		func(*types.Header, *state.StateDB, *arbosState.ArbosState, *types.Transaction, common.Address, uint64, *core.ExecutionResult) error {
+		PostTxFilter: func(*types.Header, *state.StateDB, *arbosState.ArbosState, *types.Transaction, common.Address, uint64, *core.ExecutionResult) error {
 			return nil
 		},
-		nil,
-		nil,
+		BlockFilter:             nil,
+		ConditionalOptionsForTx: nil,
 	}
 }
 
@@ -147,6 +769,26 @@ func ProduceBlock(
 	isMsgForPrefetch bool,
 	runCtx *core.MessageRunContext,
 ) (*types.Block, types.Receipts, error) {
+	return ProduceBlockWithContext(context.Background(), message, delayedMessagesRead, lastBlockHeader, statedb, chainContext, isMsgForPrefetch, runCtx)
+}
+
+// ProduceBlockWithContext is like ProduceBlock, but stops between txs once ctx is canceled.
+func ProduceBlockWithContext(
+	ctx context.Context,
+	message *arbostypes.L1IncomingMessage,
+	delayedMessagesRead uint64,
+	lastBlockHeader *types.Header,
+	statedb *state.StateDB,
+	chainContext core.ChainContext,
+	isMsgForPrefetch bool,
+	runCtx *core.MessageRunContext,
+) (*types.Block, types.Receipts, error) {
+	if message == nil {
+		return nil, nil, errors.New("nil incoming message")
+	}
+	if err := checkBlockProductionInputs(message.Header, lastBlockHeader, statedb, chainContext); err != nil {
+		return nil, nil, err
+	}
 	chainConfig := chainContext.Config()
 	txes, err := ParseL2Transactions(message, chainConfig.ChainID)
 	if err != nil {
@@ -155,13 +797,167 @@ func ProduceBlock(
 	}
 
 	hooks := NoopSequencingHooks()
-	return ProduceBlockAdvanced(
-		message.Header, txes, delayedMessagesRead, lastBlockHeader, statedb, chainContext, hooks, isMsgForPrefetch, runCtx,
+	// Without BlockFilterWithCulprit the block is always produced into statedb itself
+	block, receipts, _, err := ProduceBlockAdvanced(
+		ctx, message.Header, txes, delayedMessagesRead, lastBlockHeader, statedb, chainContext, hooks, isMsgForPrefetch, runCtx,
 	)
+	return block, receipts, err
+}
+
+// queuedRedeem is a scheduled redeem waiting to be applied, along with how many redeems deep it is
+// in the chain started by the tx originTx.
+type queuedRedeem struct {
+	tx       *types.Transaction
+	depth    uint64
+	originTx common.Hash
 }
 
 // A bit more flexible than ProduceBlock for use in the sequencer.
+// ctx is checked before each tx is applied, and once it's canceled ErrBlockProductionCanceled is returned.
+// The statedb is never left mid-tx, but each applied tx is finalized into it, so its journal can't undo
+// the txs already applied. Callers that want to retry should either set CopyStateDB or reopen the state
+// from lastBlockHeader.Root.
+//
+// If BlockFilterWithCulprit rejects the block and names one of its txs, the user tx responsible for it
+// (the tx itself, or the tx that scheduled it if it's a redeem) is dropped with a BlockFilterCulpritError in
+// TxErrors, and the block is produced again without it, up to maxBlockFilterCulprits times. Since applied txs
+// can't be reverted, each attempt is produced into its own copy of statedb, leaving statedb itself untouched.
+//
+// The statedb the block was produced into is returned alongside it, and it's what the caller must commit:
+// it's statedb itself unless CopyStateDB or BlockFilterWithCulprit is set.
 func ProduceBlockAdvanced(
+	ctx context.Context,
+	l1Header *arbostypes.L1IncomingMessageHeader,
+	txes types.Transactions,
+	delayedMessagesRead uint64,
+	lastBlockHeader *types.Header,
+	statedb *state.StateDB,
+	chainContext core.ChainContext,
+	sequencingHooks *SequencingHooks,
+	isMsgForPrefetch bool,
+	runCtx *core.MessageRunContext,
+) (*types.Block, types.Receipts, *state.StateDB, error) {
+	if err := checkBlockProductionInputs(l1Header, lastBlockHeader, statedb, chainContext); err != nil {
+		return nil, nil, nil, err
+	}
+	if sequencingHooks == nil {
+		return nil, nil, nil, errors.New("nil sequencing hooks, use NoopSequencingHooks() for none")
+	}
+	if metrics.Enabled() && !sequencingHooks.DryRun && !isMsgForPrefetch {
+		defer blockProductionTimer.UpdateSince(time.Now())
+	}
+	if sequencingHooks.BlockFilterWithCulprit == nil {
+		produced := statedb
+		if sequencingHooks.CopyStateDB {
+			produced = statedb.Copy()
+			// The ArbOS state was opened on the original statedb
+			defer func(arbState *arbosState.ArbosState) { sequencingHooks.ArbosState = arbState }(sequencingHooks.ArbosState)
+			sequencingHooks.ArbosState = nil
+		}
+		block, receipts, err := produceBlockAdvanced(ctx, l1Header, txes, delayedMessagesRead, lastBlockHeader, produced, chainContext, sequencingHooks, isMsgForPrefetch, runCtx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return block, receipts, produced, nil
+	}
+
+	// The ArbOS state was opened on statedb, but each attempt is produced into a copy of it
+	defer func(arbState *arbosState.ArbosState) { sequencingHooks.ArbosState = arbState }(sequencingHooks.ArbosState)
+	sequencingHooks.ArbosState = nil
+	txErrors := sequencingHooks.TxErrors
+	conditionalOptions := sequencingHooks.ConditionalOptionsForTx
+	dropped := make(map[int]error)
+	for {
+		remaining := make(types.Transactions, 0, len(txes)-len(dropped))
+		var remainingOptions []*arbitrum_types.ConditionalOptions
+		for i, tx := range txes {
+			if dropped[i] != nil {
+				continue
+			}
+			remaining = append(remaining, tx)
+			if i < len(conditionalOptions) {
+				remainingOptions = append(remainingOptions, conditionalOptions[i])
+			}
+		}
+		attemptStatedb := statedb.Copy()
+		sequencingHooks.TxErrors = txErrors[:len(txErrors):len(txErrors)]
+		sequencingHooks.ConditionalOptionsForTx = remainingOptions
+
+		block, receipts, err := produceBlockAdvanced(ctx, l1Header, remaining, delayedMessagesRead, lastBlockHeader, attemptStatedb, chainContext, sequencingHooks, isMsgForPrefetch, runCtx)
+		var culprit *blockFilterCulprit
+		if !errors.As(err, &culprit) {
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if len(dropped) > 0 {
+				restoreDroppedTxErrors(sequencingHooks, len(txErrors), dropped)
+			}
+			return block, receipts, attemptStatedb, nil
+		}
+		if len(dropped) >= maxBlockFilterCulprits {
+			return nil, nil, nil, fmt.Errorf("block filter still rejected the block after dropping %v txs: %w", len(dropped), culprit.err)
+		}
+		index := -1
+		for i, tx := range txes {
+			if dropped[i] == nil && tx.Hash() == culprit.originTx {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, nil, nil, fmt.Errorf("block filter named tx %v, which isn't a user tx, as the culprit: %w", culprit.originTx, culprit.err)
+		}
+		dropped[index] = &BlockFilterCulpritError{TxHash: culprit.originTx, Err: culprit.err}
+		log.Debug("block filter rejected block, retrying without culprit", "tx", culprit.originTx, "err", culprit.err)
+	}
+}
+
+// blockFilterCulprit is returned by produceBlockAdvanced when BlockFilterWithCulprit rejects the block because of
+// a tx that originated from the user tx originTx, so ProduceBlockAdvanced can retry without it.
+type blockFilterCulprit struct {
+	originTx common.Hash
+	err      error
+}
+
+func (e *blockFilterCulprit) Error() string {
+	return fmt.Sprintf("block filter rejected block because of tx %v: %v", e.originTx, e.err)
+}
+
+// restoreDroppedTxErrors puts entries for the user txs dropped by BlockFilterWithCulprit back into TxErrors
+// and TxOutcomes, which the last attempt only filled in for the txes it was given, so they match the original txes.
+// prefix is the number of entries TxErrors already had before block production.
+func restoreDroppedTxErrors(sequencingHooks *SequencingHooks, prefix int, dropped map[int]error) {
+	attemptErrors := sequencingHooks.TxErrors[prefix:]
+	attemptOutcomes := sequencingHooks.Result.TxOutcomes
+	txErrors := sequencingHooks.TxErrors[:prefix:prefix]
+	var outcomes []TxOutcome
+	for i := 0; i < len(attemptErrors)+len(dropped); i++ {
+		if err := dropped[i]; err != nil {
+			txErrors = append(txErrors, err)
+			outcomes = append(outcomes, TxDroppedBlockFilter)
+			if sequencingHooks.CountDropReasons {
+				sequencingHooks.Result.countDrop(DropReasonBlockFilter)
+			}
+			continue
+		}
+		if len(attemptErrors) == 0 {
+			break
+		}
+		txErrors = append(txErrors, attemptErrors[0])
+		attemptErrors = attemptErrors[1:]
+		if len(attemptOutcomes) > 0 {
+			outcomes = append(outcomes, attemptOutcomes[0])
+			attemptOutcomes = attemptOutcomes[1:]
+		}
+	}
+	sequencingHooks.TxErrors = txErrors
+	if sequencingHooks.RecordTxOutcomes {
+		sequencingHooks.Result.TxOutcomes = outcomes
+	}
+}
+
+func produceBlockAdvanced(
+	ctx context.Context,
 	l1Header *arbostypes.L1IncomingMessageHeader,
 	txes types.Transactions,
 	delayedMessagesRead uint64,
@@ -172,73 +968,157 @@ func ProduceBlockAdvanced(
 	isMsgForPrefetch bool,
 	runCtx *core.MessageRunContext,
 ) (*types.Block, types.Receipts, error) {
+	sequencingHooks.Result = BlockProductionResult{}
 
-	arbState, err := arbosState.OpenSystemArbosState(statedb, nil, true)
+	if sequencingHooks.RequireNonZeroPoster && l1Header.Poster == (common.Address{}) {
+		return nil, nil, ErrZeroPoster
+	}
+
+	if lastBlockHeader != nil {
+		if lastDelayedMessagesRead := lastBlockHeader.Nonce.Uint64(); delayedMessagesRead < lastDelayedMessagesRead {
+			return nil, nil, fmt.Errorf("%w: block %v read %v delayed messages but its parent already read %v", ErrDelayedMessagesReadDecreased, new(big.Int).Add(lastBlockHeader.Number, common.Big1), delayedMessagesRead, lastDelayedMessagesRead)
+		}
+		// createNewHeader clamps the timestamp to the parent's, which is consensus behavior; this only surfaces it
+		if l1Header.Timestamp < lastBlockHeader.Time {
+			regression := lastBlockHeader.Time - l1Header.Timestamp
+			sequencingHooks.Result.TimestampRegression = regression
+			threshold := sequencingHooks.TimestampRegressionWarnThreshold
+			if threshold == 0 {
+				threshold = DefaultTimestampRegressionWarnThreshold
+			}
+			if regression > threshold && !isMsgForPrefetch {
+				timestampRegressionCounter.Inc(1)
+				log.Warn("L1 timestamp is behind the parent block, clamping the block timestamp", "block", new(big.Int).Add(lastBlockHeader.Number, common.Big1), "l1Timestamp", l1Header.Timestamp, "parentTimestamp", lastBlockHeader.Time, "regressionSeconds", regression)
+			}
+		}
+	}
+
+	var buildDeadline time.Time
+	if sequencingHooks.MaxBlockBuildDuration > 0 {
+		buildDeadline = sequencingHooks.clock().Now().Add(sequencingHooks.MaxBlockBuildDuration)
+	}
+
+	openedArbState := sequencingHooks.ArbosState
+	if sequencingHooks.DryRun {
+		// Finalise clears the statedb's journal after every tx, so a snapshot can't undo the block; work on a copy instead
+		statedb = statedb.Copy()
+		openedArbState = nil
+	}
+
+	builder, err := newBlockBuilder(l1Header, lastBlockHeader, statedb, chainContext, runCtx, openedArbState)
 	if err != nil {
 		return nil, nil, err
 	}
+	builder.buildDeadline = buildDeadline
+	builder.vmConfig = sequencingHooks.VMConfig
+	builder.txTracerFactory = sequencingHooks.TxTracerFactory
+	if sequencingHooks.OnStateDiff != nil {
+		builder.stateDiff = newStateDiffCollector()
+	}
+	builder.onArbOSUpgrade = sequencingHooks.OnArbOSUpgrade
+	builder.resetRefundOnMismatch = sequencingHooks.ResetRefundOnMismatch
+	header := builder.header
+	chainConfig := builder.chainConfig
+	injectFailure := sequencingHooks.InjectFailure
+	if injectFailure != nil && !chainConfig.DebugMode() {
+		return nil, nil, errors.New("failure injection is only allowed in debug mode")
+	}
 
-	if statedb.GetUnexpectedBalanceDelta().BitLen() != 0 {
-		return nil, nil, errors.New("ProduceBlock called with dirty StateDB (non-zero unexpected balance delta)")
+	if sequencingHooks.MixDigestProvider != nil {
+		if !chainConfig.DebugMode() {
+			return nil, nil, errors.New("overriding the mix digest is only allowed in debug mode")
+		}
+		// The EVM's block context is built from the MixDigest, which carries the ArbOS version, so overriding it can change execution.
+		// Applying the start block tx rewrites the MixDigest from the header info, so only that tx sees the override.
+		// Blocks produced this way can't be reproduced by replay, which always copies the parent's MixDigest.
+		header.MixDigest = sequencingHooks.MixDigestProvider(header)
 	}
 
-	poster := l1Header.Poster
+	if sequencingHooks.AdjustGasLimit != nil {
+		// header.GasLimit is part of the block hash, and replay doesn't run this hook,
+		// so it can only be used on development chains where the blocks are never replayed.
+		if !chainConfig.DebugMode() {
+			return nil, nil, errors.New("adjusting the block gas limit is only allowed in debug mode")
+		}
+		if err := builder.SetGasLimit(sequencingHooks.AdjustGasLimit(header, lastBlockHeader)); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	l1Info := &L1Info{
-		poster:        poster,
-		l1BlockNumber: l1Header.BlockNumber,
-		l1Timestamp:   l1Header.Timestamp,
+	if sequencingHooks.MaxRedeemDepth > 0 && !chainConfig.DebugMode() {
+		return nil, nil, errors.New("limiting the redeem depth is only allowed in debug mode")
 	}
 
-	chainConfig := chainContext.Config()
+	if sequencingHooks.SkipStartBlockTx && !chainConfig.DebugMode() {
+		return nil, nil, errors.New("skipping the start block tx is only allowed in debug mode")
+	}
 
-	header := createNewHeader(lastBlockHeader, l1Info, arbState, chainConfig)
-	// Note: blockGasLeft will diverge from the actual gas left during execution in the event of invalid txs,
-	// but it's only used as block-local representation limiting the amount of work done in a block.
-	blockGasLeft, _ := arbState.L2PricingState().PerBlockGasLimit()
-	l1BlockNum := l1Info.l1BlockNumber
+	sequencingHooks.Result.PerBlockGasLimit = builder.blockGasLeft
+	sequencingHooks.Result.GethBlockGasLimit = header.GasLimit
+	logGasLimitsOnce.Do(func() {
+		log.Info("Block production gas limits", "arbosPerBlockGasLimit", builder.blockGasLeft, "gethBlockGasLimit", header.GasLimit)
+	})
+
+	var blockSpan BlockSpan
+	if sequencingHooks.Tracer != nil {
+		blockSpan = sequencingHooks.Tracer.StartSpan("ProduceBlock")
+		defer blockSpan.End()
+		blockSpan.SetAttribute("blockNumber", header.Number.Uint64())
+		blockSpan.SetAttribute("txCount", len(txes))
+	}
 
 	// Prepend a tx before all others to touch up the state (update the L1 block num, pricing pools, etc)
-	startTx := InternalTxStartBlock(chainConfig.ChainID, l1Header.L1BaseFee, l1BlockNum, header, lastBlockHeader)
-	txes = append(types.Transactions{types.NewTx(startTx)}, txes...)
+	if !sequencingHooks.SkipStartBlockTx {
+		txes = append(types.Transactions{builder.StartBlockTx()}, txes...)
+	}
 
 	complete := types.Transactions{}
+	completeOrigins := []common.Hash{}
 	receipts := types.Receipts{}
-	basefee := header.BaseFee
 	time := header.Time
-	expectedBalanceDelta := new(big.Int)
-	redeems := types.Transactions{}
-	userTxsProcessed := 0
-
-	// We'll check that the block can fit each message, so this pool is set to not run out
-	gethGas := core.GasPool(l2pricing.GethBlockGasLimit)
+	redeems := []queuedRedeem{}
+	var userTxs, droppedUserTxs, appliedRedeems int64
 
 	for len(txes) > 0 || len(redeems) > 0 {
-		// repeatedly process the next tx, doing redeems created along the way in FIFO order
+		// repeatedly process the next tx, doing redeems created along the way in FIFO order.
+		// All the redeems a tx transitively schedules are applied before the next tx, in the order they were
+		// scheduled, so redeems scheduled by a redeem run after those scheduled before it. Replay depends on this.
+
+		if err := ctx.Err(); err != nil {
+			return nil, nil, fmt.Errorf("%w after %v txs: %w", ErrBlockProductionCanceled, len(complete), err)
+		}
 
 		var tx *types.Transaction
 		var options *arbitrum_types.ConditionalOptions
 		hooks := NoopSequencingHooks()
 		isUserTx := false
+		processed := ProcessedTx{Kind: ProcessedInternalTx}
+		var redeemDepth uint64
+		var originTx common.Hash
 		if len(redeems) > 0 {
-			tx = redeems[0]
+			tx = redeems[0].tx
+			redeemDepth = redeems[0].depth
+			originTx = redeems[0].originTx
 			redeems = redeems[1:]
 
 			retry, ok := (tx.GetInner()).(*types.ArbitrumRetryTx)
 			if !ok {
 				return nil, nil, errors.New("retryable tx is somehow not a retryable")
 			}
-			retryable, _ := arbState.RetryableState().OpenRetryable(retry.TicketId, time)
+			retryable, _ := builder.arbState.RetryableState().OpenRetryable(retry.TicketId, time)
 			if retryable == nil {
 				// retryable was already deleted
 				continue
 			}
+			processed = ProcessedTx{Kind: ProcessedRedeem, TicketId: retry.TicketId}
 		} else {
 			tx = txes[0]
 			txes = txes[1:]
+			originTx = tx.Hash()
 			if tx.Type() != types.ArbitrumInternalTxType {
 				hooks = sequencingHooks // the sequencer has the ability to drop this tx
 				isUserTx = true
+				processed.Kind = ProcessedUserTx
 				if len(hooks.ConditionalOptionsForTx) > 0 {
 					options = hooks.ConditionalOptionsForTx[0]
 					hooks.ConditionalOptionsForTx = hooks.ConditionalOptionsForTx[1:]
@@ -246,218 +1126,137 @@ func ProduceBlockAdvanced(
 			}
 		}
 
-		startRefund := statedb.GetRefund()
-		if startRefund != 0 {
-			return nil, nil, fmt.Errorf("at beginning of tx statedb has non-zero refund %v", startRefund)
+		if injectFailure != nil && injectFailure.OnTxHash != (common.Hash{}) && tx.Hash() == injectFailure.OnTxHash {
+			return nil, nil, fmt.Errorf("%w: on tx %v", ErrInjectedFailure, tx.Hash())
 		}
 
-		var sender common.Address
-		var dataGas uint64 = 0
-		preTxHeaderGasUsed := header.GasUsed
-		signer := types.MakeSigner(chainConfig, header.Number, header.Time, arbState.ArbOSVersion())
-		receipt, result, err := (func() (*types.Receipt, *core.ExecutionResult, error) {
-			// If we've done too much work in this block, discard the tx as early as possible
-			if blockGasLeft < params.TxGas && isUserTx {
-				return nil, nil, core.ErrGasLimitReached
-			}
-
-			sender, err = signer.Sender(tx)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			// Writes to statedb object should be avoided to prevent invalid state from permeating as statedb snapshot is not taken
-			if err = hooks.PreTxFilter(chainConfig, header, statedb, arbState, tx, options, sender, l1Info); err != nil {
-				return nil, nil, err
-			}
-
-			// Additional pre-transaction validity check
-			// Writes to statedb object should be avoided to prevent invalid state from permeating as statedb snapshot is not taken
-			if err = extraPreTxFilter(chainConfig, header, statedb, arbState, tx, options, sender, l1Info); err != nil {
-				return nil, nil, err
-			}
-
-			if basefee.Sign() > 0 {
-				dataGas = math.MaxUint64
-				brotliCompressionLevel, err := arbState.BrotliCompressionLevel()
-				if err != nil {
-					return nil, nil, fmt.Errorf("failed to get brotli compression level: %w", err)
-				}
-				posterCost, _ := arbState.L1PricingState().GetPosterInfo(tx, poster, brotliCompressionLevel)
-				posterCostInL2Gas := arbmath.BigDiv(posterCost, basefee)
-
-				if posterCostInL2Gas.IsUint64() {
-					dataGas = posterCostInL2Gas.Uint64()
-				} else {
-					log.Error("Could not get poster cost in L2 terms", "posterCost", posterCost, "basefee", basefee)
-				}
+		var txSpan BlockSpan
+		if sequencingHooks.Tracer != nil && sequencingHooks.TraceEachTx {
+			txSpan = sequencingHooks.Tracer.StartSpan("ApplyTx")
+			txSpan.SetAttribute("txHash", tx.Hash().Hex())
+			txSpan.SetAttribute("txType", tx.Type())
+		}
+		applied, txErr, err := builder.ApplyTx(tx, hooks, options, isUserTx)
+		if txSpan != nil {
+			if txErr != nil {
+				txSpan.SetAttribute("error", txErr.Error())
+			} else if applied != nil {
+				txSpan.SetAttribute("gasUsed", applied.GasUsed)
 			}
+			txSpan.End()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
 
-			if dataGas > tx.Gas() {
-				// this txn is going to be rejected later
-				dataGas = tx.Gas()
-			}
+		// append the err, even if it is nil
+		hooks.TxErrors = append(hooks.TxErrors, txErr)
 
-			computeGas := tx.Gas() - dataGas
-			if computeGas < params.TxGas {
-				if hooks.DiscardInvalidTxsEarly {
-					return nil, nil, core.ErrIntrinsicGas
-				}
-				// ensure at least TxGas is left in the pool before trying a state transition
-				computeGas = params.TxGas
-			}
-
-			if computeGas > blockGasLeft && isUserTx && userTxsProcessed > 0 {
-				return nil, nil, core.ErrGasLimitReached
-			}
-
-			snap := statedb.Snapshot()
-			statedb.SetTxContext(tx.Hash(), len(receipts)) // the number of successful state transitions
-
-			gasPool := gethGas
-			blockContext := core.NewEVMBlockContext(header, chainContext, &header.Coinbase)
-			evm := vm.NewEVM(blockContext, statedb, chainConfig, vm.Config{})
-			receipt, result, err := core.ApplyTransactionWithResultFilter(
-				evm,
-				&gasPool,
-				statedb,
-				header,
-				tx,
-				&header.GasUsed,
-				runCtx,
-				func(result *core.ExecutionResult) error {
-					return hooks.PostTxFilter(header, statedb, arbState, tx, sender, dataGas, result)
-				},
-			)
-			if err != nil {
-				// Ignore this transaction if it's invalid under the state transition function
-				statedb.RevertToSnapshot(snap)
-				statedb.ClearTxFilter()
-				return nil, nil, err
+		if isUserTx {
+			userTxs++
+			if txErr != nil {
+				droppedUserTxs++
 			}
+		}
 
-			// Additional post-transaction validity check
-			if err = extraPostTxFilter(chainConfig, header, statedb, arbState, tx, options, sender, l1Info, result); err != nil {
-				statedb.RevertToSnapshot(snap)
-				statedb.ClearTxFilter()
-				return nil, nil, err
+		if isUserTx && sequencingHooks.CountDropReasons {
+			if reason, dropped := DropReasonFromError(txErr); dropped {
+				sequencingHooks.Result.countDrop(reason)
 			}
+		}
 
-			return receipt, result, nil
-		})()
+		if isUserTx && sequencingHooks.RecordTxOutcomes {
+			sequencingHooks.Result.TxOutcomes = append(sequencingHooks.Result.TxOutcomes, TxOutcomeFromError(txErr))
+		}
 
-		// append the err, even if it is nil
-		hooks.TxErrors = append(hooks.TxErrors, err)
+		if sequencingHooks.RecordTxOrder {
+			processed.TxHash = tx.Hash()
+			processed.Applied = txErr == nil
+			sequencingHooks.Result.TxOrder = append(sequencingHooks.Result.TxOrder, processed)
+		}
 
-		if err != nil {
+		if txErr != nil {
 			logLevel := log.Debug
 			if chainConfig.DebugMode() {
 				logLevel = log.Warn
 			}
 			if !isMsgForPrefetch {
-				logLevel("error applying transaction", "tx", printTxAsJson{tx}, "err", err)
+				logLevel("error applying transaction", "tx", printTxAsJson{tx}, "err", txErr)
 			}
-			if !hooks.DiscardInvalidTxsEarly {
-				// we'll still deduct a TxGas's worth from the block-local rate limiter even if the tx was invalid
-				blockGasLeft = arbmath.SaturatingUSub(blockGasLeft, params.TxGas)
-				if isUserTx {
-					userTxsProcessed++
-				}
+			if errors.Is(txErr, ErrSenderGasLimitReached) || errors.Is(txErr, ErrBlockTimeBudgetExceeded) {
+				sequencingHooks.Result.DeferredTxs = append(sequencingHooks.Result.DeferredTxs, tx)
 			}
 			continue
 		}
 
-		if tx.Type() == types.ArbitrumInternalTxType {
-			// ArbOS might have upgraded to a new version, so we need to refresh our state
-			arbState, err = arbosState.OpenSystemArbosState(statedb, nil, true)
-			if err != nil {
-				return nil, nil, err
-			}
-			// Update the ArbOS version in the header (if it changed)
-			extraInfo := types.DeserializeHeaderExtraInformation(header)
-			extraInfo.ArbOSFormatVersion = arbState.ArbOSVersion()
-			extraInfo.UpdateHeaderWithInfo(header)
+		switch processed.Kind {
+		case ProcessedInternalTx:
+			sequencingHooks.Result.InternalGasUsed += applied.GasUsed
+		case ProcessedUserTx:
+			sequencingHooks.Result.UserGasUsed += applied.GasUsed
+		case ProcessedRedeem:
+			sequencingHooks.Result.RedeemGasUsed += applied.GasUsed
+			appliedRedeems++
 		}
 
-		if tx.Type() == types.ArbitrumInternalTxType && result.Err != nil {
-			return nil, nil, fmt.Errorf("failed to apply internal transaction: %w", result.Err)
+		if applied.Trace != nil {
+			sequencingHooks.Result.TxTraces = append(sequencingHooks.Result.TxTraces, *applied.Trace)
 		}
 
-		if preTxHeaderGasUsed > header.GasUsed {
-			return nil, nil, fmt.Errorf("ApplyTransaction() used -%v gas", preTxHeaderGasUsed-header.GasUsed)
+		if sequencingHooks.RecordGasBreakdown {
+			sequencingHooks.Result.GasBreakdown = append(sequencingHooks.Result.GasBreakdown, TxGasBreakdown{
+				TxHash:             tx.Hash(),
+				DataGas:            applied.DataGas,
+				ComputeGas:         applied.ComputeUsed,
+				TotalGas:           applied.GasUsed,
+				PosterCost:         applied.PosterCost,
+				PosterCostOverflow: applied.PosterCostOverflow,
+			})
 		}
-		txGasUsed := header.GasUsed - preTxHeaderGasUsed
 
-		arbosVer := types.DeserializeHeaderExtraInformation(header).ArbOSFormatVersion
-		if arbosVer >= params.ArbosVersion_FixRedeemGas {
-			// subtract gas burned for future use
-			for _, scheduledTx := range result.ScheduledTxes {
-				switch inner := scheduledTx.GetInner().(type) {
-				case *types.ArbitrumRetryTx:
-					txGasUsed = arbmath.SaturatingUSub(txGasUsed, inner.Gas)
-				default:
-					log.Warn("Unexpected type of scheduled tx", "type", scheduledTx.Type())
+		// append any scheduled redeems
+		for _, scheduled := range applied.ScheduledTxes {
+			depth := redeemDepth + 1
+			if sequencingHooks.MaxRedeemDepth > 0 && depth > sequencingHooks.MaxRedeemDepth {
+				skipped := &RedeemDepthError{OriginTx: originTx, Depth: depth}
+				if retry, ok := scheduled.GetInner().(*types.ArbitrumRetryTx); ok {
+					skipped.TicketId = retry.TicketId
 				}
+				sequencingHooks.Result.SkippedRedeems = append(sequencingHooks.Result.SkippedRedeems, skipped)
+				continue
+			}
+			if sequencingHooks.OnScheduledTx != nil {
+				sequencingHooks.OnScheduledTx(tx, scheduled)
 			}
+			redeems = append(redeems, queuedRedeem{tx: scheduled, depth: depth, originTx: originTx})
 		}
 
-		// Update expectedTotalBalanceDelta (also done in logs loop)
-		switch txInner := tx.GetInner().(type) {
-		case *types.ArbitrumDepositTx:
-			// L1->L2 deposits add eth to the system
-			expectedBalanceDelta.Add(expectedBalanceDelta, txInner.Value)
-		case *types.ArbitrumSubmitRetryableTx:
-			// Retryable submission can include a deposit which adds eth to the system
-			expectedBalanceDelta.Add(expectedBalanceDelta, txInner.DepositValue)
-		}
+		complete = append(complete, tx)
+		completeOrigins = append(completeOrigins, originTx)
+		receipts = append(receipts, applied.Receipt)
 
-		computeUsed := txGasUsed - dataGas
-		if txGasUsed < dataGas {
-			log.Error("ApplyTransaction() used less gas than it should have", "delta", dataGas-txGasUsed)
-			computeUsed = params.TxGas
-		} else if computeUsed < params.TxGas {
-			computeUsed = params.TxGas
+		if sequencingHooks.ProgressCallback != nil {
+			// The receipts are shared with the block being built, but the slice is cut to its length so appending to it is safe
+			sequencingHooks.ProgressCallback(types.CopyHeader(header), receipts[:len(receipts):len(receipts)])
 		}
 
-		if txGasUsed > tx.Gas() {
-			return nil, nil, fmt.Errorf("ApplyTransaction() used %v more gas than it should have", txGasUsed-tx.Gas())
+		if injectFailure != nil && injectFailure.AfterTxs > 0 && len(complete) >= injectFailure.AfterTxs {
+			return nil, nil, fmt.Errorf("%w: after %v txs", ErrInjectedFailure, len(complete))
 		}
+	}
 
-		// append any scheduled redeems
-		redeems = append(redeems, result.ScheduledTxes...)
-
-		for _, txLog := range receipt.Logs {
-			if txLog.Address == ArbSysAddress {
-				// L2ToL1TransactionEventID is deprecated in upgrade 4, but it should to safe to make this code handle
-				// both events ignoring the version.
-				// TODO: Remove L2ToL1Transaction handling on next chain reset
-				// L2->L1 withdrawals remove eth from the system
-				switch txLog.Topics[0] {
-				case L2ToL1TransactionEventID:
-					event, err := util.ParseL2ToL1TransactionLog(txLog)
-					if err != nil {
-						log.Error("Failed to parse L2ToL1Transaction log", "err", err)
-					} else {
-						expectedBalanceDelta.Sub(expectedBalanceDelta, event.Callvalue)
-					}
-				case L2ToL1TxEventID:
-					event, err := util.ParseL2ToL1TxLog(txLog)
-					if err != nil {
-						log.Error("Failed to parse L2ToL1Tx log", "err", err)
-					} else {
-						expectedBalanceDelta.Sub(expectedBalanceDelta, event.Callvalue)
-					}
-				}
+	if chainConfig.DebugMode() {
+		// ApplyTx checks the refund before each tx; also check it after the last so a leak is attributed to this block
+		if refund := statedb.GetRefund(); refund != 0 {
+			var lastTxHash common.Hash
+			if len(complete) > 0 {
+				lastTxHash = complete[len(complete)-1].Hash()
 			}
-		}
-
-		blockGasLeft = arbmath.SaturatingUSub(blockGasLeft, computeUsed)
-
-		complete = append(complete, tx)
-		receipts = append(receipts, receipt)
-
-		if isUserTx {
-			userTxsProcessed++
+			if !sequencingHooks.ResetRefundOnMismatch {
+				return nil, nil, fmt.Errorf("at end of block statedb has non-zero refund %v after tx %v", refund, lastTxHash)
+			}
+			log.Warn("Resetting non-zero statedb refund at end of block", "refund", refund, "lastTx", lastTxHash)
+			statedb.SubRefund(refund)
 		}
 	}
 
@@ -471,9 +1270,39 @@ func ProduceBlockAdvanced(
 		}
 	}
 
+	if sequencingHooks.BlockFilterWithCulprit != nil {
+		culprit, err := sequencingHooks.BlockFilterWithCulprit(header, statedb, complete, receipts)
+		if err != nil {
+			if culprit < 0 {
+				return nil, nil, err
+			}
+			if culprit >= len(complete) {
+				return nil, nil, fmt.Errorf("block filter named tx %v as the culprit but the block only has %v txs: %w", culprit, len(complete), err)
+			}
+			return nil, nil, &blockFilterCulprit{originTx: completeOrigins[culprit], err: err}
+		}
+	}
+
+	if sequencingHooks.RecordSnapshotStats {
+		sequencingHooks.Result.Snapshots, sequencingHooks.Result.Reverts = builder.SnapshotStats()
+	}
+
+	sequencingHooks.Result.PerBlockGasLeft = builder.blockGasLeft
+	sequencingHooks.Result.GethGasLeft = arbmath.SaturatingUSub(header.GasLimit, header.GasUsed)
+
+	// Only the internal start block tx made it into the block
+	sequencingHooks.Result.EmptyBlock = len(complete) == 1
+
 	binary.BigEndian.PutUint64(header.Nonce[:], delayedMessagesRead)
 
-	FinalizeBlock(header, complete, statedb, chainConfig)
+	if injectFailure != nil && injectFailure.DuringFinalization {
+		return nil, nil, &FinalizeBlockError{Txs: complete, Receipts: receipts, Err: ErrInjectedFailure}
+	}
+
+	headerInfo, err := finalizeBlock(header, statedb, chainConfig, builder.arbState)
+	if err != nil {
+		return nil, nil, &FinalizeBlockError{Txs: complete, Receipts: receipts, Err: err}
+	}
 
 	// Touch up the block hashes in receipts
 	tmpBlock := types.NewBlock(header, &types.Body{Transactions: complete}, receipts, trie.NewStackTrie(nil))
@@ -492,24 +1321,652 @@ func ProduceBlockAdvanced(
 		return nil, nil, fmt.Errorf("block has %d txes but %d receipts", len(block.Transactions()), len(receipts))
 	}
 
+	if sequencingHooks.EncodeBlockRLP {
+		sequencingHooks.Result.BlockRLP, err = rlp.EncodeToBytes(block)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if blockSpan != nil {
+		blockSpan.SetAttribute("includedTxCount", len(complete))
+		blockSpan.SetAttribute("gasUsed", header.GasUsed)
+	}
+
 	balanceDelta := statedb.GetUnexpectedBalanceDelta()
+	expectedBalanceDelta := builder.expectedBalanceDelta
+	sequencingHooks.Result.BalanceDelta = builder.ExpectedBalanceDeltaBreakdown()
+	sequencingHooks.Result.BalanceDelta.Actual = new(big.Int).Set(balanceDelta)
 	if !arbmath.BigEquals(balanceDelta, expectedBalanceDelta) {
 		// Fail if funds have been minted or debug mode is enabled (i.e. this is a test)
 		if balanceDelta.Cmp(expectedBalanceDelta) > 0 || chainConfig.DebugMode() {
 			return nil, nil, fmt.Errorf("unexpected total balance delta %v (expected %v)", balanceDelta, expectedBalanceDelta)
 		}
-		// This is a real chain and funds were burnt, not minted, so only log an error and don't panic
-		log.Error("Unexpected total balance delta", "delta", balanceDelta, "expected", expectedBalanceDelta)
+		if sequencingHooks.DryRun {
+			return nil, nil, fmt.Errorf("funds would be burnt: unexpected total balance delta %v (expected %v)", balanceDelta, expectedBalanceDelta)
+		}
+		// This is a real chain and funds were burnt, not minted, so by default only log an error and don't panic
+		balanceBurntCounter.Inc(1)
+		switch sequencingHooks.BalanceBurnPolicy {
+		case BalanceBurnError:
+			return nil, nil, fmt.Errorf("funds burnt: unexpected total balance delta %v (expected %v)", balanceDelta, expectedBalanceDelta)
+		case BalanceBurnMetricOnly:
+		default:
+			log.Error("Unexpected total balance delta", "delta", balanceDelta, "expected", expectedBalanceDelta)
+		}
 	}
 
+	if sequencingHooks.DryRun {
+		return nil, receipts, nil
+	}
+	if metrics.Enabled() && !isMsgForPrefetch {
+		// Dropped txs include deferred ones, which may make it into a later block
+		blockUserTxsHistogram.Update(userTxs)
+		blockDroppedTxsHistogram.Update(droppedUserTxs)
+		blockRedeemsHistogram.Update(appliedRedeems)
+		blockGasUsedHistogram.Update(int64(block.GasUsed()))
+	}
+	if sequencingHooks.OnBlockFinalized != nil {
+		sequencingHooks.OnBlockFinalized(block.Header(), headerInfo.SendRoot, headerInfo.SendCount)
+	}
+	if builder.stateDiff != nil {
+		sequencingHooks.OnStateDiff(builder.stateDiff.diff(statedb))
+	}
 	return block, receipts, nil
 }
 
+// BlockBuilder applies transactions to an in-progress block with exactly the semantics of ProduceBlockAdvanced,
+// which is built on top of it. This lets alternative block building loops (e.g. ones pulling from a live mempool)
+// reuse Nitro's tx application rules. It never finalizes the block; that's up to the caller.
+type BlockBuilder struct {
+	header          *types.Header
+	lastBlockHeader *types.Header
+	l1BaseFee       *big.Int
+	statedb         *state.StateDB
+	arbState        *arbosState.ArbosState
+	chainContext    core.ChainContext
+	chainConfig     *params.ChainConfig
+	l1Info          *L1Info
+	runCtx          *core.MessageRunContext
+
+	// We'll check that the block can fit each message, so this pool is set to not run out.
+	// It's copied for each tx rather than drawn down, so it only caps the gas of individual txs.
+	gethGas core.GasPool
+	// Note: blockGasLeft will diverge from the actual gas left during execution in the event of invalid txs,
+	// but it's only used as block-local representation limiting the amount of work done in a block.
+	blockGasLeft         uint64
+	userTxsProcessed     int
+	txsApplied           int
+	senderComputeUsed    map[common.Address]uint64
+	expectedBalanceDelta *big.Int
+	deposited            *big.Int
+	retryableDeposited   *big.Int
+	withdrawn            *big.Int
+	snapshots            uint64
+	reverts              uint64
+	buildDeadline        time.Time // If set, user txs are no longer attempted once the hooks' clock reaches it
+	vmConfig             vm.Config
+	txTracerFactory      func(tx *types.Transaction) *TxTracer
+	stateDiff            *stateDiffCollector // If set, records the state each tx changes through the EVM
+	onArbOSUpgrade       func(oldVersion, newVersion uint64)
+	// Internal txs and redeems are applied with NoopSequencingHooks, so the block's setting is kept here too
+	resetRefundOnMismatch bool
+
+	// The brotli compression level poster costs are computed with, cached until something could have changed it
+	brotliLevel       uint64
+	brotliLevelCached bool
+	brotliLevelReads  uint64
+}
+
+// AppliedTx describes a transaction that was successfully applied by BlockBuilder.ApplyTx.
+type AppliedTx struct {
+	Receipt *types.Receipt
+	Result  *core.ExecutionResult
+	Sender  common.Address
+	// The tx's L1 data cost in L2 gas
+	DataGas uint64
+	// The tx's L1 data cost in wei, as estimated by GetPosterInfo. Zero if the block's basefee is zero
+	PosterCost *big.Int
+	// Whether PosterCost overflowed a uint64 when converted to L2 gas, so DataGas is just the tx's gas limit
+	PosterCostOverflow bool
+	// The gas used by the tx, not including gas set aside for the redeems it scheduled
+	GasUsed uint64
+	// The gas counted against the block's ArbOS gas limit
+	ComputeUsed uint64
+	// Retryable redeems scheduled by the tx, which ProduceBlockAdvanced applies before any further user txs
+	ScheduledTxes types.Transactions
+	// The tx's trace, if the builder has a tx tracer factory that returned a tracer for it
+	Trace *TxTrace
+}
+
+// NewBlockBuilder opens the ArbOS state and creates the header for the block following lastBlockHeader.
+// The statedb is modified in place as transactions are applied.
+func NewBlockBuilder(
+	l1Header *arbostypes.L1IncomingMessageHeader,
+	lastBlockHeader *types.Header,
+	statedb *state.StateDB,
+	chainContext core.ChainContext,
+	runCtx *core.MessageRunContext,
+) (*BlockBuilder, error) {
+	if err := checkBlockProductionInputs(l1Header, lastBlockHeader, statedb, chainContext); err != nil {
+		return nil, err
+	}
+	return newBlockBuilder(l1Header, lastBlockHeader, statedb, chainContext, runCtx, nil)
+}
+
+// newBlockBuilder is like NewBlockBuilder, but reuses arbState if it isn't nil.
+// arbState must have been opened on statedb, as it reads and writes ArbOS storage through it.
+func newBlockBuilder(
+	l1Header *arbostypes.L1IncomingMessageHeader,
+	lastBlockHeader *types.Header,
+	statedb *state.StateDB,
+	chainContext core.ChainContext,
+	runCtx *core.MessageRunContext,
+	arbState *arbosState.ArbosState,
+) (*BlockBuilder, error) {
+	if arbState == nil {
+		var err error
+		arbState, err = arbosState.OpenSystemArbosState(statedb, nil, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if arbState.BackingStorage().StateDB() != statedb {
+		return nil, errors.New("ArbOS state wasn't opened on the statedb the block is built into")
+	}
+
+	if statedb.GetUnexpectedBalanceDelta().BitLen() != 0 {
+		return nil, errors.New("ProduceBlock called with dirty StateDB (non-zero unexpected balance delta)")
+	}
+
+	l1Info := &L1Info{
+		poster:        l1Header.Poster,
+		l1BlockNumber: l1Header.BlockNumber,
+		l1Timestamp:   l1Header.Timestamp,
+	}
+
+	chainConfig := chainContext.Config()
+
+	header := createNewHeader(lastBlockHeader, l1Info, arbState, chainConfig, 0)
+	blockGasLeft, _ := arbState.L2PricingState().PerBlockGasLimit()
+
+	return &BlockBuilder{
+		header:               header,
+		lastBlockHeader:      lastBlockHeader,
+		l1BaseFee:            l1Header.L1BaseFee,
+		statedb:              statedb,
+		arbState:             arbState,
+		chainContext:         chainContext,
+		chainConfig:          chainConfig,
+		l1Info:               l1Info,
+		runCtx:               runCtx,
+		gethGas:              core.GasPool(header.GasLimit),
+		blockGasLeft:         blockGasLeft,
+		expectedBalanceDelta: new(big.Int),
+		deposited:            new(big.Int),
+		retryableDeposited:   new(big.Int),
+		withdrawn:            new(big.Int),
+	}, nil
+}
+
+// Header returns the in-progress header. GasUsed and the ArbOS version are kept up to date as txs are applied.
+func (b *BlockBuilder) Header() *types.Header {
+	return b.header
+}
+
+// ExpectedBalanceDelta is the change in total ETH supply the applied txs should have caused via deposits and withdrawals.
+func (b *BlockBuilder) ExpectedBalanceDelta() *big.Int {
+	return new(big.Int).Set(b.expectedBalanceDelta)
+}
+
+// ExpectedBalanceDeltaBreakdown itemizes ExpectedBalanceDelta. Its Actual field is left nil.
+func (b *BlockBuilder) ExpectedBalanceDeltaBreakdown() *BalanceDeltaBreakdown {
+	return &BalanceDeltaBreakdown{
+		Deposited:          new(big.Int).Set(b.deposited),
+		RetryableDeposited: new(big.Int).Set(b.retryableDeposited),
+		Withdrawn:          new(big.Int).Set(b.withdrawn),
+	}
+}
+
+// SetGasLimit replaces the header's GasLimit and rebuilds the geth gas pool to match. It must be called before any tx is applied.
+// This doesn't change the ArbOS per-block gas limit, which separately rate limits the compute gas of the block's txs.
+// Since the geth gas pool is reset for each tx, a gas limit below the per-block gas limit caps each tx's gas rather than the block's.
+func (b *BlockBuilder) SetGasLimit(gasLimit uint64) error {
+	if b.txsApplied > 0 {
+		return errors.New("can't change the gas limit of a block after applying txs")
+	}
+	b.header.GasLimit = gasLimit
+	b.gethGas = core.GasPool(gasLimit)
+	return nil
+}
+
+// brotliCompressionLevel returns the brotli compression level used to estimate poster costs.
+// It's read from the ArbOS state once and then cached, until a tx that could have changed it is applied:
+// an internal tx, which may upgrade ArbOS, or a tx in which the chain owner acted (e.g. SetBrotliCompressionLevel).
+func (b *BlockBuilder) brotliCompressionLevel() (uint64, error) {
+	if !b.brotliLevelCached {
+		level, err := b.arbState.BrotliCompressionLevel()
+		if err != nil {
+			return 0, err
+		}
+		b.brotliLevel = level
+		b.brotliLevelCached = true
+		b.brotliLevelReads++
+	}
+	return b.brotliLevel, nil
+}
+
+// SnapshotStats returns the number of state snapshots taken and reverted while applying txs so far.
+func (b *BlockBuilder) SnapshotStats() (snapshots uint64, reverts uint64) {
+	return b.snapshots, b.reverts
+}
+
+// StartBlockTx returns the internal tx that must be applied before all others to touch up the state
+// (update the L1 block num, pricing pools, etc).
+func (b *BlockBuilder) StartBlockTx() *types.Transaction {
+	startTx := InternalTxStartBlock(b.chainConfig.ChainID, b.l1BaseFee, b.l1Info.l1BlockNumber, b.header, b.lastBlockHeader)
+	return types.NewTx(startTx)
+}
+
+// ApplyTx applies tx to the block, running it through the hooks' filters and the block's gas limits.
+// If the tx is rejected, the state is reverted and the reason is returned as txErr; the block can still be continued.
+// A non-nil err means an invariant was violated and the block can't be built.
+// isUserTx should be set for txs the sequencer is allowed to drop, and options are the tx's conditional options, if any.
+func (b *BlockBuilder) ApplyTx(
+	tx *types.Transaction,
+	hooks *SequencingHooks,
+	options *arbitrum_types.ConditionalOptions,
+	isUserTx bool,
+) (applied *AppliedTx, txErr error, err error) {
+	header := b.header
+	statedb := b.statedb
+	chainConfig := b.chainConfig
+	arbState := b.arbState
+	l1Info := b.l1Info
+	basefee := header.BaseFee
+
+	startRefund := statedb.GetRefund()
+	if startRefund != 0 {
+		if !hooks.ResetRefundOnMismatch && !b.resetRefundOnMismatch {
+			return nil, nil, fmt.Errorf("at beginning of tx statedb has non-zero refund %v", startRefund)
+		}
+		log.Warn("Resetting non-zero statedb refund at beginning of tx", "refund", startRefund, "tx", tx.Hash())
+		statedb.SubRefund(startRefund)
+	}
+
+	if hooks.MaxComputeGasPerSender > 0 && isUserTx && b.senderComputeUsed == nil {
+		b.senderComputeUsed = make(map[common.Address]uint64)
+	}
+
+	var sender common.Address
+	var dataGas uint64 = 0
+	posterCost := new(big.Int)
+	posterCostOverflow := false
+	var txTracer *TxTracer
+	preTxHeaderGasUsed := header.GasUsed
+	signer := types.MakeSigner(chainConfig, header.Number, header.Time, arbState.ArbOSVersion())
+	if retry, ok := tx.GetInner().(*types.ArbitrumRetryTx); ok && !isUserTx {
+		if retry.ChainId == nil || retry.ChainId.Cmp(chainConfig.ChainID) != 0 {
+			return nil, nil, fmt.Errorf("%w %v: chain id %v doesn't match the chain's %v", ErrInvalidRedeem, tx.Hash(), retry.ChainId, chainConfig.ChainID)
+		}
+		if _, err := signer.Sender(tx); err != nil {
+			return nil, nil, fmt.Errorf("%w %v: failed to recover sender: %w", ErrInvalidRedeem, tx.Hash(), err)
+		}
+	}
+	receipt, result, err := (func() (*types.Receipt, *core.ExecutionResult, error) {
+		// If we've done too much work in this block, discard the tx as early as possible
+		if b.blockGasLeft < params.TxGas && isUserTx {
+			return nil, nil, core.ErrGasLimitReached
+		}
+		if isUserTx && !b.buildDeadline.IsZero() && !hooks.clock().Now().Before(b.buildDeadline) {
+			return nil, nil, ErrBlockTimeBudgetExceeded
+		}
+		if isUserTx && len(hooks.AllowedTxTypes) > 0 && !slices.Contains(hooks.AllowedTxTypes, tx.Type()) {
+			return nil, nil, fmt.Errorf("%w: %v", ErrTxTypeNotAllowed, tx.Type())
+		}
+
+		sender, err = signer.Sender(tx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Writes to statedb object should be avoided to prevent invalid state from permeating as statedb snapshot is not taken
+		if err = hooks.PreTxFilter(chainConfig, header, statedb, arbState, tx, options, sender, l1Info); err != nil {
+			return nil, nil, &TxFilterError{Stage: PreTxFilterStage, Err: err}
+		}
+
+		// Additional pre-transaction validity check
+		// Writes to statedb object should be avoided to prevent invalid state from permeating as statedb snapshot is not taken
+		if err = extraPreTxFilter(chainConfig, header, statedb, arbState, tx, options, sender, l1Info); err != nil {
+			return nil, nil, &TxFilterError{Stage: ExtraPreTxFilterStage, Err: err}
+		}
+
+		if basefee.Sign() > 0 {
+			if hooks.PosterCostFunc != nil {
+				cost, err := hooks.PosterCostFunc(tx, l1Info.poster)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to compute poster cost: %w", err)
+				}
+				posterCost.Set(cost)
+			} else {
+				brotliCompressionLevel, err := b.brotliCompressionLevel()
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to get brotli compression level: %w", err)
+				}
+				// SetBrotliCompressionLevel won't store an invalid level, so this can only be state corruption
+				if brotliCompressionLevel > arbcompress.LEVEL_WELL {
+					return nil, nil, fmt.Errorf("invalid brotli compression level %v in ArbOS state (max %v)", brotliCompressionLevel, arbcompress.LEVEL_WELL)
+				}
+				cost, _ := arbState.L1PricingState().GetPosterInfo(tx, l1Info.poster, brotliCompressionLevel)
+				posterCost.Set(cost)
+			}
+			dataGas, posterCostOverflow = PosterCostToL2Gas(posterCost, basefee)
+			if posterCostOverflow {
+				log.Error("Could not get poster cost in L2 terms", "posterCost", posterCost, "basefee", basefee)
+				posterCostOverflowCounter.Inc(1)
+			}
+		}
+
+		if dataGas > tx.Gas() {
+			// this txn is going to be rejected later
+			dataGas = tx.Gas()
+		}
+
+		computeGas := tx.Gas() - dataGas
+		if computeGas < params.TxGas {
+			if hooks.DiscardInvalidTxsEarly {
+				return nil, nil, core.ErrIntrinsicGas
+			}
+			// ensure at least TxGas is left in the pool before trying a state transition
+			computeGas = params.TxGas
+		}
+
+		// Rejecting an oversized first tx only changes which txs the sequencer includes. Replay always uses
+		// NoopSequencingHooks, which allow it, but it never sees a tx the sequencer left out.
+		if computeGas > b.blockGasLeft && isUserTx && (b.userTxsProcessed > 0 || !hooks.AllowOversizedFirstTx) {
+			return nil, nil, core.ErrGasLimitReached
+		}
+
+		if b.senderComputeUsed != nil && isUserTx {
+			// Like the block limit, a sender's first tx is always allowed so it can't get stuck
+			used := b.senderComputeUsed[sender]
+			if used > 0 && arbmath.SaturatingUAdd(used, computeGas) > hooks.MaxComputeGasPerSender {
+				return nil, nil, ErrSenderGasLimitReached
+			}
+		}
+
+		snap := statedb.Snapshot()
+		b.snapshots++
+		statedb.SetTxContext(tx.Hash(), b.txsApplied) // the number of successful state transitions
+
+		gasPool := b.gethGas
+		blockContext := core.NewEVMBlockContext(header, b.chainContext, &header.Coinbase)
+		vmConfig := b.vmConfig
+		if b.txTracerFactory != nil {
+			txTracer = b.txTracerFactory(tx)
+			if txTracer != nil {
+				vmConfig.Tracer = txTracer.Hooks
+			}
+		}
+		var evmStateDB vm.StateDB = statedb
+		if b.stateDiff != nil {
+			evmStateDB = state.NewHookedState(statedb, b.stateDiff.hooks)
+		}
+		evm := vm.NewEVM(blockContext, evmStateDB, chainConfig, vmConfig)
+		receipt, result, err := core.ApplyTransactionWithResultFilter(
+			evm,
+			&gasPool,
+			statedb,
+			header,
+			tx,
+			&header.GasUsed,
+			b.runCtx,
+			func(result *core.ExecutionResult) error {
+				if err := hooks.PostTxFilter(header, statedb, arbState, tx, sender, dataGas, result); err != nil {
+					return &TxFilterError{Stage: PostTxFilterStage, Err: err}
+				}
+				if hooks.PostTxFilterWithOptions != nil {
+					if err := hooks.PostTxFilterWithOptions(header, statedb, arbState, tx, options, sender, dataGas, result); err != nil {
+						return &TxFilterError{Stage: PostTxFilterStage, Err: err}
+					}
+				}
+				return nil
+			},
+		)
+		if err != nil {
+			// Ignore this transaction if it's invalid under the state transition function
+			statedb.RevertToSnapshot(snap)
+			b.reverts++
+			statedb.ClearTxFilter()
+			return nil, nil, err
+		}
+
+		// Additional post-transaction validity check
+		if err = extraPostTxFilter(chainConfig, header, statedb, arbState, tx, options, sender, l1Info, result); err != nil {
+			statedb.RevertToSnapshot(snap)
+			b.reverts++
+			statedb.ClearTxFilter()
+			return nil, nil, &TxFilterError{Stage: ExtraPostTxFilterStage, Err: err}
+		}
+
+		if hooks.MaxWithdrawalValuePerBlock != nil && isUserTx {
+			// Only checked here; the withdrawals are added to the block's total with the rest of the tx's accounting below
+			withdrawn := new(big.Int).Set(b.withdrawn)
+			for _, txLog := range receipt.Logs {
+				if callvalue, ok := parseWithdrawalCallvalue(txLog); ok {
+					withdrawn.Add(withdrawn, callvalue)
+				}
+			}
+			if withdrawn.Cmp(hooks.MaxWithdrawalValuePerBlock) > 0 {
+				statedb.RevertToSnapshot(snap)
+				b.reverts++
+				statedb.ClearTxFilter()
+				header.GasUsed = preTxHeaderGasUsed
+				return nil, nil, fmt.Errorf("%w: block would withdraw %v (max %v)", ErrWithdrawalCapExceeded, withdrawn, hooks.MaxWithdrawalValuePerBlock)
+			}
+		}
+
+		return receipt, result, nil
+	})()
+
+	if err != nil {
+		if !hooks.DiscardInvalidTxsEarly {
+			// we'll still deduct a TxGas's worth from the block-local rate limiter even if the tx was invalid
+			b.blockGasLeft = arbmath.SaturatingUSub(b.blockGasLeft, params.TxGas)
+			if isUserTx {
+				b.userTxsProcessed++
+			}
+		}
+		return nil, err, nil
+	}
+
+	if tx.Type() == types.ArbitrumInternalTxType {
+		// ArbOS might have upgraded to a new version, so we need to refresh our state.
+		// The ArbOS state reads everything else from the statedb as needed, so it only goes stale on an upgrade.
+		if oldVersion := b.arbState.ArbOSVersion(); arbosState.ArbOSVersion(statedb) != oldVersion {
+			b.arbState, err = arbosState.OpenSystemArbosState(statedb, nil, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			if b.onArbOSUpgrade != nil {
+				b.onArbOSUpgrade(oldVersion, b.arbState.ArbOSVersion())
+			}
+		}
+		b.brotliLevelCached = false
+		// Update the ArbOS version in the header (if it changed)
+		extraInfo := types.DeserializeHeaderExtraInformation(header)
+		extraInfo.ArbOSFormatVersion = b.arbState.ArbOSVersion()
+		extraInfo.UpdateHeaderWithInfo(header)
+	}
+
+	if tx.Type() == types.ArbitrumInternalTxType && result.Err != nil {
+		return nil, nil, fmt.Errorf("failed to apply internal transaction: %w", result.Err)
+	}
+
+	if preTxHeaderGasUsed > header.GasUsed {
+		return nil, nil, fmt.Errorf("ApplyTransaction() used -%v gas", preTxHeaderGasUsed-header.GasUsed)
+	}
+	txGasUsed := header.GasUsed - preTxHeaderGasUsed
+
+	arbosVer := types.DeserializeHeaderExtraInformation(header).ArbOSFormatVersion
+	if arbosVer >= params.ArbosVersion_FixRedeemGas {
+		// subtract gas burned for future use
+		txGasUsed, err = subtractRedeemGas(tx, result.ScheduledTxes, txGasUsed, chainConfig.DebugMode())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Update expectedTotalBalanceDelta (also done in logs loop)
+	switch txInner := tx.GetInner().(type) {
+	case *types.ArbitrumDepositTx:
+		// L1->L2 deposits add eth to the system
+		b.expectedBalanceDelta.Add(b.expectedBalanceDelta, txInner.Value)
+		b.deposited.Add(b.deposited, txInner.Value)
+	case *types.ArbitrumSubmitRetryableTx:
+		// Retryable submission can include a deposit which adds eth to the system
+		b.expectedBalanceDelta.Add(b.expectedBalanceDelta, txInner.DepositValue)
+		b.retryableDeposited.Add(b.retryableDeposited, txInner.DepositValue)
+	}
+
+	computeUsed := txGasUsed - dataGas
+	if txGasUsed < dataGas {
+		log.Error("ApplyTransaction() used less gas than it should have", "delta", dataGas-txGasUsed)
+		computeUsed = params.TxGas
+	} else if computeUsed < params.TxGas {
+		computeUsed = params.TxGas
+	}
+
+	if txGasUsed > tx.Gas() {
+		return nil, nil, fmt.Errorf("ApplyTransaction() used %v more gas than it should have", txGasUsed-tx.Gas())
+	}
+
+	for _, txLog := range receipt.Logs {
+		// L2->L1 withdrawals remove eth from the system
+		if callvalue, ok := parseWithdrawalCallvalue(txLog); ok {
+			b.expectedBalanceDelta.Sub(b.expectedBalanceDelta, callvalue)
+			b.withdrawn.Add(b.withdrawn, callvalue)
+		}
+	}
+
+	b.blockGasLeft = arbmath.SaturatingUSub(b.blockGasLeft, computeUsed)
+	if b.senderComputeUsed != nil && isUserTx {
+		b.senderComputeUsed[sender] = arbmath.SaturatingUAdd(b.senderComputeUsed[sender], computeUsed)
+	}
+
+	if isUserTx {
+		b.userTxsProcessed++
+	}
+	b.txsApplied++
+
+	for _, txLog := range receipt.Logs {
+		if txLog.Address == types.ArbOwnerAddress {
+			// The chain owner may have changed the brotli compression level
+			b.brotliLevelCached = false
+			break
+		}
+	}
+
+	applied = &AppliedTx{
+		Receipt:            receipt,
+		Result:             result,
+		Sender:             sender,
+		DataGas:            dataGas,
+		PosterCost:         posterCost,
+		PosterCostOverflow: posterCostOverflow,
+		GasUsed:            txGasUsed,
+		ComputeUsed:        computeUsed,
+		ScheduledTxes:      result.ScheduledTxes,
+	}
+	if txTracer != nil && txTracer.GetResult != nil {
+		trace := &TxTrace{TxHash: tx.Hash()}
+		trace.Result, trace.Err = txTracer.GetResult()
+		applied.Trace = trace
+	}
+	return applied, nil, nil
+}
+
+// parseWithdrawalCallvalue returns the callvalue withdrawn to L1 if txLog is one of ArbSys's L2->L1 withdrawal events.
+// L2ToL1Transaction was replaced by L2ToL1Tx in ArbOS 4, but both are handled regardless of the ArbOS version,
+// as the old event can still be found in old blocks. A new variant of the event only needs to be added here.
+func parseWithdrawalCallvalue(txLog *types.Log) (*big.Int, bool) {
+	if txLog.Address != ArbSysAddress || len(txLog.Topics) == 0 {
+		return nil, false
+	}
+	switch txLog.Topics[0] {
+	case L2ToL1TxEventID:
+		event, err := util.ParseL2ToL1TxLog(txLog)
+		if err != nil {
+			log.Error("Failed to parse L2ToL1Tx log", "err", err)
+			return nil, false
+		}
+		return event.Callvalue, true
+	case L2ToL1TransactionEventID:
+		// TODO: Remove L2ToL1Transaction handling on next chain reset
+		event, err := util.ParseL2ToL1TransactionLog(txLog)
+		if err != nil {
+			log.Error("Failed to parse L2ToL1Transaction log", "err", err)
+			return nil, false
+		}
+		return event.Callvalue, true
+	}
+	return nil, false
+}
+
+// subtractRedeemGas returns the gas tx used minus the gas of the redeems it scheduled.
+// In DebugMode, redeems with more gas than the tx used are an error rather than saturating to zero,
+// as that can only be a redeem gas accounting bug.
+func subtractRedeemGas(tx *types.Transaction, scheduledTxes types.Transactions, txGasUsed uint64, debugMode bool) (uint64, error) {
+	var redeemGas uint64
+	for _, scheduledTx := range scheduledTxes {
+		switch inner := scheduledTx.GetInner().(type) {
+		case *types.ArbitrumRetryTx:
+			redeemGas = arbmath.SaturatingUAdd(redeemGas, inner.Gas)
+		default:
+			log.Warn("Unexpected type of scheduled tx", "type", scheduledTx.Type())
+		}
+	}
+	if redeemGas > txGasUsed && debugMode {
+		return 0, fmt.Errorf("tx %v scheduled redeems with %v gas but only used %v gas", tx.Hash(), redeemGas, txGasUsed)
+	}
+	return arbmath.SaturatingUSub(txGasUsed, redeemGas), nil
+}
+
+// PosterCostToL2Gas converts a poster cost in wei into L2 gas at the given basefee.
+// If the result doesn't fit in a uint64, it returns math.MaxUint64 and true.
+// A non-positive basefee means there's no data gas to charge.
+func PosterCostToL2Gas(posterCost, basefee *big.Int) (uint64, bool) {
+	if basefee.Sign() <= 0 {
+		return 0, false
+	}
+	posterCostInL2Gas := arbmath.BigDiv(posterCost, basefee)
+	if !posterCostInL2Gas.IsUint64() {
+		return math.MaxUint64, true
+	}
+	return posterCostInL2Gas.Uint64(), false
+}
+
 // Also sets header.Root
 func FinalizeBlock(header *types.Header, txs types.Transactions, statedb vm.StateDB, chainConfig *params.ChainConfig) {
+	if err := FinalizeBlockChecked(header, txs, statedb, chainConfig); err != nil {
+		panic(err)
+	}
+}
+
+// FinalizeBlockChecked is like FinalizeBlock, but returns an error instead of panicking.
+func FinalizeBlockChecked(header *types.Header, txs types.Transactions, statedb vm.StateDB, chainConfig *params.ChainConfig) error {
+	_, err := finalizeBlock(header, statedb, chainConfig, nil)
+	return err
+}
+
+// finalizeBlock fills in the header's Arbitrum info and state root, and returns the info it used.
+// For the genesis block or a nil header, the returned send root and count are zero.
+// If arbState isn't nil, it must be up to date with statedb's ArbOS version, and is used instead of opening the state.
+func finalizeBlock(header *types.Header, statedb vm.StateDB, chainConfig *params.ChainConfig, arbState *arbosState.ArbosState) (types.HeaderInfo, error) {
+	var arbitrumHeader types.HeaderInfo
 	if header != nil {
 		if header.Number.Uint64() < chainConfig.ArbitrumChainParams.GenesisBlockNum {
-			panic("cannot finalize blocks before genesis")
+			return arbitrumHeader, errors.New("cannot finalize blocks before genesis")
 		}
 
 		var sendRoot common.Hash
@@ -520,10 +1977,13 @@ func FinalizeBlock(header *types.Header, txs types.Transactions, statedb vm.Stat
 		if header.Number.Uint64() == chainConfig.ArbitrumChainParams.GenesisBlockNum {
 			arbosVersion = chainConfig.ArbitrumChainParams.InitialArbOSVersion
 		} else {
-			state, err := arbosState.OpenSystemArbosState(statedb, nil, true)
-			if err != nil {
-				newErr := fmt.Errorf("%w while opening arbos state. Block: %d root: %v", err, header.Number, header.Root)
-				panic(newErr)
+			state := arbState
+			if state == nil {
+				var err error
+				state, err = arbosState.OpenSystemArbosState(statedb, nil, true)
+				if err != nil {
+					return arbitrumHeader, fmt.Errorf("%w while opening arbos state. Block: %d root: %v", err, header.Number, header.Root)
+				}
 			}
 			// Add outbox info to the header for client-side proving
 			acc := state.SendMerkleAccumulator()
@@ -532,7 +1992,7 @@ func FinalizeBlock(header *types.Header, txs types.Transactions, statedb vm.Stat
 			nextL1BlockNumber, _ = state.Blockhashes().L1BlockNumber()
 			arbosVersion = state.ArbOSVersion()
 		}
-		arbitrumHeader := types.HeaderInfo{
+		arbitrumHeader = types.HeaderInfo{
 			SendRoot:           sendRoot,
 			SendCount:          sendCount,
 			L1BlockNumber:      nextL1BlockNumber,
@@ -541,4 +2001,5 @@ func FinalizeBlock(header *types.Header, txs types.Transactions, statedb vm.Stat
 		arbitrumHeader.UpdateHeaderWithInfo(header)
 		header.Root = statedb.IntermediateRoot(true)
 	}
+	return arbitrumHeader, nil
 }
@@ -0,0 +1,2027 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/arbitrum_types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/tracing"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/offchainlabs/nitro/arbcompress"
+	"github.com/offchainlabs/nitro/arbos/arbosState"
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+	"github.com/offchainlabs/nitro/arbos/l1pricing"
+	"github.com/offchainlabs/nitro/arbos/l2pricing"
+	"github.com/offchainlabs/nitro/cmd/chaininfo"
+	pgen "github.com/offchainlabs/nitro/solgen/go/precompilesgen"
+	"github.com/offchainlabs/nitro/util/testhelpers"
+)
+
+func TestPosterCostToL2Gas(t *testing.T) {
+	gas, overflow := PosterCostToL2Gas(big.NewInt(1000), big.NewInt(10))
+	if overflow || gas != 100 {
+		Fail(t, "unexpected conversion", gas, overflow)
+	}
+
+	// Rounds down like the rest of the pricing code
+	gas, overflow = PosterCostToL2Gas(big.NewInt(1009), big.NewInt(10))
+	if overflow || gas != 100 {
+		Fail(t, "unexpected rounding", gas, overflow)
+	}
+
+	gas, overflow = PosterCostToL2Gas(big.NewInt(1000), big.NewInt(0))
+	if overflow || gas != 0 {
+		Fail(t, "zero basefee should produce no data gas", gas, overflow)
+	}
+
+	posterCost := new(big.Int).Lsh(big.NewInt(1), 80)
+	gas, overflow = PosterCostToL2Gas(posterCost, big.NewInt(1))
+	if !overflow || gas != math.MaxUint64 {
+		Fail(t, "expected overflow", gas, overflow)
+	}
+
+	gas, overflow = PosterCostToL2Gas(new(big.Int).SetUint64(math.MaxUint64), big.NewInt(1))
+	if overflow || gas != math.MaxUint64 {
+		Fail(t, "max uint64 shouldn't overflow", gas, overflow)
+	}
+}
+
+func TestSequencingHooksClock(t *testing.T) {
+	hooks := NoopSequencingHooks()
+	before := time.Now()
+	if hooks.clock().Now().Before(before) {
+		Fail(t, "default clock should be the system clock")
+	}
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := testhelpers.NewFakeClock(start)
+	hooks.Clock = clock
+	clock.Advance(time.Minute)
+	if !hooks.clock().Now().Equal(start.Add(time.Minute)) {
+		Fail(t, "injected clock wasn't used", hooks.clock().Now())
+	}
+}
+
+func TestTxFilterErrorUnwraps(t *testing.T) {
+	inner := errors.New("rejected")
+	var err error = &TxFilterError{Stage: PostTxFilterStage, Err: inner}
+	if !errors.Is(err, inner) {
+		Fail(t, "TxFilterError should unwrap to the filter's error")
+	}
+	var filterErr *TxFilterError
+	if !errors.As(err, &filterErr) || filterErr.Stage != PostTxFilterStage {
+		Fail(t, "expected to find the rejecting stage", err)
+	}
+}
+
+type testChainContext struct {
+	chainConfig *params.ChainConfig
+}
+
+func (c *testChainContext) Engine() consensus.Engine {
+	return Engine{}
+}
+
+func (c *testChainContext) GetHeader(common.Hash, uint64) *types.Header {
+	return nil
+}
+
+func (c *testChainContext) Config() *params.ChainConfig {
+	return c.chainConfig
+}
+
+// newBlockProductionTestState returns a fresh ArbOS state and its genesis header, ready to produce block 1
+func newBlockProductionTestState(t testing.TB) (*state.StateDB, *types.Header, core.ChainContext) {
+	t.Helper()
+	_, statedb := arbosState.NewArbosMemoryBackedArbOSState()
+	chainConfig := chaininfo.ArbitrumDevTestChainConfig()
+	genesis := arbosState.MakeGenesisBlock(common.Hash{}, 0, 0, statedb.IntermediateRoot(true), chainConfig)
+	return statedb, genesis.Header(), &testChainContext{chainConfig}
+}
+
+// produceTestBlock produces the block after lastBlockHeader, reading no delayed messages beyond those its parent read.
+// The block is produced into statedb, so hooks must not set CopyStateDB or BlockFilterWithCulprit.
+func produceTestBlock(
+	ctx context.Context,
+	l1Header *arbostypes.L1IncomingMessageHeader,
+	txes types.Transactions,
+	lastBlockHeader *types.Header,
+	statedb *state.StateDB,
+	chainContext core.ChainContext,
+	hooks *SequencingHooks,
+) (*types.Block, types.Receipts, error) {
+	block, receipts, _, err := ProduceBlockAdvanced(ctx, l1Header, txes, lastBlockHeader.Nonce.Uint64(), lastBlockHeader, statedb, chainContext, hooks, false, core.NewMessageReplayContext())
+	return block, receipts, err
+}
+
+func testL1Header(lastBlockHeader *types.Header) *arbostypes.L1IncomingMessageHeader {
+	return &arbostypes.L1IncomingMessageHeader{
+		Kind:        arbostypes.L1MessageType_L2Message,
+		Poster:      l1pricing.BatchPosterAddress,
+		BlockNumber: 1,
+		Timestamp:   lastBlockHeader.Time + 1,
+		RequestId:   nil,
+		L1BaseFee:   nil,
+	}
+}
+
+func testDepositTx(chainConfig *params.ChainConfig, to common.Address, value *big.Int) *types.Transaction {
+	return types.NewTx(&types.ArbitrumDepositTx{
+		ChainId:     chainConfig.ChainID,
+		L1RequestId: testhelpers.RandomHash(),
+		From:        testhelpers.RandomAddress(),
+		To:          to,
+		Value:       value,
+	})
+}
+
+func testTransferTx(t testing.TB, chainConfig *params.ChainConfig, key *ecdsa.PrivateKey, nonce uint64, to common.Address) *types.Transaction {
+	t.Helper()
+	tx, err := types.SignNewTx(key, types.LatestSignerForChainID(chainConfig.ChainID), &types.DynamicFeeTx{
+		ChainID:   chainConfig.ChainID,
+		Nonce:     nonce,
+		GasTipCap: big.NewInt(0),
+		GasFeeCap: big.NewInt(params.GWei),
+		Gas:       5_000_000,
+		To:        &to,
+		Value:     big.NewInt(1),
+	})
+	testhelpers.RequireImpl(t, err)
+	return tx
+}
+
+func TestBlockBuilderApplyTx(t *testing.T) {
+	statedb, genesis, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	hooks := NoopSequencingHooks()
+
+	builder, err := NewBlockBuilder(testL1Header(genesis), genesis, statedb, chainContext, core.NewMessageReplayContext())
+	Require(t, err)
+	_, txErr, err := builder.ApplyTx(builder.StartBlockTx(), hooks, nil, false)
+	Require(t, err)
+	Require(t, txErr)
+
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	to := testhelpers.RandomAddress()
+
+	// The sender isn't funded yet, so the transfer is rejected without touching the state
+	rootBefore := statedb.IntermediateRoot(true)
+	applied, txErr, err := builder.ApplyTx(testTransferTx(t, chainConfig, key, 0, to), hooks, nil, true)
+	Require(t, err)
+	if txErr == nil || applied != nil {
+		Fail(t, "expected unfunded transfer to be rejected")
+	}
+	if statedb.IntermediateRoot(true) != rootBefore {
+		Fail(t, "rejected tx modified the state")
+	}
+
+	deposit := big.NewInt(params.Ether)
+	_, txErr, err = builder.ApplyTx(testDepositTx(chainConfig, from, deposit), hooks, nil, true)
+	Require(t, err)
+	Require(t, txErr)
+	if builder.ExpectedBalanceDelta().Cmp(deposit) != 0 {
+		Fail(t, "deposit not reflected in expected balance delta", builder.ExpectedBalanceDelta())
+	}
+
+	gasUsedBefore := builder.Header().GasUsed
+	applied, txErr, err = builder.ApplyTx(testTransferTx(t, chainConfig, key, 0, to), hooks, nil, true)
+	Require(t, err)
+	Require(t, txErr)
+	if applied.Sender != from {
+		Fail(t, "unexpected sender", applied.Sender)
+	}
+	if applied.Receipt.GasUsed != builder.Header().GasUsed-gasUsedBefore {
+		Fail(t, "receipt gas doesn't match header gas", applied.Receipt.GasUsed, builder.Header().GasUsed-gasUsedBefore)
+	}
+	if applied.DataGas == 0 || applied.ComputeUsed < params.TxGas {
+		Fail(t, "unexpected gas breakdown", applied.DataGas, applied.ComputeUsed)
+	}
+	if statedb.GetRefund() != 0 {
+		Fail(t, "refund leaked out of the tx", statedb.GetRefund())
+	}
+}
+
+func TestInvalidRedeem(t *testing.T) {
+	statedb, genesis, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	builder, err := NewBlockBuilder(testL1Header(genesis), genesis, statedb, chainContext, core.NewMessageReplayContext())
+	Require(t, err)
+	_, txErr, err := builder.ApplyTx(builder.StartBlockTx(), NoopSequencingHooks(), nil, false)
+	Require(t, err)
+	Require(t, txErr)
+
+	to := testhelpers.RandomAddress()
+	redeem := types.NewTx(&types.ArbitrumRetryTx{
+		ChainId:             new(big.Int).Add(chainConfig.ChainID, common.Big1),
+		From:                testhelpers.RandomAddress(),
+		GasFeeCap:           big.NewInt(params.GWei),
+		Gas:                 100_000,
+		To:                  &to,
+		Value:               common.Big0,
+		TicketId:            testhelpers.RandomHash(),
+		RefundTo:            testhelpers.RandomAddress(),
+		MaxRefund:           common.Big0,
+		SubmissionFeeRefund: common.Big0,
+	})
+	_, _, err = builder.ApplyTx(redeem, NoopSequencingHooks(), nil, false)
+	if !errors.Is(err, ErrInvalidRedeem) {
+		Fail(t, "expected a corrupted redeem to fail block production, got", err)
+	}
+}
+
+func TestBlockProductionInputChecks(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	l1Header := testL1Header(lastBlockHeader)
+	// produceTestBlock can't be used, as it reads the delayed message count from the parent header, which may be nil here
+	delayedMessagesRead := lastBlockHeader.Nonce.Uint64()
+	produce := func(lastBlockHeader *types.Header, statedb *state.StateDB, chainContext core.ChainContext) error {
+		_, _, _, err := ProduceBlockAdvanced(context.Background(), l1Header, nil, delayedMessagesRead, lastBlockHeader, statedb, chainContext, NoopSequencingHooks(), false, core.NewMessageReplayContext())
+		return err
+	}
+	if err := produce(lastBlockHeader, statedb, &testChainContext{}); !errors.Is(err, ErrNilChainConfig) {
+		Fail(t, "expected a nil chain config to be rejected, got", err)
+	}
+	if err := produce(lastBlockHeader, nil, chainContext); err == nil {
+		Fail(t, "expected a nil statedb to be rejected")
+	}
+	if err := produce(nil, statedb, chainContext); err == nil {
+		Fail(t, "expected a missing parent header to be rejected")
+	}
+	if _, err := NewBlockBuilder(l1Header, lastBlockHeader, statedb, &testChainContext{}, core.NewMessageReplayContext()); !errors.Is(err, ErrNilChainConfig) {
+		Fail(t, "expected NewBlockBuilder to reject a nil chain config, got", err)
+	}
+	Require(t, produce(lastBlockHeader, statedb, chainContext))
+}
+
+func TestEmptyBlockResult(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	hooks := NoopSequencingHooks()
+	_, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if !hooks.Result.EmptyBlock {
+		Fail(t, "expected a block with only the internal tx to be flagged as empty")
+	}
+	if hooks.Result.UserGasUsed != 0 || hooks.Result.RedeemGasUsed != 0 {
+		Fail(t, "expected an empty block to have no user or redeem gas", hooks.Result.UserGasUsed, hooks.Result.RedeemGasUsed)
+	}
+}
+
+func TestEncodeBlockRLP(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	hooks := NoopSequencingHooks()
+	hooks.EncodeBlockRLP = true
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	var decoded types.Block
+	Require(t, rlp.DecodeBytes(hooks.Result.BlockRLP, &decoded))
+	if decoded.Hash() != block.Hash() {
+		Fail(t, "decoded block hash", decoded.Hash(), "doesn't match produced block hash", block.Hash())
+	}
+}
+
+func TestOnBlockFinalized(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	hooks := NoopSequencingHooks()
+	var finalized []*types.Header
+	var sendRoots []common.Hash
+	var sendCounts []uint64
+	hooks.OnBlockFinalized = func(header *types.Header, sendRoot common.Hash, sendCount uint64) {
+		finalized = append(finalized, header)
+		sendRoots = append(sendRoots, sendRoot)
+		sendCounts = append(sendCounts, sendCount)
+	}
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if len(finalized) != 1 {
+		Fail(t, "expected the hook to be called once, got", len(finalized))
+	}
+	if finalized[0].Hash() != block.Hash() {
+		Fail(t, "hook got header", finalized[0].Hash(), "instead of", block.Hash())
+	}
+	info := types.DeserializeHeaderExtraInformation(block.Header())
+	if sendRoots[0] != info.SendRoot || sendCounts[0] != info.SendCount {
+		Fail(t, "hook got send root", sendRoots[0], "and count", sendCounts[0], "but header has", info.SendRoot, info.SendCount)
+	}
+}
+
+func TestProgressCallback(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	txes := types.Transactions{
+		testDepositTx(chainConfig, testhelpers.RandomAddress(), big.NewInt(params.Ether)),
+		testDepositTx(chainConfig, testhelpers.RandomAddress(), big.NewInt(params.Ether)),
+	}
+	hooks := NoopSequencingHooks()
+	var gasUsed []uint64
+	var receiptCounts []int
+	hooks.ProgressCallback = func(header *types.Header, receiptsSoFar types.Receipts) {
+		gasUsed = append(gasUsed, header.GasUsed)
+		receiptCounts = append(receiptCounts, len(receiptsSoFar))
+		// Modifying the copy mustn't affect the block being built
+		header.GasUsed = math.MaxUint64
+	}
+	block, receipts, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+
+	// Called for the start block tx and each deposit
+	if len(receiptCounts) != len(block.Transactions()) {
+		Fail(t, "expected a call per block tx, got", len(receiptCounts))
+	}
+	for i, count := range receiptCounts {
+		if count != i+1 {
+			Fail(t, "call", i, "got", count, "receipts")
+		}
+		if gasUsed[i] != receipts[i].CumulativeGasUsed {
+			Fail(t, "call", i, "got gas used", gasUsed[i], "instead of", receipts[i].CumulativeGasUsed)
+		}
+	}
+	if block.GasUsed() != receipts[len(receipts)-1].CumulativeGasUsed {
+		Fail(t, "callback modified the block's gas used", block.GasUsed())
+	}
+}
+
+func TestPostTxFilterWithOptions(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	rejected := testhelpers.RandomAddress()
+	accepted := testhelpers.RandomAddress()
+	txes := types.Transactions{
+		testDepositTx(chainConfig, rejected, big.NewInt(params.Ether)),
+		testDepositTx(chainConfig, accepted, big.NewInt(params.Ether)),
+	}
+	maxBalance := big.NewInt(params.Ether / 2)
+	hooks := NoopSequencingHooks()
+	// Only the first tx has options, which cap its recipient's balance after execution
+	hooks.ConditionalOptionsForTx = []*arbitrum_types.ConditionalOptions{{}, nil}
+	var seenOptions []*arbitrum_types.ConditionalOptions
+	hooks.PostTxFilterWithOptions = func(_ *types.Header, statedb *state.StateDB, _ *arbosState.ArbosState, tx *types.Transaction, options *arbitrum_types.ConditionalOptions, _ common.Address, _ uint64, _ *core.ExecutionResult) error {
+		seenOptions = append(seenOptions, options)
+		if options != nil && statedb.GetBalance(*tx.To()).ToBig().Cmp(maxBalance) > 0 {
+			return errors.New("balance too high after execution")
+		}
+		return nil
+	}
+	_, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+
+	// Internal txs aren't filtered, so the filter only sees the user txs
+	if len(seenOptions) != 2 || seenOptions[0] == nil || seenOptions[1] != nil {
+		Fail(t, "filter got unexpected options", seenOptions)
+	}
+	var filterErr *TxFilterError
+	if !errors.As(hooks.TxErrors[0], &filterErr) || filterErr.Stage != PostTxFilterStage {
+		Fail(t, "expected the first tx to be rejected by the post tx filter, got", hooks.TxErrors[0])
+	}
+	Require(t, hooks.TxErrors[1])
+	if statedb.GetBalance(rejected).Sign() != 0 || statedb.GetBalance(accepted).Sign() == 0 {
+		Fail(t, "rejected tx wasn't reverted")
+	}
+}
+
+func TestOnArbOSUpgrade(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	state, err := arbosState.OpenSystemArbosState(statedb, nil, false)
+	Require(t, err)
+	oldVersion := state.ArbOSVersion()
+	newVersion := oldVersion + 1
+	Require(t, state.ScheduleArbOSUpgrade(newVersion, 0))
+
+	var upgrades [][2]uint64
+	hooks := NoopSequencingHooks()
+	hooks.OnArbOSUpgrade = func(oldVersion, newVersion uint64) {
+		upgrades = append(upgrades, [2]uint64{oldVersion, newVersion})
+	}
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if len(upgrades) != 1 || upgrades[0] != [2]uint64{oldVersion, newVersion} {
+		Fail(t, "expected an upgrade from", oldVersion, "to", newVersion, "got", upgrades)
+	}
+	if version := types.DeserializeHeaderExtraInformation(block.Header()).ArbOSFormatVersion; version != newVersion {
+		Fail(t, "block has ArbOS version", version, "instead of", newVersion)
+	}
+
+	// The next block doesn't upgrade again
+	upgrades = nil
+	_, _, err = produceTestBlock(context.Background(), testL1Header(block.Header()), nil, block.Header(), statedb, chainContext, hooks)
+	Require(t, err)
+	if len(upgrades) != 0 {
+		Fail(t, "unexpected upgrades", upgrades)
+	}
+}
+
+func TestSkipStartBlockTx(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	deposit := testDepositTx(chainConfig, testhelpers.RandomAddress(), big.NewInt(params.Ether))
+	hooks := NoopSequencingHooks()
+	hooks.SkipStartBlockTx = true
+	block, receipts, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), types.Transactions{deposit}, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if len(block.Transactions()) != 1 || block.Transactions()[0].Hash() != deposit.Hash() || len(receipts) != 1 {
+		Fail(t, "expected the block to only contain the deposit, got", len(block.Transactions()), "txs")
+	}
+
+	// Chains that aren't in debug mode must always apply the start block tx
+	nonDebugConfig := *chainConfig
+	nonDebugConfig.ArbitrumChainParams.AllowDebugPrecompiles = false
+	statedb, lastBlockHeader, _ = newBlockProductionTestState(t)
+	hooks = NoopSequencingHooks()
+	hooks.SkipStartBlockTx = true
+	_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, &testChainContext{&nonDebugConfig}, hooks)
+	if err == nil {
+		Fail(t, "expected skipping the start block tx to fail outside of debug mode")
+	}
+}
+
+func TestAllowedTxTypes(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	txes := types.Transactions{
+		testDepositTx(chainConfig, from, big.NewInt(params.Ether)),
+		testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+	}
+
+	hooks := NoopSequencingHooks()
+	hooks.AllowedTxTypes = []byte{types.ArbitrumDepositTxType}
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if len(hooks.TxErrors) != 2 || hooks.TxErrors[0] != nil || !errors.Is(hooks.TxErrors[1], ErrTxTypeNotAllowed) {
+		Fail(t, "expected only the transfer to be rejected for its type, got", hooks.TxErrors)
+	}
+	// The start block tx isn't filtered, even though its type isn't allowed
+	if len(block.Transactions()) != 2 || block.Transactions()[0].Type() != types.ArbitrumInternalTxType {
+		Fail(t, "expected the block to contain the start block tx and the deposit, got", len(block.Transactions()), "txs")
+	}
+	if statedb.GetNonce(from) != 0 {
+		Fail(t, "disallowed tx was executed")
+	}
+
+	statedb, lastBlockHeader, chainContext = newBlockProductionTestState(t)
+	hooks = NoopSequencingHooks()
+	hooks.AllowedTxTypes = []byte{types.ArbitrumDepositTxType, types.DynamicFeeTxType}
+	_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	for i, txErr := range hooks.TxErrors {
+		if txErr != nil {
+			Fail(t, "allowed tx", i, "was rejected:", txErr)
+		}
+	}
+}
+
+func TestInjectFailure(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	hooks := NoopSequencingHooks()
+	hooks.InjectFailure = &FailureInjection{DuringFinalization: true}
+	_, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, hooks)
+	if !errors.Is(err, ErrInjectedFailure) {
+		Fail(t, "expected an injected failure, got", err)
+	}
+	var finalizeErr *FinalizeBlockError
+	if !errors.As(err, &finalizeErr) || len(finalizeErr.Txs) != 1 || len(finalizeErr.Receipts) != 1 {
+		Fail(t, "expected the failure to include the partial block, got", err)
+	}
+
+	statedb, lastBlockHeader, chainContext = newBlockProductionTestState(t)
+	hooks = NoopSequencingHooks()
+	hooks.InjectFailure = &FailureInjection{AfterTxs: 1}
+	_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, hooks)
+	if !errors.Is(err, ErrInjectedFailure) {
+		Fail(t, "expected an injected failure after the start block tx, got", err)
+	}
+}
+
+func TestRecordTxOrder(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	hooks := NoopSequencingHooks()
+	hooks.RecordTxOrder = true
+	deposit := testDepositTx(chainContext.Config(), common.HexToAddress("0x1234"), big.NewInt(1))
+	_, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), types.Transactions{deposit}, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	order := hooks.Result.TxOrder
+	if len(order) != 2 || order[0].Kind != ProcessedInternalTx || order[1].Kind != ProcessedUserTx || order[1].TxHash != deposit.Hash() || !order[1].Applied {
+		Fail(t, "unexpected tx order", order)
+	}
+}
+
+func TestRequireNonZeroPoster(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	hooks := NoopSequencingHooks()
+	hooks.RequireNonZeroPoster = true
+	l1Header := testL1Header(lastBlockHeader)
+	l1Header.Poster = common.Address{}
+	_, _, err := produceTestBlock(context.Background(), l1Header, nil, lastBlockHeader, statedb, chainContext, hooks)
+	if !errors.Is(err, ErrZeroPoster) {
+		Fail(t, "expected a zero poster error, got", err)
+	}
+}
+
+func TestDelayedMessagesReadMonotonic(t *testing.T) {
+	// The genesis block reads the init message, so block 1 must read at least that
+	for _, c := range []struct {
+		next      uint64
+		decreased bool
+	}{
+		{next: 1},
+		{next: 2},
+		{next: 0, decreased: true},
+	} {
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+		previous := lastBlockHeader.Nonce.Uint64()
+		block, _, _, err := ProduceBlockAdvanced(context.Background(), testL1Header(lastBlockHeader), nil, c.next, lastBlockHeader, statedb, chainContext, NoopSequencingHooks(), false, core.NewMessageReplayContext())
+		if c.decreased {
+			if !errors.Is(err, ErrDelayedMessagesReadDecreased) {
+				Fail(t, "expected an error going from", previous, "to", c.next, "delayed messages read, got", err)
+			}
+			continue
+		}
+		Require(t, err)
+		if block.Nonce() != c.next {
+			Fail(t, "expected block nonce", c.next, "got", block.Nonce())
+		}
+	}
+}
+
+func TestAdjustGasLimit(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	txes := types.Transactions{
+		testDepositTx(chainConfig, from, big.NewInt(params.Ether)),
+		testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+	}
+
+	// The transfer's gas is above the adjusted limit, so it can't fit in the geth gas pool
+	const gasLimit = 1_000_000
+	hooks := NoopSequencingHooks()
+	hooks.AdjustGasLimit = func(*types.Header, *types.Header) uint64 { return gasLimit }
+	hooks.RecordTxOutcomes = true
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if block.GasLimit() != gasLimit || hooks.Result.GethBlockGasLimit != gasLimit {
+		Fail(t, "unexpected gas limit", block.GasLimit(), hooks.Result.GethBlockGasLimit)
+	}
+	if len(hooks.TxErrors) != 2 || hooks.TxErrors[0] != nil || !errors.Is(hooks.TxErrors[1], core.ErrGasLimitReached) {
+		Fail(t, "expected only the transfer to be rejected for exceeding the gas limit, got", hooks.TxErrors)
+	}
+	outcomes := hooks.Result.TxOutcomes
+	if len(outcomes) != 2 || outcomes[0] != TxIncluded || outcomes[1] != TxDroppedGasLimit {
+		Fail(t, "unexpected tx outcomes", outcomes)
+	}
+}
+
+func TestBindingGasLimit(t *testing.T) {
+	for _, gethLimitBinds := range []bool{true, false} {
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+		chainConfig := chainContext.Config()
+		var txes types.Transactions
+		for i := 0; i < 2; i++ {
+			key, err := crypto.GenerateKey()
+			Require(t, err)
+			txes = append(txes,
+				testDepositTx(chainConfig, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether)),
+				testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+			)
+		}
+
+		hooks := NoopSequencingHooks()
+		var dropped []error
+		if gethLimitBinds {
+			// Each transfer's gas is above the geth gas limit, so neither fits in the geth gas pool
+			hooks.AdjustGasLimit = func(*types.Header, *types.Header) uint64 { return 1_000_000 }
+			dropped = []error{nil, core.ErrGasLimitReached, nil, core.ErrGasLimitReached}
+		} else {
+			// Without L1 data gas each transfer's compute gas is its full gas limit, so the first transfer fits,
+			// but the gas it then uses leaves too little of the limit for the second
+			arbState, err := arbosState.OpenSystemArbosState(statedb, nil, false)
+			Require(t, err)
+			Require(t, arbState.L1PricingState().SetPricePerUnit(common.Big0))
+			Require(t, arbState.L2PricingState().SetMaxPerBlockGasLimit(txes[1].Gas()+10_000))
+			dropped = []error{nil, nil, nil, core.ErrGasLimitReached}
+		}
+		block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+		Require(t, err)
+		for i, expected := range dropped {
+			if !errors.Is(hooks.TxErrors[i], expected) {
+				Fail(t, "geth limit binds:", gethLimitBinds, "tx", i, "has error", hooks.TxErrors[i], "instead of", expected)
+			}
+		}
+
+		result := hooks.Result
+		if result.GethGasLeft != block.GasLimit()-block.GasUsed() {
+			Fail(t, "geth gas left", result.GethGasLeft, "doesn't match the block's", block.GasLimit()-block.GasUsed())
+		}
+		// Only the binding limit is too low for the last transfer
+		lastGas := txes[3].Gas()
+		if gethLimitBinds && (result.GethGasLeft >= lastGas || result.PerBlockGasLeft < lastGas) {
+			Fail(t, "expected only the geth gas limit to bind, gas left is", result.GethGasLeft, "geth and", result.PerBlockGasLeft, "per-block")
+		}
+		if !gethLimitBinds && (result.PerBlockGasLeft >= lastGas || result.GethGasLeft < lastGas) {
+			Fail(t, "expected only the per-block gas limit to bind, gas left is", result.GethGasLeft, "geth and", result.PerBlockGasLeft, "per-block")
+		}
+		// Without L1 data gas, each of the start block tx, deposits, and first transfer uses TxGas of compute gas,
+		// and the dropped transfer is charged TxGas too
+		if expected := txes[1].Gas() + 10_000 - 5*params.TxGas; !gethLimitBinds && result.PerBlockGasLeft != expected {
+			Fail(t, "per-block gas left", result.PerBlockGasLeft, "instead of", expected)
+		}
+	}
+}
+
+func TestCreateNewHeaderGasLimit(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	arbState, err := arbosState.OpenSystemArbosState(statedb, nil, true)
+	Require(t, err)
+	l1Info := &L1Info{poster: l1pricing.BatchPosterAddress, l1BlockNumber: 1, l1Timestamp: lastBlockHeader.Time + 1}
+
+	header := createNewHeader(lastBlockHeader, l1Info, arbState, chainContext.Config(), 0)
+	if header.GasLimit != l2pricing.GethBlockGasLimit {
+		Fail(t, "expected the default gas limit", l2pricing.GethBlockGasLimit, "got", header.GasLimit)
+	}
+
+	// A geth gas limit below the ArbOS per-block gas limit
+	perBlockGasLimit, err := arbState.L2PricingState().PerBlockGasLimit()
+	Require(t, err)
+	header = createNewHeader(lastBlockHeader, l1Info, arbState, chainContext.Config(), perBlockGasLimit/2)
+	if header.GasLimit != perBlockGasLimit/2 {
+		Fail(t, "expected gas limit", perBlockGasLimit/2, "got", header.GasLimit)
+	}
+}
+
+func TestBuildNextHeader(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	l1Header := testL1Header(lastBlockHeader)
+	l1Info := NewL1Info(l1Header.Poster, l1Header.BlockNumber, l1Header.Timestamp)
+	header, err := BuildNextHeader(lastBlockHeader, l1Info, statedb, chainContext.Config())
+	Require(t, err)
+
+	block, _, err := produceTestBlock(context.Background(), l1Header, types.Transactions{}, lastBlockHeader, statedb, chainContext, NoopSequencingHooks())
+	Require(t, err)
+	if header.Number.Cmp(block.Number()) != 0 || header.Time != block.Time() || header.ParentHash != block.ParentHash() {
+		Fail(t, "previewed header", header.Number, header.Time, header.ParentHash, "doesn't match the block", block.Number(), block.Time(), block.ParentHash())
+	}
+	if header.BaseFee.Cmp(block.BaseFee()) != 0 {
+		Fail(t, "previewed basefee", header.BaseFee, "instead of", block.BaseFee())
+	}
+	if header.Coinbase != block.Coinbase() {
+		Fail(t, "previewed coinbase", header.Coinbase, "instead of", block.Coinbase())
+	}
+}
+
+func TestTxOutcomeFromError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected TxOutcome
+	}{
+		{nil, TxIncluded},
+		{ErrSenderGasLimitReached, TxDeferred},
+		{core.ErrGasLimitReached, TxDroppedGasLimit},
+		{&TxFilterError{Stage: ExtraPreTxFilterStage, Err: errors.New("filtered")}, TxDroppedPreFilter},
+		{&TxFilterError{Stage: PostTxFilterStage, Err: errors.New("filtered")}, TxDroppedPostFilter},
+		{&BlockFilterCulpritError{Err: errors.New("too big")}, TxDroppedBlockFilter},
+		{core.ErrNonceTooLow, TxDroppedInvalid},
+	}
+	for _, c := range cases {
+		if outcome := TxOutcomeFromError(c.err); outcome != c.expected {
+			Fail(t, "expected", c.expected, "for error", c.err, "got", outcome)
+		}
+	}
+}
+
+func TestDropReasonFromError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected DropReason
+	}{
+		{core.ErrIntrinsicGas, DropReasonIntrinsicGas},
+		{core.ErrGasLimitReached, DropReasonGasLimitReached},
+		{&TxFilterError{Stage: ExtraPreTxFilterStage, Err: errors.New("filtered")}, DropReasonPreTxFilter},
+		{&TxFilterError{Stage: PostTxFilterStage, Err: errors.New("filtered")}, DropReasonPostTxFilter},
+		{&BlockFilterCulpritError{Err: errors.New("too big")}, DropReasonBlockFilter},
+		{types.ErrInvalidSig, DropReasonInvalidSignature},
+		{fmt.Errorf("%w: address 0x1, tx: 1 state: 2", core.ErrNonceTooLow), DropReasonNonce},
+		{core.ErrInsufficientFunds, DropReasonInsufficientFunds},
+		{errors.New("something else"), DropReasonOther},
+	}
+	for _, c := range cases {
+		reason, dropped := DropReasonFromError(c.err)
+		if !dropped || reason != c.expected {
+			Fail(t, "expected", c.expected, "for error", c.err, "got", reason, dropped)
+		}
+	}
+	for _, err := range []error{nil, ErrSenderGasLimitReached, ErrBlockTimeBudgetExceeded} {
+		if _, dropped := DropReasonFromError(err); dropped {
+			Fail(t, "expected", err, "not to count as a dropped tx")
+		}
+	}
+}
+
+func TestCountDropReasons(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	txes := types.Transactions{
+		testDepositTx(chainConfig, from, big.NewInt(params.Ether)),
+		testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+		// Replays the same nonce
+		testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+		testTransferTx(t, chainConfig, key, 5, testhelpers.RandomAddress()),
+	}
+
+	hooks := NoopSequencingHooks()
+	hooks.CountDropReasons = true
+	_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	counts := hooks.Result.DropCounts
+	if len(counts) != 1 || counts[DropReasonNonce] != 2 {
+		Fail(t, "expected two txs dropped for their nonce, got", counts)
+	}
+}
+
+func TestProduceBlockCanceled(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := produceTestBlock(ctx, testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, NoopSequencingHooks())
+	if !errors.Is(err, ErrBlockProductionCanceled) || !errors.Is(err, context.Canceled) {
+		Fail(t, "expected block production to be canceled, got", err)
+	}
+	// Nothing was applied before the cancellation was noticed, so the state is still usable
+	if root := statedb.IntermediateRoot(true); root != lastBlockHeader.Root {
+		Fail(t, "state root changed from", lastBlockHeader.Root, "to", root)
+	}
+
+	// With CopyStateDB, a block canceled midway leaves the statedb untouched
+	chainConfig := chainContext.Config()
+	to := testhelpers.RandomAddress()
+	txes := types.Transactions{
+		testDepositTx(chainConfig, to, big.NewInt(params.Ether)),
+		testDepositTx(chainConfig, to, big.NewInt(params.Ether)),
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	hooks := NoopSequencingHooks()
+	hooks.CopyStateDB = true
+	hooks.PostTxFilter = func(*types.Header, *state.StateDB, *arbosState.ArbosState, *types.Transaction, common.Address, uint64, *core.ExecutionResult) error {
+		cancel()
+		return nil
+	}
+	_, _, _, err = ProduceBlockAdvanced(ctx, testL1Header(lastBlockHeader), txes, lastBlockHeader.Nonce.Uint64(), lastBlockHeader, statedb, chainContext, hooks, false, core.NewMessageReplayContext())
+	if !errors.Is(err, ErrBlockProductionCanceled) {
+		Fail(t, "expected block production to be canceled, got", err)
+	}
+	if len(hooks.TxErrors) != 1 {
+		Fail(t, "expected production to stop after the first deposit, got", len(hooks.TxErrors), "tx results")
+	}
+	if balance := statedb.GetBalance(to); !balance.IsZero() {
+		Fail(t, "canceled block's deposit was applied to the statedb", balance)
+	}
+
+	// So it can be used to produce the block again
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, NoopSequencingHooks())
+	Require(t, err)
+	if root := statedb.IntermediateRoot(true); root != block.Root() {
+		Fail(t, "reused statedb has root", root, "instead of the block's", block.Root())
+	}
+}
+
+func TestGasBreakdown(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	txes := types.Transactions{
+		testDepositTx(chainConfig, from, big.NewInt(params.Ether)),
+		testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+		testTransferTx(t, chainConfig, key, 1, testhelpers.RandomAddress()),
+	}
+
+	hooks := NoopSequencingHooks()
+	hooks.RecordGasBreakdown = true
+	block, receipts, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	breakdown := hooks.Result.GasBreakdown
+	if len(breakdown) != len(block.Transactions()) {
+		Fail(t, "expected a gas breakdown for each of the", len(block.Transactions()), "txs, got", len(breakdown))
+	}
+	var dataGas, posterGas uint64
+	for i, tx := range block.Transactions() {
+		if breakdown[i].TxHash != tx.Hash() {
+			Fail(t, "gas breakdown", i, "is for tx", breakdown[i].TxHash, "instead of", tx.Hash())
+		}
+		if breakdown[i].TotalGas != receipts[i].GasUsed {
+			Fail(t, "tx", i, "total gas", breakdown[i].TotalGas, "doesn't match receipt gas used", receipts[i].GasUsed)
+		}
+		if tx.Type() == types.DynamicFeeTxType {
+			dataGas += breakdown[i].DataGas
+			posterGas += receipts[i].GasUsedForL1
+		}
+	}
+	if dataGas == 0 || dataGas != posterGas {
+		Fail(t, "expected the transfers' data gas", dataGas, "to match their poster gas", posterGas)
+	}
+}
+
+func TestBlockFilterWithCulprit(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	blockedKey, err := crypto.GenerateKey()
+	Require(t, err)
+	otherKey, err := crypto.GenerateKey()
+	Require(t, err)
+	blocked := testhelpers.RandomAddress()
+	recipient := testhelpers.RandomAddress()
+	txes := types.Transactions{
+		testDepositTx(chainConfig, crypto.PubkeyToAddress(blockedKey.PublicKey), big.NewInt(params.Ether)),
+		testDepositTx(chainConfig, crypto.PubkeyToAddress(otherKey.PublicKey), big.NewInt(params.Ether)),
+		testTransferTx(t, chainConfig, blockedKey, 0, blocked),
+		testTransferTx(t, chainConfig, otherKey, 0, recipient),
+	}
+
+	hooks := NoopSequencingHooks()
+	hooks.RecordTxOutcomes = true
+	attempts := 0
+	hooks.BlockFilterWithCulprit = func(_ *types.Header, _ *state.StateDB, txes types.Transactions, _ types.Receipts) (int, error) {
+		attempts++
+		for i, tx := range txes {
+			if tx.To() != nil && *tx.To() == blocked {
+				return i, errors.New("blocked recipient")
+			}
+		}
+		return -1, nil
+	}
+	preRoot := statedb.IntermediateRoot(true)
+	block, _, produced, err := ProduceBlockAdvanced(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader.Nonce.Uint64(), lastBlockHeader, statedb, chainContext, hooks, false, core.NewMessageReplayContext())
+	Require(t, err)
+	if attempts != 2 {
+		Fail(t, "expected the filter to run twice, got", attempts)
+	}
+	if len(block.Transactions()) != 4 {
+		Fail(t, "expected the start block tx, deposits, and unblocked transfer in the block, got", len(block.Transactions()))
+	}
+	var culpritErr *BlockFilterCulpritError
+	if len(hooks.TxErrors) != len(txes) || !errors.As(hooks.TxErrors[2], &culpritErr) || culpritErr.TxHash != txes[2].Hash() {
+		Fail(t, "expected only the blocked transfer to be dropped, got", hooks.TxErrors)
+	}
+	for _, i := range []int{0, 1, 3} {
+		if hooks.TxErrors[i] != nil {
+			Fail(t, "tx", i, "unexpectedly failed:", hooks.TxErrors[i])
+		}
+	}
+	if outcomes := hooks.Result.TxOutcomes; len(outcomes) != len(txes) || outcomes[2] != TxDroppedBlockFilter || outcomes[3] != TxIncluded {
+		Fail(t, "unexpected tx outcomes", outcomes)
+	}
+	if produced.GetBalance(blocked).Sign() != 0 || produced.GetBalance(recipient).IsZero() {
+		Fail(t, "expected only the unblocked transfer to be applied to the produced state")
+	}
+	// Committing the returned statedb, as callers do, must persist exactly the block's state
+	root, err := produced.Commit(block.NumberU64(), true, false)
+	Require(t, err)
+	if root != block.Root() {
+		Fail(t, "committed state root", root, "doesn't match the block's state root", block.Root())
+	}
+	// None of the attempts touched the statedb that was passed in
+	if root := statedb.IntermediateRoot(true); root != preRoot {
+		Fail(t, "passed in statedb changed from", preRoot, "to", root)
+	}
+}
+
+func TestVMConfigTracer(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	txes := types.Transactions{
+		testDepositTx(chainConfig, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether)),
+		testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+	}
+
+	var traced []common.Hash
+	hooks := NoopSequencingHooks()
+	hooks.VMConfig.Tracer = &tracing.Hooks{
+		OnTxStart: func(_ *tracing.VMContext, tx *types.Transaction, _ common.Address) {
+			traced = append(traced, tx.Hash())
+		},
+	}
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if len(traced) != len(block.Transactions()) {
+		Fail(t, "expected the tracer to see all", len(block.Transactions()), "txs, got", len(traced))
+	}
+	for i, tx := range block.Transactions() {
+		if traced[i] != tx.Hash() {
+			Fail(t, "tracer saw tx", traced[i], "instead of", tx.Hash())
+		}
+	}
+
+	// Tracing mustn't change the block
+	statedb, lastBlockHeader, chainContext = newBlockProductionTestState(t)
+	untraced, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, NoopSequencingHooks())
+	Require(t, err)
+	if untraced.Hash() != block.Hash() {
+		Fail(t, "traced block", block.Hash(), "doesn't match untraced block", untraced.Hash())
+	}
+}
+
+func TestTxTracerFactory(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	transfer := testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress())
+	txes := types.Transactions{
+		testDepositTx(chainConfig, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether)),
+		transfer,
+	}
+
+	hooks := NoopSequencingHooks()
+	hooks.TxTracerFactory = func(tx *types.Transaction) *TxTracer {
+		if tx.Type() == types.ArbitrumInternalTxType {
+			return nil
+		}
+		var gasUsed uint64
+		return &TxTracer{
+			Hooks: &tracing.Hooks{
+				OnTxEnd: func(receipt *types.Receipt, _ error) {
+					if receipt != nil {
+						gasUsed = receipt.GasUsed
+					}
+				},
+			},
+			GetResult: func() (json.RawMessage, error) {
+				return json.Marshal(gasUsed)
+			},
+		}
+	}
+	block, receipts, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	traces := hooks.Result.TxTraces
+	// The start block tx wasn't traced
+	if len(traces) != len(block.Transactions())-1 {
+		Fail(t, "expected a trace for each user tx, got", len(traces))
+	}
+	for i, trace := range traces {
+		tx := block.Transactions()[i+1]
+		Require(t, trace.Err)
+		if trace.TxHash != tx.Hash() {
+			Fail(t, "trace", i, "is for tx", trace.TxHash, "instead of", tx.Hash())
+		}
+		var gasUsed uint64
+		Require(t, json.Unmarshal(trace.Result, &gasUsed))
+		if gasUsed != receipts[i+1].GasUsed {
+			Fail(t, "trace of tx", tx.Hash(), "has gas used", gasUsed, "but receipt has", receipts[i+1].GasUsed)
+		}
+	}
+}
+
+func TestBalanceDeltaBreakdown(t *testing.T) {
+	produce := func(burn bool) (*BalanceDeltaBreakdown, error) {
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+		chainConfig := chainContext.Config()
+		key, err := crypto.GenerateKey()
+		Require(t, err)
+		from := crypto.PubkeyToAddress(key.PublicKey)
+		retryTo := testhelpers.RandomAddress()
+		transfer := testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress())
+		txes := types.Transactions{
+			testDepositTx(chainConfig, from, big.NewInt(params.Ether)),
+			types.NewTx(&types.ArbitrumSubmitRetryableTx{
+				ChainId:          chainConfig.ChainID,
+				RequestId:        testhelpers.RandomHash(),
+				From:             testhelpers.RandomAddress(),
+				L1BaseFee:        big.NewInt(1),
+				DepositValue:     big.NewInt(2 * params.Ether),
+				GasFeeCap:        big.NewInt(params.GWei),
+				RetryTo:          &retryTo,
+				RetryValue:       common.Big0,
+				Beneficiary:      testhelpers.RandomAddress(),
+				MaxSubmissionFee: big.NewInt(params.GWei),
+				FeeRefundAddr:    testhelpers.RandomAddress(),
+			}),
+			transfer,
+		}
+		hooks := NoopSequencingHooks()
+		if burn {
+			hooks.PreTxFilter = func(_ *params.ChainConfig, _ *types.Header, statedb *state.StateDB, _ *arbosState.ArbosState, tx *types.Transaction, _ *arbitrum_types.ConditionalOptions, sender common.Address, _ *L1Info) error {
+				if tx.Hash() == transfer.Hash() {
+					statedb.SubBalance(sender, uint256.NewInt(1), tracing.BalanceChangeUnspecified)
+				}
+				return nil
+			}
+		}
+		_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+		return hooks.Result.BalanceDelta, err
+	}
+
+	breakdown, err := produce(false)
+	Require(t, err)
+	if breakdown.Deposited.Cmp(big.NewInt(params.Ether)) != 0 || breakdown.RetryableDeposited.Cmp(big.NewInt(2*params.Ether)) != 0 || breakdown.Withdrawn.Sign() != 0 {
+		Fail(t, "unexpected balance delta breakdown", breakdown.Deposited, breakdown.RetryableDeposited, breakdown.Withdrawn)
+	}
+	if breakdown.Actual.Cmp(breakdown.Expected()) != 0 || breakdown.Expected().Cmp(big.NewInt(3*params.Ether)) != 0 {
+		Fail(t, "expected actual balance delta", breakdown.Actual, "to match expected", breakdown.Expected())
+	}
+
+	// Burning funds is an error in debug mode, but the breakdown is still reported
+	breakdown, err = produce(true)
+	if err == nil {
+		Fail(t, "expected burning funds to fail in debug mode")
+	}
+	if breakdown == nil || breakdown.Expected().Cmp(big.NewInt(3*params.Ether)) != 0 {
+		Fail(t, "expected the breakdown to be reported when funds were burnt, got", breakdown)
+	}
+	if expected := new(big.Int).Sub(breakdown.Expected(), common.Big1); breakdown.Actual.Cmp(expected) != 0 {
+		Fail(t, "expected actual balance delta", expected, "got", breakdown.Actual)
+	}
+}
+
+func TestMaxBlockBuildDuration(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	slowTx := testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress())
+	txes := types.Transactions{
+		testDepositTx(chainConfig, from, big.NewInt(params.Ether)),
+		slowTx,
+		testTransferTx(t, chainConfig, key, 1, testhelpers.RandomAddress()),
+	}
+
+	clock := testhelpers.NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	hooks := NoopSequencingHooks()
+	hooks.Clock = clock
+	hooks.MaxBlockBuildDuration = time.Second
+	hooks.RecordTxOutcomes = true
+	// Applying the first transfer takes up the whole time budget
+	hooks.PreTxFilter = func(_ *params.ChainConfig, _ *types.Header, _ *state.StateDB, _ *arbosState.ArbosState, tx *types.Transaction, _ *arbitrum_types.ConditionalOptions, _ common.Address, _ *L1Info) error {
+		if tx.Hash() == slowTx.Hash() {
+			clock.Advance(time.Second)
+		}
+		return nil
+	}
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if len(block.Transactions()) != 3 {
+		Fail(t, "expected the start block tx, deposit, and first transfer in the block, got", len(block.Transactions()))
+	}
+	if len(hooks.TxErrors) != 3 || hooks.TxErrors[1] != nil || !errors.Is(hooks.TxErrors[2], ErrBlockTimeBudgetExceeded) {
+		Fail(t, "expected only the second transfer to exceed the time budget, got", hooks.TxErrors)
+	}
+	if !errors.Is(hooks.TxErrors[2], core.ErrGasLimitReached) {
+		Fail(t, "expected the time budget error to be treated like a full block")
+	}
+	if len(hooks.Result.DeferredTxs) != 1 || hooks.Result.DeferredTxs[0].Hash() != txes[2].Hash() {
+		Fail(t, "expected the second transfer to be deferred, got", hooks.Result.DeferredTxs)
+	}
+	if outcomes := hooks.Result.TxOutcomes; outcomes[2] != TxDeferred {
+		Fail(t, "unexpected tx outcomes", outcomes)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	txes := types.Transactions{
+		testDepositTx(chainConfig, from, big.NewInt(params.Ether)),
+		testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+	}
+
+	hooks := NoopSequencingHooks()
+	hooks.DryRun = true
+	hooks.RecordGasBreakdown = true
+	block, receipts, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if block != nil {
+		Fail(t, "expected a dry run not to return a block")
+	}
+	if len(receipts) != 3 || len(hooks.Result.GasBreakdown) != 3 {
+		Fail(t, "expected receipts and gas breakdowns for all 3 txs, got", len(receipts), len(hooks.Result.GasBreakdown))
+	}
+	if root := statedb.IntermediateRoot(true); root != lastBlockHeader.Root {
+		Fail(t, "dry run modified the state")
+	}
+
+	// The state is still usable for producing the real block, which gets the same receipts
+	realHooks := NoopSequencingHooks()
+	block, realReceipts, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, realHooks)
+	Require(t, err)
+	if block == nil || len(realReceipts) != len(receipts) {
+		Fail(t, "expected the real block to include the same txs as the dry run")
+	}
+	for i := range receipts {
+		if receipts[i].Status != realReceipts[i].Status || receipts[i].GasUsed != realReceipts[i].GasUsed {
+			Fail(t, "receipt", i, "differs between the dry run and the real block")
+		}
+	}
+}
+
+func TestPosterCostInGasBreakdown(t *testing.T) {
+	produce := func(t *testing.T, zeroBaseFee bool) (*state.StateDB, *types.Transaction, TxGasBreakdown) {
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+		chainConfig := chainContext.Config()
+		if zeroBaseFee {
+			arbState, err := arbosState.OpenSystemArbosState(statedb, nil, false)
+			Require(t, err)
+			Require(t, arbState.L2PricingState().SetMinBaseFeeWei(common.Big0))
+			Require(t, arbState.L2PricingState().SetBaseFeeWei(common.Big0))
+		}
+		key, err := crypto.GenerateKey()
+		Require(t, err)
+		transfer := testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress())
+		txes := types.Transactions{
+			testDepositTx(chainConfig, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether)),
+			transfer,
+		}
+		hooks := NoopSequencingHooks()
+		hooks.RecordGasBreakdown = true
+		_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+		Require(t, err)
+		breakdown := hooks.Result.GasBreakdown
+		if len(breakdown) != 3 || breakdown[2].TxHash != transfer.Hash() {
+			Fail(t, "expected a gas breakdown for the transfer, got", breakdown)
+		}
+		return statedb, transfer, breakdown[2]
+	}
+
+	statedb, transfer, breakdown := produce(t, false)
+	arbState, err := arbosState.OpenSystemArbosState(statedb, nil, true)
+	Require(t, err)
+	brotliLevel, err := arbState.BrotliCompressionLevel()
+	Require(t, err)
+	expected, _ := arbState.L1PricingState().GetPosterInfo(transfer, l1pricing.BatchPosterAddress, brotliLevel)
+	if expected.Sign() == 0 || breakdown.PosterCost.Cmp(expected) != 0 {
+		Fail(t, "poster cost", breakdown.PosterCost, "doesn't match GetPosterInfo", expected)
+	}
+
+	_, _, breakdown = produce(t, true)
+	if breakdown.PosterCost.Sign() != 0 || breakdown.DataGas != 0 {
+		Fail(t, "expected no poster cost with a zero basefee, got", breakdown.PosterCost, breakdown.DataGas)
+	}
+}
+
+func TestPosterCostFunc(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	transfer := testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress())
+	txes := types.Transactions{
+		testDepositTx(chainConfig, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether)),
+		transfer,
+	}
+
+	const dataGas = 1000
+	var posters []common.Address
+	var basefee *big.Int
+	hooks := NoopSequencingHooks()
+	hooks.RecordGasBreakdown = true
+	hooks.PosterCostFunc = func(tx *types.Transaction, poster common.Address) (*big.Int, error) {
+		posters = append(posters, poster)
+		return new(big.Int).Mul(basefee, big.NewInt(dataGas)), nil
+	}
+	l1Header := testL1Header(lastBlockHeader)
+	builder, err := NewBlockBuilder(l1Header, lastBlockHeader, statedb.Copy(), chainContext, core.NewMessageReplayContext())
+	Require(t, err)
+	basefee = builder.Header().BaseFee
+	_, _, err = produceTestBlock(context.Background(), l1Header, txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	breakdown := hooks.Result.GasBreakdown
+	if len(breakdown) != 3 || breakdown[2].TxHash != transfer.Hash() {
+		Fail(t, "expected a gas breakdown for the transfer, got", breakdown)
+	}
+	if breakdown[2].DataGas != dataGas || breakdown[2].PosterCost.Cmp(new(big.Int).Mul(basefee, big.NewInt(dataGas))) != 0 {
+		Fail(t, "poster cost wasn't taken from the hook", breakdown[2].DataGas, breakdown[2].PosterCost)
+	}
+	// Only user txs are priced by the hook
+	if len(posters) != 2 || posters[0] != l1pricing.BatchPosterAddress {
+		Fail(t, "unexpected hook calls", posters)
+	}
+
+	statedb, lastBlockHeader, chainContext = newBlockProductionTestState(t)
+	hooks = NoopSequencingHooks()
+	hooks.PosterCostFunc = func(*types.Transaction, common.Address) (*big.Int, error) {
+		return nil, errors.New("DA layer unavailable")
+	}
+	_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes[1:], lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if len(hooks.TxErrors) != 1 || hooks.TxErrors[0] == nil {
+		Fail(t, "expected the tx to be dropped when its poster cost can't be computed, got", hooks.TxErrors)
+	}
+}
+
+func TestPosterCostOverflow(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	transfer := testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress())
+	txes := types.Transactions{
+		testDepositTx(chainConfig, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether)),
+		transfer,
+	}
+
+	hooks := NoopSequencingHooks()
+	hooks.RecordGasBreakdown = true
+	// Far more L2 gas than fits in a uint64 at any basefee of at least 1 wei
+	hooks.PosterCostFunc = func(tx *types.Transaction, _ common.Address) (*big.Int, error) {
+		if tx.Hash() == transfer.Hash() {
+			return new(big.Int).Lsh(common.Big1, 128), nil
+		}
+		return new(big.Int), nil
+	}
+	_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	// The hook only affects budgeting, so the transfer is still included
+	Require(t, hooks.TxErrors[1])
+	breakdown := hooks.Result.GasBreakdown
+	if len(breakdown) != 3 || breakdown[2].TxHash != transfer.Hash() {
+		Fail(t, "expected a gas breakdown for the transfer, got", breakdown)
+	}
+	if !breakdown[2].PosterCostOverflow || breakdown[2].DataGas != transfer.Gas() {
+		Fail(t, "expected the transfer's poster cost to overflow, got", breakdown[2].PosterCostOverflow, breakdown[2].DataGas)
+	}
+	if breakdown[1].PosterCostOverflow {
+		Fail(t, "deposit's poster cost unexpectedly overflowed")
+	}
+}
+
+func BenchmarkApplyTxBrotliLevelReads(b *testing.B) {
+	const transfers = 100
+	var reads uint64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		statedb, genesis, chainContext := newBlockProductionTestState(b)
+		chainConfig := chainContext.Config()
+		hooks := NoopSequencingHooks()
+		key, err := crypto.GenerateKey()
+		testhelpers.RequireImpl(b, err)
+		txes := types.Transactions{testDepositTx(chainConfig, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether))}
+		for nonce := uint64(0); nonce < transfers; nonce++ {
+			txes = append(txes, testTransferTx(b, chainConfig, key, nonce, testhelpers.RandomAddress()))
+		}
+		builder, err := NewBlockBuilder(testL1Header(genesis), genesis, statedb, chainContext, core.NewMessageReplayContext())
+		testhelpers.RequireImpl(b, err)
+		b.StartTimer()
+
+		_, _, err = builder.ApplyTx(builder.StartBlockTx(), hooks, nil, false)
+		testhelpers.RequireImpl(b, err)
+		for _, tx := range txes {
+			_, txErr, err := builder.ApplyTx(tx, hooks, nil, true)
+			testhelpers.RequireImpl(b, err)
+			testhelpers.RequireImpl(b, txErr)
+		}
+		reads += builder.brotliLevelReads
+	}
+	// Without the cache, this would be one read per tx
+	b.ReportMetric(float64(reads)/float64(b.N), "brotli-level-reads/block")
+}
+
+func TestPreopenedArbosState(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	expected, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, NoopSequencingHooks())
+	Require(t, err)
+
+	statedb, lastBlockHeader, chainContext = newBlockProductionTestState(t)
+	hooks := NoopSequencingHooks()
+	hooks.ArbosState, err = arbosState.OpenSystemArbosState(statedb, nil, true)
+	Require(t, err)
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if block.Hash() != expected.Hash() {
+		Fail(t, "block produced with a pre-opened ArbOS state", block.Hash(), "doesn't match", expected.Hash())
+	}
+
+	// A state opened on another statedb would read and write ArbOS storage outside the block
+	statedb, lastBlockHeader, chainContext = newBlockProductionTestState(t)
+	hooks.ArbosState, err = arbosState.OpenSystemArbosState(statedb.Copy(), nil, true)
+	Require(t, err)
+	_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, hooks)
+	if err == nil {
+		Fail(t, "expected an ArbOS state opened on another statedb to be rejected")
+	}
+}
+
+func BenchmarkProduceBlockArbosState(b *testing.B) {
+	for _, preopened := range []bool{false, true} {
+		name := "open"
+		if preopened {
+			name = "preopened"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				statedb, lastBlockHeader, chainContext := newBlockProductionTestState(b)
+				hooks := NoopSequencingHooks()
+				if preopened {
+					var err error
+					hooks.ArbosState, err = arbosState.OpenSystemArbosState(statedb, nil, true)
+					testhelpers.RequireImpl(b, err)
+				}
+				b.StartTimer()
+				_, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, chainContext, hooks)
+				testhelpers.RequireImpl(b, err)
+			}
+		})
+	}
+}
+
+// The common case: the start block tx doesn't upgrade ArbOS, so the pre-opened state is used for the whole block
+func BenchmarkProduceBlockWithoutUpgrade(b *testing.B) {
+	deposit := testDepositTx(chaininfo.ArbitrumDevTestChainConfig(), testhelpers.RandomAddress(), big.NewInt(params.Ether))
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(b)
+		version := arbosState.ArbOSVersion(statedb)
+		hooks := NoopSequencingHooks()
+		var err error
+		hooks.ArbosState, err = arbosState.OpenSystemArbosState(statedb, nil, true)
+		testhelpers.RequireImpl(b, err)
+		b.StartTimer()
+		_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), types.Transactions{deposit}, lastBlockHeader, statedb, chainContext, hooks)
+		testhelpers.RequireImpl(b, err)
+		b.StopTimer()
+		if upgraded := arbosState.ArbOSVersion(statedb); upgraded != version {
+			b.Fatal("block upgraded ArbOS from version", version, "to", upgraded)
+		}
+		b.StartTimer()
+	}
+}
+
+func TestMaxWithdrawalValuePerBlock(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+
+	arbSysAbi, err := abi.JSON(strings.NewReader(pgen.ArbSysABI))
+	Require(t, err)
+	withdrawData, err := arbSysAbi.Pack("withdrawEth", testhelpers.RandomAddress())
+	Require(t, err)
+	withdrawTx := func(nonce uint64, value *big.Int) *types.Transaction {
+		tx, err := types.SignNewTx(key, types.LatestSignerForChainID(chainConfig.ChainID), &types.DynamicFeeTx{
+			ChainID:   chainConfig.ChainID,
+			Nonce:     nonce,
+			GasTipCap: big.NewInt(0),
+			GasFeeCap: big.NewInt(params.GWei),
+			Gas:       5_000_000,
+			To:        &types.ArbSysAddress,
+			Value:     value,
+			Data:      withdrawData,
+		})
+		Require(t, err)
+		return tx
+	}
+	withdrawal := big.NewInt(params.Ether / 4)
+	txes := types.Transactions{
+		testDepositTx(chainConfig, from, big.NewInt(params.Ether)),
+		withdrawTx(0, withdrawal),
+		withdrawTx(1, withdrawal),
+		// Would bring the total to 3/4 ether, past the cap
+		withdrawTx(2, withdrawal),
+		// Txs that don't withdraw still go through once the cap is reached
+		testTransferTx(t, chainConfig, key, 2, testhelpers.RandomAddress()),
+	}
+
+	hooks := NoopSequencingHooks()
+	hooks.MaxWithdrawalValuePerBlock = big.NewInt(params.Ether * 3 / 5)
+	_, receipts, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+
+	for i, err := range hooks.TxErrors {
+		capped := errors.Is(err, ErrWithdrawalCapExceeded)
+		if expectCapped := i == 3; capped != expectCapped || (err != nil && !capped) {
+			Fail(t, "tx", i, "got unexpected error", err)
+		}
+	}
+	// The start block tx, the deposit, two withdrawals, and the transfer
+	if len(receipts) != 5 {
+		Fail(t, "expected 5 receipts, got", len(receipts))
+	}
+	expectedWithdrawn := new(big.Int).Mul(withdrawal, big.NewInt(2))
+	if hooks.Result.BalanceDelta.Withdrawn.Cmp(expectedWithdrawn) != 0 {
+		Fail(t, "expected", expectedWithdrawn, "to be withdrawn, got", hooks.Result.BalanceDelta.Withdrawn)
+	}
+}
+
+func TestParseWithdrawalCallvalue(t *testing.T) {
+	arbSys, err := abi.JSON(strings.NewReader(pgen.ArbSysABI))
+	Require(t, err)
+	// The event IDs are normally set by the precompiles package, which can't be imported here
+	oldTxID, oldTransactionID := L2ToL1TxEventID, L2ToL1TransactionEventID
+	L2ToL1TxEventID = arbSys.Events["L2ToL1Tx"].ID
+	L2ToL1TransactionEventID = arbSys.Events["L2ToL1Transaction"].ID
+	defer func() {
+		L2ToL1TxEventID, L2ToL1TransactionEventID = oldTxID, oldTransactionID
+	}()
+
+	caller := testhelpers.RandomAddress()
+	destination := testhelpers.RandomAddress()
+	withdrawalLog := func(event string, callvalue *big.Int) *types.Log {
+		t.Helper()
+		var data []byte
+		nonIndexed := arbSys.Events[event].Inputs.NonIndexed()
+		switch event {
+		case "L2ToL1Tx":
+			// caller, arbBlockNum, ethBlockNum, timestamp, callvalue, data
+			data, err = nonIndexed.Pack(caller, big.NewInt(2), big.NewInt(3), big.NewInt(4), callvalue, []byte{1})
+		case "L2ToL1Transaction":
+			// caller, indexInBatch, arbBlockNum, ethBlockNum, timestamp, callvalue, data
+			data, err = nonIndexed.Pack(caller, big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4), callvalue, []byte{1})
+		}
+		Require(t, err)
+		return &types.Log{
+			Address: ArbSysAddress,
+			Topics: []common.Hash{
+				arbSys.Events[event].ID,
+				common.BytesToHash(destination.Bytes()),
+				testhelpers.RandomHash(),
+				common.BigToHash(big.NewInt(5)),
+			},
+			Data: data,
+		}
+	}
+
+	for _, event := range []string{"L2ToL1Tx", "L2ToL1Transaction"} {
+		expected := big.NewInt(1234)
+		callvalue, ok := parseWithdrawalCallvalue(withdrawalLog(event, expected))
+		if !ok {
+			Fail(t, event, "log wasn't recognized as a withdrawal")
+		}
+		if callvalue.Cmp(expected) != 0 {
+			Fail(t, event, "log has callvalue", callvalue, "instead of", expected)
+		}
+
+		// The same event from another contract isn't a withdrawal
+		other := withdrawalLog(event, expected)
+		other.Address = testhelpers.RandomAddress()
+		if _, ok := parseWithdrawalCallvalue(other); ok {
+			Fail(t, event, "log from another address was treated as a withdrawal")
+		}
+
+		// Neither is a log whose data doesn't match the event's schema
+		malformed := withdrawalLog(event, expected)
+		malformed.Data = malformed.Data[:len(malformed.Data)/2]
+		if _, ok := parseWithdrawalCallvalue(malformed); ok {
+			Fail(t, event, "malformed log was treated as a withdrawal")
+		}
+	}
+
+	unrelated := &types.Log{Address: ArbSysAddress, Topics: []common.Hash{arbSys.Events["SendMerkleUpdate"].ID}}
+	if _, ok := parseWithdrawalCallvalue(unrelated); ok {
+		Fail(t, "unrelated ArbSys log was treated as a withdrawal")
+	}
+	if _, ok := parseWithdrawalCallvalue(&types.Log{Address: ArbSysAddress}); ok {
+		Fail(t, "log without topics was treated as a withdrawal")
+	}
+}
+
+func TestTimestampRegression(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		behind     uint64
+		regression uint64
+	}{
+		{"ahead", 0, 0},
+		{"behind", 990, 990},
+	} {
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+		lastBlockHeader = types.CopyHeader(lastBlockHeader)
+		lastBlockHeader.Time = 1000
+		l1Header := testL1Header(lastBlockHeader)
+		if tc.behind > 0 {
+			l1Header.Timestamp = lastBlockHeader.Time - tc.behind
+		}
+
+		hooks := NoopSequencingHooks()
+		block, _, err := produceTestBlock(context.Background(), l1Header, types.Transactions{}, lastBlockHeader, statedb, chainContext, hooks)
+		Require(t, err)
+		if hooks.Result.TimestampRegression != tc.regression {
+			Fail(t, tc.name, "expected a regression of", tc.regression, "got", hooks.Result.TimestampRegression)
+		}
+		// The block timestamp is still clamped to the parent's, regardless of the regression being reported
+		expectedTime := max(l1Header.Timestamp, lastBlockHeader.Time)
+		if block.Time() != expectedTime {
+			Fail(t, tc.name, "block timestamp", block.Time(), "instead of", expectedTime)
+		}
+	}
+}
+
+func TestResetRefundOnMismatch(t *testing.T) {
+	for _, reset := range []bool{false, true} {
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+		// Simulate an execution environment that left a refund behind
+		statedb.AddRefund(100)
+
+		hooks := NoopSequencingHooks()
+		hooks.ResetRefundOnMismatch = reset
+		_, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), types.Transactions{}, lastBlockHeader, statedb, chainContext, hooks)
+		if !reset {
+			if err == nil || !strings.Contains(err.Error(), "non-zero refund") {
+				Fail(t, "expected the non-zero refund to fail the block, got", err)
+			}
+			continue
+		}
+		Require(t, err)
+		if refund := statedb.GetRefund(); refund != 0 {
+			Fail(t, "refund wasn't reset, it's", refund)
+		}
+	}
+
+	// A refund left behind by the block's last tx is reset at the end of the block instead of failing it in debug mode
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	txes := types.Transactions{testDepositTx(chainContext.Config(), testhelpers.RandomAddress(), big.NewInt(params.Ether))}
+	hooks := NoopSequencingHooks()
+	hooks.ResetRefundOnMismatch = true
+	hooks.PreTxFilter = func(_ *params.ChainConfig, _ *types.Header, statedb *state.StateDB, _ *arbosState.ArbosState, _ *types.Transaction, _ *arbitrum_types.ConditionalOptions, _ common.Address, _ *L1Info) error {
+		statedb.AddRefund(100)
+		return errors.New("rejected")
+	}
+	_, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if refund := statedb.GetRefund(); refund != 0 {
+		Fail(t, "refund wasn't reset at the end of the block, it's", refund)
+	}
+}
+
+func TestMaxComputeGasPerSender(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	cappedKey, err := crypto.GenerateKey()
+	Require(t, err)
+	otherKey, err := crypto.GenerateKey()
+	Require(t, err)
+	txes := types.Transactions{
+		testDepositTx(chainConfig, crypto.PubkeyToAddress(cappedKey.PublicKey), big.NewInt(params.Ether)),
+		testDepositTx(chainConfig, crypto.PubkeyToAddress(otherKey.PublicKey), big.NewInt(params.Ether)),
+		testTransferTx(t, chainConfig, cappedKey, 0, testhelpers.RandomAddress()),
+		testTransferTx(t, chainConfig, cappedKey, 1, testhelpers.RandomAddress()),
+		testTransferTx(t, chainConfig, otherKey, 0, testhelpers.RandomAddress()),
+		testTransferTx(t, chainConfig, cappedKey, 2, testhelpers.RandomAddress()),
+	}
+
+	// Without L1 data gas each transfer's compute gas is its full gas limit, so once a sender has used
+	// any of its budget, none of its later transfers fit
+	arbState, err := arbosState.OpenSystemArbosState(statedb, nil, false)
+	Require(t, err)
+	Require(t, arbState.L1PricingState().SetPricePerUnit(common.Big0))
+	hooks := NoopSequencingHooks()
+	hooks.MaxComputeGasPerSender = txes[2].Gas()
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+
+	deferred := []bool{false, false, false, true, false, true}
+	for i, isDeferred := range deferred {
+		if isDeferred && !errors.Is(hooks.TxErrors[i], ErrSenderGasLimitReached) {
+			Fail(t, "expected tx", i, "to exceed its sender's budget, got", hooks.TxErrors[i])
+		}
+		if !isDeferred && hooks.TxErrors[i] != nil {
+			Fail(t, "expected tx", i, "to be applied, got", hooks.TxErrors[i])
+		}
+	}
+	if !errors.Is(hooks.TxErrors[3], core.ErrGasLimitReached) {
+		Fail(t, "expected the per-sender limit to be treated like a full block")
+	}
+	if len(block.Transactions()) != 5 {
+		Fail(t, "expected the start block tx, deposits, and each sender's first transfer in the block, got", len(block.Transactions()))
+	}
+	deferredTxs := hooks.Result.DeferredTxs
+	if len(deferredTxs) != 2 || deferredTxs[0].Hash() != txes[3].Hash() || deferredTxs[1].Hash() != txes[5].Hash() {
+		Fail(t, "expected the capped sender's later transfers to be deferred, got", deferredTxs)
+	}
+}
+
+func TestReportedBlockGasLimits(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	var txes types.Transactions
+	for i := 0; i < 2; i++ {
+		key, err := crypto.GenerateKey()
+		Require(t, err)
+		txes = append(txes,
+			testDepositTx(chainConfig, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether)),
+			testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+		)
+	}
+
+	// Without L1 data gas each transfer's compute gas is its full gas limit, so the first transfer fits,
+	// but the gas it then uses leaves too little of the per-block limit for the second
+	perBlockGasLimit := txes[1].Gas() + 10_000
+	arbState, err := arbosState.OpenSystemArbosState(statedb, nil, false)
+	Require(t, err)
+	Require(t, arbState.L1PricingState().SetPricePerUnit(common.Big0))
+	Require(t, arbState.L2PricingState().SetMaxPerBlockGasLimit(perBlockGasLimit))
+	hooks := NoopSequencingHooks()
+	block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if !errors.Is(hooks.TxErrors[3], core.ErrGasLimitReached) {
+		Fail(t, "expected the per-block gas limit to leave out the second transfer, got", hooks.TxErrors[3])
+	}
+
+	if hooks.Result.PerBlockGasLimit != perBlockGasLimit {
+		Fail(t, "per-block gas limit", hooks.Result.PerBlockGasLimit, "isn't the one in the ArbOS state", perBlockGasLimit)
+	}
+	if hooks.Result.GethBlockGasLimit != block.GasLimit() || hooks.Result.GethBlockGasLimit != l2pricing.GethBlockGasLimit {
+		Fail(t, "geth block gas limit", hooks.Result.GethBlockGasLimit, "doesn't match the block's", block.GasLimit())
+	}
+}
+
+// recordingTracer is a BlockTracer which records every span it starts.
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	name       string
+	attributes map[string]interface{}
+	ended      bool
+}
+
+func (t *recordingTracer) StartSpan(name string) BlockSpan {
+	span := &recordingSpan{name: name, attributes: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+}
+
+func (s *recordingSpan) End() {
+	s.ended = true
+}
+
+func TestBlockTracer(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	txes := types.Transactions{
+		testDepositTx(chainConfig, testhelpers.RandomAddress(), big.NewInt(params.Ether)),
+		// The sender isn't funded, so this is dropped
+		testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+	}
+	tracer := &recordingTracer{}
+	hooks := NoopSequencingHooks()
+	hooks.Tracer = tracer
+	hooks.TraceEachTx = true
+	block, receipts, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+
+	// One span for the block, and one for each tx including the start block tx
+	if len(tracer.spans) != 4 {
+		Fail(t, "expected 4 spans, got", len(tracer.spans))
+	}
+	for _, span := range tracer.spans {
+		if !span.ended {
+			Fail(t, "span", span.name, "wasn't ended")
+		}
+	}
+	blockSpan := tracer.spans[0]
+	if blockSpan.name != "ProduceBlock" || blockSpan.attributes["blockNumber"] != block.NumberU64() || blockSpan.attributes["txCount"] != len(txes) {
+		Fail(t, "unexpected block span", blockSpan.name, blockSpan.attributes)
+	}
+	if blockSpan.attributes["includedTxCount"] != len(block.Transactions()) || blockSpan.attributes["gasUsed"] != block.GasUsed() {
+		Fail(t, "unexpected block span results", blockSpan.attributes)
+	}
+	allTxes := append(types.Transactions{block.Transactions()[0]}, txes...)
+	for i, span := range tracer.spans[1:] {
+		tx := allTxes[i]
+		if span.name != "ApplyTx" || span.attributes["txHash"] != tx.Hash().Hex() || span.attributes["txType"] != tx.Type() {
+			Fail(t, "span", i, "isn't for tx", tx.Hash(), "got", span.name, span.attributes)
+		}
+		if i < len(receipts) {
+			if span.attributes["gasUsed"] != receipts[i].GasUsed || span.attributes["error"] != nil {
+				Fail(t, "span of applied tx", tx.Hash(), "has unexpected attributes", span.attributes)
+			}
+		} else if span.attributes["error"] != hooks.TxErrors[1].Error() || span.attributes["gasUsed"] != nil {
+			Fail(t, "span of dropped tx", tx.Hash(), "has unexpected attributes", span.attributes)
+		}
+	}
+}
+
+func TestInvalidBrotliCompressionLevel(t *testing.T) {
+	// The offset of the brotli compression level in the ArbOS state's storage
+	const brotliCompressionLevelOffset = 7
+	for _, tc := range []struct {
+		level uint64
+		valid bool
+	}{
+		{arbcompress.LEVEL_WELL, true},
+		{arbcompress.LEVEL_WELL + 1, false},
+	} {
+		statedb, genesis, chainContext := newBlockProductionTestState(t)
+		chainConfig := chainContext.Config()
+		hooks := NoopSequencingHooks()
+		builder, err := NewBlockBuilder(testL1Header(genesis), genesis, statedb, chainContext, core.NewMessageReplayContext())
+		Require(t, err)
+		_, txErr, err := builder.ApplyTx(builder.StartBlockTx(), hooks, nil, false)
+		Require(t, err)
+		Require(t, txErr)
+		key, err := crypto.GenerateKey()
+		Require(t, err)
+		_, txErr, err = builder.ApplyTx(testDepositTx(chainConfig, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether)), hooks, nil, true)
+		Require(t, err)
+		Require(t, txErr)
+
+		// SetBrotliCompressionLevel refuses to store an invalid level, so write it to the ArbOS storage directly
+		arbState, err := arbosState.OpenSystemArbosState(statedb, nil, false)
+		Require(t, err)
+		Require(t, arbState.BackingStorage().SetUint64ByUint64(brotliCompressionLevelOffset, tc.level))
+		level, err := arbState.BrotliCompressionLevel()
+		Require(t, err)
+		if level != tc.level {
+			Fail(t, "wrote brotli compression level", tc.level, "but read back", level)
+		}
+
+		_, txErr, err = builder.ApplyTx(testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()), hooks, nil, true)
+		Require(t, err)
+		if tc.valid {
+			Require(t, txErr)
+		} else if txErr == nil || !strings.Contains(txErr.Error(), "invalid brotli compression level") {
+			Fail(t, "expected brotli compression level", tc.level, "to be rejected, got", txErr)
+		}
+	}
+}
+
+func TestBalanceBurnPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy BalanceBurnPolicy
+		fails  bool
+	}{
+		{"log", BalanceBurnLog, false},
+		{"error", BalanceBurnError, true},
+		{"metric only", BalanceBurnMetricOnly, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+			// Burning funds is always an error in debug mode, regardless of the policy
+			nonDebugConfig := *chainContext.Config()
+			nonDebugConfig.ArbitrumChainParams.AllowDebugPrecompiles = false
+			to := testhelpers.RandomAddress()
+			burningTx := testDepositTx(&nonDebugConfig, testhelpers.RandomAddress(), big.NewInt(1))
+			txes := types.Transactions{
+				testDepositTx(&nonDebugConfig, to, big.NewInt(params.Ether)),
+				burningTx,
+			}
+			hooks := NoopSequencingHooks()
+			hooks.BalanceBurnPolicy = tc.policy
+			hooks.PreTxFilter = func(_ *params.ChainConfig, _ *types.Header, statedb *state.StateDB, _ *arbosState.ArbosState, tx *types.Transaction, _ *arbitrum_types.ConditionalOptions, _ common.Address, _ *L1Info) error {
+				if tx.Hash() == burningTx.Hash() {
+					statedb.SubBalance(to, uint256.NewInt(1), tracing.BalanceChangeUnspecified)
+				}
+				return nil
+			}
+			burnt := balanceBurntCounter.Snapshot().Count()
+			block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, &testChainContext{&nonDebugConfig}, hooks)
+			if tc.fails {
+				if err == nil || !strings.Contains(err.Error(), "funds burnt") {
+					Fail(t, "expected burning funds to fail block production, got", err)
+				}
+			} else {
+				Require(t, err)
+				if len(block.Transactions()) != 3 {
+					Fail(t, "expected the block to be produced with both deposits, got", len(block.Transactions()), "txs")
+				}
+			}
+			// Every policy counts the burn
+			if count := balanceBurntCounter.Snapshot().Count(); count != burnt+1 {
+				Fail(t, "expected the burn to be counted once, counter went from", burnt, "to", count)
+			}
+		})
+	}
+}
+
+func TestMixDigestProvider(t *testing.T) {
+	deposit := testDepositTx(chaininfo.ArbitrumDevTestChainConfig(), testhelpers.RandomAddress(), big.NewInt(params.Ether))
+	var blocks []*types.Block
+	for _, provide := range []bool{false, true} {
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+		hooks := NoopSequencingHooks()
+		provided := false
+		if provide {
+			hooks.MixDigestProvider = func(header *types.Header) common.Hash {
+				if header.Number.Uint64() != lastBlockHeader.Number.Uint64()+1 {
+					Fail(t, "provider got header of block", header.Number, "instead of the block being produced")
+				}
+				provided = true
+				// Only change the bytes past the header info, so the ArbOS version the EVM runs with is unchanged
+				digest := header.MixDigest
+				digest[31] = 1
+				return digest
+			}
+		}
+		block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), types.Transactions{deposit}, lastBlockHeader, statedb, chainContext, hooks)
+		Require(t, err)
+		if provided != provide {
+			Fail(t, "provider set:", provide, "but called:", provided)
+		}
+		blocks = append(blocks, block)
+	}
+	// The produced header's MixDigest is always the Arbitrum header info
+	if blocks[1].MixDigest()[31] != 0 || blocks[0].Hash() != blocks[1].Hash() {
+		Fail(t, "block produced with a mix digest provider", blocks[1].Hash(), "differs from the one without", blocks[0].Hash())
+	}
+
+	// Chains that aren't in debug mode must always use the MixDigest replay would
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	nonDebugConfig := *chainContext.Config()
+	nonDebugConfig.ArbitrumChainParams.AllowDebugPrecompiles = false
+	hooks := NoopSequencingHooks()
+	hooks.MixDigestProvider = func(header *types.Header) common.Hash {
+		return header.MixDigest
+	}
+	_, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), nil, lastBlockHeader, statedb, &testChainContext{&nonDebugConfig}, hooks)
+	if err == nil {
+		Fail(t, "expected a mix digest provider to fail outside of debug mode")
+	}
+}
+
+func TestAllowOversizedFirstTx(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+		chainConfig := chainContext.Config()
+		key, err := crypto.GenerateKey()
+		Require(t, err)
+		// Fund the sender in an earlier block, so the transfer is the first user tx of its block
+		deposit := testDepositTx(chainConfig, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether))
+		block, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), types.Transactions{deposit}, lastBlockHeader, statedb, chainContext, NoopSequencingHooks())
+		Require(t, err)
+
+		// The transfer's gas is above the per-block gas limit
+		arbState, err := arbosState.OpenSystemArbosState(statedb, nil, false)
+		Require(t, err)
+		Require(t, arbState.L2PricingState().SetMaxPerBlockGasLimit(1_000_000))
+		hooks := NoopSequencingHooks()
+		if !hooks.AllowOversizedFirstTx {
+			Fail(t, "expected NoopSequencingHooks to allow an oversized first tx")
+		}
+		hooks.AllowOversizedFirstTx = allow
+		transfer := testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress())
+		_, _, err = produceTestBlock(context.Background(), testL1Header(block.Header()), types.Transactions{transfer}, block.Header(), statedb, chainContext, hooks)
+		Require(t, err)
+		if allow && hooks.TxErrors[0] != nil {
+			Fail(t, "expected the oversized first tx to be allowed, got", hooks.TxErrors[0])
+		}
+		if !allow && !errors.Is(hooks.TxErrors[0], core.ErrGasLimitReached) {
+			Fail(t, "expected the oversized first tx to be rejected, got", hooks.TxErrors[0])
+		}
+	}
+}
+
+func TestRecordSnapshotStats(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	unfundedKey, err := crypto.GenerateKey()
+	Require(t, err)
+	txes := types.Transactions{
+		testDepositTx(chainConfig, testhelpers.RandomAddress(), big.NewInt(params.Ether)),
+		testTransferTx(t, chainConfig, unfundedKey, 0, testhelpers.RandomAddress()),
+	}
+	hooks := NoopSequencingHooks()
+	hooks.RecordSnapshotStats = true
+	_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if hooks.TxErrors[1] == nil {
+		Fail(t, "expected the unfunded transfer to fail")
+	}
+	// Each tx, including the start block tx, takes a snapshot, which is reverted if applying the tx fails
+	if hooks.Result.Snapshots != 3 || hooks.Result.Reverts != 1 {
+		Fail(t, "expected 3 snapshots and 1 revert, got", hooks.Result.Snapshots, "and", hooks.Result.Reverts)
+	}
+}
+
+func TestSubtractRedeemGas(t *testing.T) {
+	tx := testDepositTx(chaininfo.ArbitrumDevTestChainConfig(), testhelpers.RandomAddress(), big.NewInt(1))
+	redeems := types.Transactions{
+		types.NewTx(&types.ArbitrumRetryTx{Gas: 30_000}),
+		types.NewTx(&types.ArbitrumRetryTx{Gas: 20_000}),
+	}
+	for _, tc := range []struct {
+		txGasUsed uint64
+		debugMode bool
+		expected  uint64
+		fails     bool
+	}{
+		{100_000, true, 50_000, false},
+		{100_000, false, 50_000, false},
+		// The redeems have more gas than the tx used, which is only caught in debug mode
+		{40_000, true, 0, true},
+		{40_000, false, 0, false},
+	} {
+		gas, err := subtractRedeemGas(tx, redeems, tc.txGasUsed, tc.debugMode)
+		if tc.fails {
+			if err == nil {
+				Fail(t, "expected redeems with", 50_000, "gas to fail a tx that used", tc.txGasUsed, "in debug mode")
+			}
+			continue
+		}
+		Require(t, err)
+		if gas != tc.expected {
+			Fail(t, "debug mode:", tc.debugMode, "tx used", tc.txGasUsed, "gas, which is", gas, "without redeems instead of", tc.expected)
+		}
+	}
+}
+
+func TestNonZeroRefundAtEndOfBlock(t *testing.T) {
+	for _, debugMode := range []bool{true, false} {
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+		chainConfig := *chainContext.Config()
+		chainConfig.ArbitrumChainParams.AllowDebugPrecompiles = debugMode
+		txes := types.Transactions{testDepositTx(&chainConfig, testhelpers.RandomAddress(), big.NewInt(params.Ether))}
+
+		// Applying a tx clears the refund, so leave one behind with a filter rejecting the last tx
+		hooks := NoopSequencingHooks()
+		hooks.PreTxFilter = func(_ *params.ChainConfig, _ *types.Header, statedb *state.StateDB, _ *arbosState.ArbosState, _ *types.Transaction, _ *arbitrum_types.ConditionalOptions, _ common.Address, _ *L1Info) error {
+			statedb.AddRefund(100)
+			return errors.New("rejected")
+		}
+		_, _, err := produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, &testChainContext{&chainConfig}, hooks)
+		if debugMode && (err == nil || !strings.Contains(err.Error(), "at end of block statedb has non-zero refund")) {
+			Fail(t, "expected the non-zero refund to fail the block in debug mode, got", err)
+		}
+		if !debugMode {
+			Require(t, err)
+		}
+	}
+}
+
+func TestBlockProductionMetrics(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+		chainConfig := chainContext.Config()
+		key, err := crypto.GenerateKey()
+		Require(t, err)
+		txes := types.Transactions{
+			testDepositTx(chainConfig, testhelpers.RandomAddress(), big.NewInt(params.Ether)),
+			// The sender isn't funded, so this is dropped
+			testTransferTx(t, chainConfig, key, 0, testhelpers.RandomAddress()),
+		}
+		histograms := map[string]metrics.Histogram{
+			"user txs":    blockUserTxsHistogram,
+			"dropped txs": blockDroppedTxsHistogram,
+			"redeems":     blockRedeemsHistogram,
+			"gas used":    blockGasUsedHistogram,
+		}
+		counts := make(map[string]int64)
+		for name, histogram := range histograms {
+			counts[name] = histogram.Snapshot().Count()
+		}
+		timerCount := blockProductionTimer.Snapshot().Count()
+
+		hooks := NoopSequencingHooks()
+		hooks.DryRun = dryRun
+		_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+		Require(t, err)
+
+		// Dry runs aren't real blocks, so they aren't measured, and nothing is measured with metrics disabled
+		var expected int64 = 1
+		if dryRun || !metrics.Enabled() {
+			expected = 0
+		}
+		for name, histogram := range histograms {
+			if count := histogram.Snapshot().Count() - counts[name]; count != expected {
+				Fail(t, "dry run:", dryRun, "expected", expected, "updates of the", name, "histogram, got", count)
+			}
+		}
+		if count := blockProductionTimer.Snapshot().Count() - timerCount; count != expected {
+			Fail(t, "dry run:", dryRun, "expected", expected, "updates of the block production timer, got", count)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+)
+
+// DiffBlocks lists the header fields and transactions in which the actual block differs from the expected one.
+// It returns nil if the blocks have the same hash.
+func DiffBlocks(expected, actual *types.Block) []string {
+	if expected.Hash() == actual.Hash() {
+		return nil
+	}
+	var diffs []string
+	diff := func(field string, expected, actual interface{}) {
+		diffs = append(diffs, fmt.Sprintf("%v: expected %v, got %v", field, expected, actual))
+	}
+	e, a := expected.Header(), actual.Header()
+	if e.ParentHash != a.ParentHash {
+		diff("parent hash", e.ParentHash, a.ParentHash)
+	}
+	if e.Coinbase != a.Coinbase {
+		diff("coinbase", e.Coinbase, a.Coinbase)
+	}
+	if e.Root != a.Root {
+		diff("state root", e.Root, a.Root)
+	}
+	if e.TxHash != a.TxHash {
+		diff("tx hash", e.TxHash, a.TxHash)
+	}
+	if e.ReceiptHash != a.ReceiptHash {
+		diff("receipt hash", e.ReceiptHash, a.ReceiptHash)
+	}
+	if e.Bloom != a.Bloom {
+		diff("bloom", common.Bytes2Hex(e.Bloom[:]), common.Bytes2Hex(a.Bloom[:]))
+	}
+	if e.Number.Cmp(a.Number) != 0 {
+		diff("number", e.Number, a.Number)
+	}
+	if e.GasLimit != a.GasLimit {
+		diff("gas limit", e.GasLimit, a.GasLimit)
+	}
+	if e.GasUsed != a.GasUsed {
+		diff("gas used", e.GasUsed, a.GasUsed)
+	}
+	if e.Time != a.Time {
+		diff("time", e.Time, a.Time)
+	}
+	if !bytes.Equal(e.Extra, a.Extra) {
+		diff("extra", common.Bytes2Hex(e.Extra), common.Bytes2Hex(a.Extra))
+	}
+	if e.MixDigest != a.MixDigest {
+		diff("mix digest", e.MixDigest, a.MixDigest)
+	}
+	if e.Nonce != a.Nonce {
+		diff("nonce", e.Nonce.Uint64(), a.Nonce.Uint64())
+	}
+	if (e.BaseFee == nil) != (a.BaseFee == nil) || (e.BaseFee != nil && e.BaseFee.Cmp(a.BaseFee) != 0) {
+		diff("base fee", e.BaseFee, a.BaseFee)
+	}
+	expectedTxs, actualTxs := expected.Transactions(), actual.Transactions()
+	if len(expectedTxs) != len(actualTxs) {
+		diff("tx count", len(expectedTxs), len(actualTxs))
+	}
+	for i := 0; i < len(expectedTxs) && i < len(actualTxs); i++ {
+		if expectedTxs[i].Hash() != actualTxs[i].Hash() {
+			diff(fmt.Sprintf("tx %v", i), expectedTxs[i].Hash(), actualTxs[i].Hash())
+		}
+	}
+	if len(diffs) == 0 {
+		diff("hash", expected.Hash(), actual.Hash())
+	}
+	return diffs
+}
+
+// BlockMismatchError is returned when a replayed block doesn't match the expected block.
+type BlockMismatchError struct {
+	Expected common.Hash
+	Actual   common.Hash
+	Diff     []string // Only filled in if the expected block is known
+}
+
+func (e *BlockMismatchError) Error() string {
+	msg := fmt.Sprintf("replayed block hash %v doesn't match expected %v", e.Actual, e.Expected)
+	if len(e.Diff) > 0 {
+		msg += ":\n\t" + strings.Join(e.Diff, "\n\t")
+	}
+	return msg
+}
+
+// ReplayBlockAndCompare produces a block from the message on top of the given state with ProduceBlock,
+// and checks that its hash matches expectedHash. The state and chain context must be the same ones
+// the expected block was produced with; statedb is modified by the replay.
+// If expected is non-nil, a mismatch is returned as a *BlockMismatchError describing how the blocks differ.
+func ReplayBlockAndCompare(
+	message *arbostypes.L1IncomingMessage,
+	delayedMessagesRead uint64,
+	lastBlockHeader *types.Header,
+	statedb *state.StateDB,
+	chainContext core.ChainContext,
+	expectedHash common.Hash,
+	expected *types.Block,
+) (*types.Block, types.Receipts, error) {
+	block, receipts, err := ProduceBlock(message, delayedMessagesRead, lastBlockHeader, statedb, chainContext, false, core.NewMessageReplayContext())
+	if err != nil {
+		return nil, nil, err
+	}
+	if block.Hash() != expectedHash {
+		mismatch := &BlockMismatchError{
+			Expected: expectedHash,
+			Actual:   block.Hash(),
+		}
+		if expected != nil {
+			mismatch.Diff = DiffBlocks(expected, block)
+		}
+		return block, receipts, mismatch
+	}
+	return block, receipts, nil
+}
+
+// ReplayAndVerifyBlock replays the production of expected from the message on top of lastBlockHeader and checks that
+// the replayed block matches it bit for bit, which catches non-determinism in block production. The delayed message
+// count is taken from expected's header nonce, and statedb must be the state at lastBlockHeader.Root; it's modified
+// by the replay. If the blocks diverge, a *BlockMismatchError names each differing field, like the receipt hash or
+// state root, with its expected and actual values.
+func ReplayAndVerifyBlock(
+	message *arbostypes.L1IncomingMessage,
+	lastBlockHeader *types.Header,
+	statedb *state.StateDB,
+	chainContext core.ChainContext,
+	expected *types.Block,
+) error {
+	if expected == nil {
+		return errors.New("no block to verify")
+	}
+	if lastBlockHeader == nil || expected.ParentHash() != lastBlockHeader.Hash() {
+		return fmt.Errorf("block %v isn't a child of the given parent header", expected.Hash())
+	}
+	_, _, err := ReplayBlockAndCompare(message, expected.Nonce(), lastBlockHeader, statedb, chainContext, expected.Hash(), expected)
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+)
+
+func testDepositMessage() *arbostypes.L1IncomingMessage {
+	requestId := common.HexToHash("0x01")
+	to := common.HexToAddress("0x1234")
+	value := common.BigToHash(big.NewInt(1e18))
+	return &arbostypes.L1IncomingMessage{
+		Header: &arbostypes.L1IncomingMessageHeader{
+			Kind:        arbostypes.L1MessageType_EthDeposit,
+			Poster:      common.HexToAddress("0x5678"),
+			BlockNumber: 1,
+			Timestamp:   1,
+			RequestId:   &requestId,
+		},
+		L2msg: append(to.Bytes(), value.Bytes()...),
+	}
+}
+
+func TestReplayBlockAndCompare(t *testing.T) {
+	message := testDepositMessage()
+
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	expected, _, err := ProduceBlock(message, 1, lastBlockHeader, statedb, chainContext, false, core.NewMessageReplayContext())
+	Require(t, err)
+
+	statedb, lastBlockHeader, chainContext = newBlockProductionTestState(t)
+	_, _, err = ReplayBlockAndCompare(message, 1, lastBlockHeader, statedb, chainContext, expected.Hash(), expected)
+	Require(t, err)
+
+	// The delayed message count is stored in the header nonce, so changing it should change the block
+	statedb, lastBlockHeader, chainContext = newBlockProductionTestState(t)
+	_, _, err = ReplayBlockAndCompare(message, 2, lastBlockHeader, statedb, chainContext, expected.Hash(), expected)
+	var mismatch *BlockMismatchError
+	if !errors.As(err, &mismatch) {
+		Fail(t, "expected a block mismatch error, got", err)
+	}
+	if len(mismatch.Diff) == 0 {
+		Fail(t, "expected the mismatch to describe how the blocks differ")
+	}
+}
+
+func TestReplayAndVerifyBlock(t *testing.T) {
+	message := testDepositMessage()
+
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	expected, _, err := ProduceBlock(message, 1, lastBlockHeader, statedb, chainContext, false, core.NewMessageReplayContext())
+	Require(t, err)
+
+	statedb, lastBlockHeader, chainContext = newBlockProductionTestState(t)
+	Require(t, ReplayAndVerifyBlock(message, lastBlockHeader, statedb, chainContext, expected))
+
+	// A different deposit executes differently, so the state root and receipts diverge
+	other := testDepositMessage()
+	other.L2msg = append(common.HexToAddress("0x4321").Bytes(), other.L2msg[common.AddressLength:]...)
+	statedb, lastBlockHeader, chainContext = newBlockProductionTestState(t)
+	err = ReplayAndVerifyBlock(other, lastBlockHeader, statedb, chainContext, expected)
+	var mismatch *BlockMismatchError
+	if !errors.As(err, &mismatch) {
+		Fail(t, "expected a block mismatch error, got", err)
+	}
+	diff := strings.Join(mismatch.Diff, "\n")
+	if !strings.Contains(diff, "state root") || !strings.Contains(diff, "receipt hash") {
+		Fail(t, "expected the state root and receipt hash to differ, got", diff)
+	}
+
+	if err := ReplayAndVerifyBlock(message, expected.Header(), statedb, chainContext, expected); err == nil {
+		Fail(t, "expected a block with another parent to be rejected")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// BlockResultCache lets a speculative block production run (e.g. a prefetch) hand its result to a later run
+// for the same message on top of the same parent block, so the block doesn't need to be executed twice.
+//
+// Results are keyed by the message, delayed message count, parent block hash, and run mode, and are only
+// returned if the parent's state root still matches. The run mode matters because the modes have different
+// side effects: a prefetch run doesn't cache Stylus programs like a commit run does, so its result must not
+// stand in for a commit run. Each result is handed out at most once, since its statedb may then be committed.
+type BlockResultCache struct {
+	mutex   sync.Mutex
+	results *containers.LruCache[blockResultKey, *cachedBlockResult]
+}
+
+type blockResultKey struct {
+	messageHash         common.Hash
+	delayedMessagesRead uint64
+	parentHash          common.Hash
+	runMode             string
+}
+
+type cachedBlockResult struct {
+	parentRoot common.Hash
+	block      *types.Block
+	receipts   types.Receipts
+	statedb    *state.StateDB
+}
+
+func NewBlockResultCache(capacity int) *BlockResultCache {
+	return &BlockResultCache{
+		results: containers.NewLruCache[blockResultKey, *cachedBlockResult](capacity),
+	}
+}
+
+func blockResultCacheKey(message *arbostypes.L1IncomingMessage, delayedMessagesRead uint64, parentHeader *types.Header, runMode string) (blockResultKey, error) {
+	encoded, err := rlp.EncodeToBytes(message)
+	if err != nil {
+		return blockResultKey{}, err
+	}
+	return blockResultKey{
+		messageHash:         crypto.Keccak256Hash(encoded),
+		delayedMessagesRead: delayedMessagesRead,
+		parentHash:          parentHeader.Hash(),
+		runMode:             runMode,
+	}, nil
+}
+
+// Put stores the result of producing a block from the message on top of parentHeader.
+// statedb must be the state the block was produced into, and mustn't be used by the caller afterwards.
+func (c *BlockResultCache) Put(
+	message *arbostypes.L1IncomingMessage,
+	delayedMessagesRead uint64,
+	parentHeader *types.Header,
+	runMode string,
+	block *types.Block,
+	receipts types.Receipts,
+	statedb *state.StateDB,
+) error {
+	key, err := blockResultCacheKey(message, delayedMessagesRead, parentHeader, runMode)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.results.Add(key, &cachedBlockResult{
+		parentRoot: parentHeader.Root,
+		block:      block,
+		receipts:   receipts,
+		statedb:    statedb,
+	})
+	return nil
+}
+
+// Take returns and removes a result previously stored for the same inputs, if its parent state root matches.
+func (c *BlockResultCache) Take(
+	message *arbostypes.L1IncomingMessage,
+	delayedMessagesRead uint64,
+	parentHeader *types.Header,
+	runMode string,
+) (*types.Block, types.Receipts, *state.StateDB, bool) {
+	key, err := blockResultCacheKey(message, delayedMessagesRead, parentHeader, runMode)
+	if err != nil {
+		return nil, nil, nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result, ok := c.results.Get(key)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	c.results.Remove(key)
+	if result.parentRoot != parentHeader.Root || result.block.ParentHash() != key.parentHash {
+		return nil, nil, nil, false
+	}
+	return result.block, result.receipts, result.statedb, true
+}
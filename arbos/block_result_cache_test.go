@@ -0,0 +1,34 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core"
+)
+
+func TestBlockResultCache(t *testing.T) {
+	message := testDepositMessage()
+	statedb, parentHeader, chainContext := newBlockProductionTestState(t)
+	runCtx := core.NewMessageReplayContext()
+	block, receipts, err := ProduceBlock(message, 1, parentHeader, statedb, chainContext, false, runCtx)
+	Require(t, err)
+
+	cache := NewBlockResultCache(4)
+	Require(t, cache.Put(message, 1, parentHeader, runCtx.RunModeMetricName(), block, receipts, statedb))
+	if _, _, _, ok := cache.Take(message, 1, parentHeader, "other"); ok {
+		Fail(t, "expected a result from a different run mode not to be reused")
+	}
+	if _, _, _, ok := cache.Take(message, 2, parentHeader, runCtx.RunModeMetricName()); ok {
+		Fail(t, "expected a result with a different delayed message count not to be reused")
+	}
+	cachedBlock, _, cachedState, ok := cache.Take(message, 1, parentHeader, runCtx.RunModeMetricName())
+	if !ok || cachedBlock.Hash() != block.Hash() || cachedState != statedb {
+		Fail(t, "expected the cached result to be reused")
+	}
+	if _, _, _, ok := cache.Take(message, 1, parentHeader, runCtx.RunModeMetricName()); ok {
+		Fail(t, "expected a cached result to only be handed out once")
+	}
+}
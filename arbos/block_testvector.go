@@ -0,0 +1,164 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/tracing"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/triedb"
+
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+)
+
+// BlockTestVector is a self-contained block production scenario which can be stored as JSON
+// and replayed by any implementation to check it produces the same block.
+type BlockTestVector struct {
+	ChainConfig         *params.ChainConfig           `json:"chainConfig"`
+	Message             *arbostypes.L1IncomingMessage `json:"message"`
+	DelayedMessagesRead uint64                        `json:"delayedMessagesRead"`
+	ParentHeader        *types.Header                 `json:"parentHeader"`
+	PreState            types.GenesisAlloc            `json:"preState"`
+	ExpectedBlockHash   common.Hash                   `json:"expectedBlockHash"`
+	ExpectedReceipts    types.Receipts                `json:"expectedReceipts"`
+}
+
+// testVectorChainContext only knows about the vector's parent header,
+// so vectors can't cover blocks which look up older block hashes.
+type testVectorChainContext struct {
+	chainConfig  *params.ChainConfig
+	parentHeader *types.Header
+}
+
+func (c *testVectorChainContext) Engine() consensus.Engine {
+	return Engine{}
+}
+
+func (c *testVectorChainContext) GetHeader(hash common.Hash, number uint64) *types.Header {
+	if hash == c.parentHeader.Hash() && number == c.parentHeader.Number.Uint64() {
+		return c.parentHeader
+	}
+	return nil
+}
+
+func (c *testVectorChainContext) Config() *params.ChainConfig {
+	return c.chainConfig
+}
+
+// ExportBlockTestVector captures the production of the block following parentHeader from the message as a test vector.
+// preState must be the committed state at parentHeader.Root, opened from a database that records preimages,
+// as the full state is dumped into the vector. preState itself isn't modified.
+func ExportBlockTestVector(
+	chainConfig *params.ChainConfig,
+	message *arbostypes.L1IncomingMessage,
+	delayedMessagesRead uint64,
+	parentHeader *types.Header,
+	preState *state.StateDB,
+) (*BlockTestVector, error) {
+	alloc, err := dumpAlloc(preState)
+	if err != nil {
+		return nil, err
+	}
+	chainContext := &testVectorChainContext{chainConfig, parentHeader}
+	block, receipts, err := ProduceBlock(message, delayedMessagesRead, parentHeader, preState.Copy(), chainContext, false, core.NewMessageReplayContext())
+	if err != nil {
+		return nil, err
+	}
+	return &BlockTestVector{
+		ChainConfig:         chainConfig,
+		Message:             message,
+		DelayedMessagesRead: delayedMessagesRead,
+		ParentHeader:        parentHeader,
+		PreState:            alloc,
+		ExpectedBlockHash:   block.Hash(),
+		ExpectedReceipts:    receipts,
+	}, nil
+}
+
+func dumpAlloc(statedb *state.StateDB) (types.GenesisAlloc, error) {
+	dump := statedb.RawDump(&state.DumpConfig{})
+	alloc := make(types.GenesisAlloc, len(dump.Accounts))
+	for key, account := range dump.Accounts {
+		if account.Address == nil {
+			return nil, fmt.Errorf("state dump is missing the address preimage of account %v", key)
+		}
+		balance, ok := new(big.Int).SetString(account.Balance, 10)
+		if !ok {
+			return nil, fmt.Errorf("account %v has invalid balance %v", account.Address, account.Balance)
+		}
+		storage := make(map[common.Hash]common.Hash, len(account.Storage))
+		for slot, value := range account.Storage {
+			storage[slot] = common.HexToHash(value)
+		}
+		alloc[*account.Address] = types.Account{
+			Code:    account.Code,
+			Storage: storage,
+			Balance: balance,
+			Nonce:   account.Nonce,
+		}
+	}
+	return alloc, nil
+}
+
+// OpenPreState builds the vector's starting state in a fresh in-memory database,
+// checking it matches the parent header's state root.
+func (v *BlockTestVector) OpenPreState() (*state.StateDB, error) {
+	if v.ParentHeader == nil {
+		return nil, errors.New("test vector has no parent header")
+	}
+	db := state.NewDatabase(triedb.NewDatabase(rawdb.NewMemoryDatabase(), nil), nil)
+	statedb, err := state.New(common.Hash{}, db)
+	if err != nil {
+		return nil, err
+	}
+	for addr, account := range v.PreState {
+		if account.Balance != nil {
+			statedb.SetBalance(addr, uint256.MustFromBig(account.Balance), tracing.BalanceChangeUnspecified)
+		}
+		statedb.SetNonce(addr, account.Nonce, tracing.NonceChangeUnspecified)
+		statedb.SetCode(addr, account.Code)
+		for slot, value := range account.Storage {
+			statedb.SetState(addr, slot, value)
+		}
+	}
+	root, err := statedb.Commit(v.ParentHeader.Number.Uint64(), true, false)
+	if err != nil {
+		return nil, err
+	}
+	if root != v.ParentHeader.Root {
+		return nil, fmt.Errorf("test vector pre-state has root %v but its parent header has root %v", root, v.ParentHeader.Root)
+	}
+	return state.New(root, db)
+}
+
+// Replay produces the vector's block and checks that it and its receipts match the expected ones.
+func (v *BlockTestVector) Replay() error {
+	statedb, err := v.OpenPreState()
+	if err != nil {
+		return err
+	}
+	chainContext := &testVectorChainContext{v.ChainConfig, v.ParentHeader}
+	_, receipts, err := ReplayBlockAndCompare(v.Message, v.DelayedMessagesRead, v.ParentHeader, statedb, chainContext, v.ExpectedBlockHash, nil)
+	if err != nil {
+		return err
+	}
+	expectedReceiptHash := types.DeriveSha(v.ExpectedReceipts, trie.NewStackTrie(nil))
+	receiptHash := types.DeriveSha(receipts, trie.NewStackTrie(nil))
+	if receiptHash != expectedReceiptHash {
+		return fmt.Errorf("replayed receipt hash %v doesn't match expected %v", receiptHash, expectedReceiptHash)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/triedb"
+
+	"github.com/offchainlabs/nitro/arbos/arbosState"
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+	"github.com/offchainlabs/nitro/arbos/burn"
+	"github.com/offchainlabs/nitro/cmd/chaininfo"
+)
+
+func TestBlockTestVectorRoundTrip(t *testing.T) {
+	// Dumping the state requires the address preimages
+	db := state.NewDatabase(triedb.NewDatabase(rawdb.NewMemoryDatabase(), &triedb.Config{Preimages: true}), nil)
+	statedb, err := state.New(common.Hash{}, db)
+	Require(t, err)
+	chainConfig := chaininfo.ArbitrumDevTestChainConfig()
+	_, err = arbosState.InitializeArbosState(statedb, burn.NewSystemBurner(nil, false), chainConfig, nil, arbostypes.TestInitMessage)
+	Require(t, err)
+	root, err := statedb.Commit(chainConfig.ArbitrumChainParams.GenesisBlockNum, true, false)
+	Require(t, err)
+	preState, err := state.New(root, db)
+	Require(t, err)
+	parentHeader := arbosState.MakeGenesisBlock(common.Hash{}, 0, 0, root, chainConfig).Header()
+
+	vector, err := ExportBlockTestVector(chainConfig, testDepositMessage(), 1, parentHeader, preState)
+	Require(t, err)
+	data, err := json.Marshal(vector)
+	Require(t, err)
+	var decoded BlockTestVector
+	Require(t, json.Unmarshal(data, &decoded))
+	Require(t, decoded.Replay())
+
+	decoded.ExpectedBlockHash = common.Hash{}
+	if err := decoded.Replay(); err == nil {
+		Fail(t, "expected replay to fail with the wrong expected block hash")
+	}
+}
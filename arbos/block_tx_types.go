@@ -0,0 +1,43 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// TxTypeCounts tallies a block's transactions by their Arbitrum tx type.
+type TxTypeCounts struct {
+	Internal        int
+	Deposit         int
+	SubmitRetryable int
+	Retry           int
+	Unsigned        int
+	Contract        int
+	Standard        int // Signed Ethereum txs of any type, including ones wrapped in an ArbitrumLegacyTx
+}
+
+// CountTxTypes classifies the transactions of a block by type.
+func CountTxTypes(block *types.Block) TxTypeCounts {
+	var counts TxTypeCounts
+	for _, tx := range block.Transactions() {
+		switch tx.GetInner().(type) {
+		case *types.ArbitrumInternalTx:
+			counts.Internal++
+		case *types.ArbitrumDepositTx:
+			counts.Deposit++
+		case *types.ArbitrumSubmitRetryableTx:
+			counts.SubmitRetryable++
+		case *types.ArbitrumRetryTx:
+			counts.Retry++
+		case *types.ArbitrumUnsignedTx:
+			counts.Unsigned++
+		case *types.ArbitrumContractTx:
+			counts.Contract++
+		default:
+			counts.Standard++
+		}
+	}
+	return counts
+}
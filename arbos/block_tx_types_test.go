@@ -0,0 +1,20 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core"
+)
+
+func TestCountTxTypes(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	block, _, err := ProduceBlock(testDepositMessage(), 1, lastBlockHeader, statedb, chainContext, false, core.NewMessageReplayContext())
+	Require(t, err)
+	counts := CountTxTypes(block)
+	if counts != (TxTypeCounts{Internal: 1, Deposit: 1}) {
+		Fail(t, "unexpected tx type counts", counts)
+	}
+}
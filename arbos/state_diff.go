@@ -0,0 +1,116 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"bytes"
+	"math/big"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/tracing"
+)
+
+// StateDiff is the set of accounts and storage slots a block modified, with their values after the block.
+// Accounts and slots that were written but ended up back at their value before the block are left out,
+// which includes everything touched by txs that were reverted and dropped from the block.
+type StateDiff struct {
+	Accounts map[common.Address]*AccountDiff
+}
+
+// AccountDiff is how a block modified an account. Fields are nil if the block didn't change them.
+type AccountDiff struct {
+	Balance *uint256.Int
+	Nonce   *uint64
+	Code    []byte
+	Storage map[common.Hash]common.Hash
+}
+
+// stateDiffCollector records the value each account field and storage slot had before it was first written
+// during the block, so the diff can be computed against the final state once the block is done.
+type stateDiffCollector struct {
+	balances   map[common.Address]*big.Int
+	nonces     map[common.Address]uint64
+	codeHashes map[common.Address]common.Hash
+	storage    map[common.Address]map[common.Hash]common.Hash
+	hooks      *tracing.Hooks
+}
+
+func newStateDiffCollector() *stateDiffCollector {
+	c := &stateDiffCollector{
+		balances:   make(map[common.Address]*big.Int),
+		nonces:     make(map[common.Address]uint64),
+		codeHashes: make(map[common.Address]common.Hash),
+		storage:    make(map[common.Address]map[common.Hash]common.Hash),
+	}
+	c.hooks = &tracing.Hooks{
+		OnBalanceChange: func(addr common.Address, prev, _ *big.Int, _ tracing.BalanceChangeReason) {
+			if _, ok := c.balances[addr]; !ok {
+				c.balances[addr] = new(big.Int).Set(prev)
+			}
+		},
+		OnNonceChange: func(addr common.Address, prev, _ uint64) {
+			if _, ok := c.nonces[addr]; !ok {
+				c.nonces[addr] = prev
+			}
+		},
+		OnCodeChange: func(addr common.Address, prevCodeHash common.Hash, _ []byte, _ common.Hash, _ []byte) {
+			if _, ok := c.codeHashes[addr]; !ok {
+				c.codeHashes[addr] = prevCodeHash
+			}
+		},
+		OnStorageChange: func(addr common.Address, slot common.Hash, prev, _ common.Hash) {
+			slots := c.storage[addr]
+			if slots == nil {
+				slots = make(map[common.Hash]common.Hash)
+				c.storage[addr] = slots
+			}
+			if _, ok := slots[slot]; !ok {
+				slots[slot] = prev
+			}
+		},
+	}
+	return c
+}
+
+func (c *stateDiffCollector) diff(statedb *state.StateDB) StateDiff {
+	diff := StateDiff{Accounts: make(map[common.Address]*AccountDiff)}
+	account := func(addr common.Address) *AccountDiff {
+		accountDiff := diff.Accounts[addr]
+		if accountDiff == nil {
+			accountDiff = &AccountDiff{}
+			diff.Accounts[addr] = accountDiff
+		}
+		return accountDiff
+	}
+	for addr, prev := range c.balances {
+		if balance := statedb.GetBalance(addr); balance.ToBig().Cmp(prev) != 0 {
+			account(addr).Balance = balance.Clone()
+		}
+	}
+	for addr, prev := range c.nonces {
+		if nonce := statedb.GetNonce(addr); nonce != prev {
+			account(addr).Nonce = &nonce
+		}
+	}
+	for addr, prev := range c.codeHashes {
+		if statedb.GetCodeHash(addr) != prev {
+			account(addr).Code = bytes.Clone(statedb.GetCode(addr))
+		}
+	}
+	for addr, slots := range c.storage {
+		for slot, prev := range slots {
+			if value := statedb.GetState(addr, slot); value != prev {
+				accountDiff := account(addr)
+				if accountDiff.Storage == nil {
+					accountDiff.Storage = make(map[common.Hash]common.Hash)
+				}
+				accountDiff.Storage[slot] = value
+			}
+		}
+	}
+	return diff
+}
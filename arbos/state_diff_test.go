@@ -0,0 +1,77 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbos
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+
+	"github.com/offchainlabs/nitro/arbos/arbosState"
+	"github.com/offchainlabs/nitro/util/testhelpers"
+)
+
+func TestOnStateDiff(t *testing.T) {
+	statedb, lastBlockHeader, chainContext := newBlockProductionTestState(t)
+	chainConfig := chainContext.Config()
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	to := testhelpers.RandomAddress()
+	rejected := testhelpers.RandomAddress()
+	txes := types.Transactions{
+		testDepositTx(chainConfig, from, big.NewInt(params.Ether)),
+		testTransferTx(t, chainConfig, key, 0, rejected),
+		testTransferTx(t, chainConfig, key, 0, to),
+	}
+
+	hooks := NoopSequencingHooks()
+	// The first transfer executes but is then reverted and dropped
+	hooks.PostTxFilter = func(_ *types.Header, _ *state.StateDB, _ *arbosState.ArbosState, tx *types.Transaction, _ common.Address, _ uint64, _ *core.ExecutionResult) error {
+		if *tx.To() == rejected {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+	var diffs []StateDiff
+	hooks.OnStateDiff = func(diff StateDiff) {
+		diffs = append(diffs, diff)
+	}
+	_, _, err = produceTestBlock(context.Background(), testL1Header(lastBlockHeader), txes, lastBlockHeader, statedb, chainContext, hooks)
+	Require(t, err)
+	if hooks.TxErrors[1] == nil {
+		Fail(t, "expected the first transfer to be dropped")
+	}
+
+	if len(diffs) != 1 {
+		Fail(t, "expected the hook to be called once, got", len(diffs))
+	}
+	diff := diffs[0]
+	if _, ok := diff.Accounts[rejected]; ok {
+		Fail(t, "diff includes the dropped transfer's recipient")
+	}
+	recipient := diff.Accounts[to]
+	if recipient == nil || recipient.Balance == nil || recipient.Balance.Uint64() != 1 {
+		Fail(t, "diff doesn't include the transfer's recipient balance", recipient)
+	}
+	sender := diff.Accounts[from]
+	if sender == nil || sender.Nonce == nil || *sender.Nonce != 1 || sender.Balance == nil {
+		Fail(t, "diff doesn't include the sender's nonce and balance", sender)
+	}
+	if sender.Balance.Cmp(statedb.GetBalance(from)) != 0 {
+		Fail(t, "sender balance", sender.Balance, "doesn't match the state", statedb.GetBalance(from))
+	}
+	// The start block tx updates ArbOS state, e.g. the L1 block number
+	if arbOS := diff.Accounts[types.ArbosStateAddress]; arbOS == nil || len(arbOS.Storage) == 0 {
+		Fail(t, "diff doesn't include ArbOS storage changes")
+	}
+}
@@ -323,6 +323,10 @@ func (s *Storage) Burner() burn.Burner {
 	return s.burner // not public because these should never be changed once set
 }
 
+func (s *Storage) StateDB() vm.StateDB {
+	return s.db
+}
+
 func (s *Storage) Keccak(data ...[]byte) ([]byte, error) {
 	var byteCount uint64
 	for _, part := range data {
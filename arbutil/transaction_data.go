@@ -7,11 +7,16 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 )
 
-func GetLogTransaction(ctx context.Context, client *ethclient.Client, log types.Log) (*types.Transaction, error) {
+// TransactionInBlockReader is implemented by *ethclient.Client, among others.
+type TransactionInBlockReader interface {
+	TransactionInBlock(ctx context.Context, blockHash common.Hash, index uint) (*types.Transaction, error)
+}
+
+func GetLogTransaction(ctx context.Context, client TransactionInBlockReader, log types.Log) (*types.Transaction, error) {
 	tx, err := client.TransactionInBlock(ctx, log.BlockHash, log.TxIndex)
 	if err != nil {
 		return nil, err
@@ -23,7 +28,7 @@ func GetLogTransaction(ctx context.Context, client *ethclient.Client, log types.
 }
 
 // GetLogEmitterTxData requires that the tx's data is at least 4 bytes long
-func GetLogEmitterTxData(ctx context.Context, client *ethclient.Client, log types.Log) ([]byte, error) {
+func GetLogEmitterTxData(ctx context.Context, client TransactionInBlockReader, log types.Log) ([]byte, error) {
 	tx, err := GetLogTransaction(ctx, client, log)
 	if err != nil {
 		return nil, err
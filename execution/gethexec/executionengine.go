@@ -548,6 +548,10 @@ func writeAndLog(pprof, trace *bytes.Buffer) {
 }
 
 func (s *ExecutionEngine) sequenceTransactionsWithBlockMutex(header *arbostypes.L1IncomingMessageHeader, txes types.Transactions, hooks *arbos.SequencingHooks, timeboostedTxs map[common.Hash]struct{}) (*types.Block, error) {
+	if hooks.SkipStartBlockTx {
+		// Replay always applies the start block tx, so a sequenced block without it could never be reproduced
+		return nil, errors.New("the sequencer can't skip the start block tx")
+	}
 	lastBlockHeader, err := s.getCurrentHeader()
 	if err != nil {
 		return nil, err
@@ -573,7 +577,8 @@ func (s *ExecutionEngine) sequenceTransactionsWithBlockMutex(header *arbostypes.
 	delayedMessagesRead := lastBlockHeader.Nonce.Uint64()
 
 	startTime := time.Now()
-	block, receipts, err := arbos.ProduceBlockAdvanced(
+	block, receipts, statedb, err := arbos.ProduceBlockAdvanced(
+		s.GetContext(),
 		header,
 		txes,
 		delayedMessagesRead,
@@ -695,7 +700,7 @@ func (s *ExecutionEngine) sequenceDelayedMessageWithBlockMutex(message *arbostyp
 	}
 
 	startTime := time.Now()
-	block, statedb, receipts, err := s.createBlockFromNextMessage(&messageWithMeta, false)
+	block, statedb, receipts, err := s.createBlockFromNextMessage(context.Background(), &messageWithMeta, false)
 	if err != nil {
 		return nil, err
 	}
@@ -740,7 +745,7 @@ func (s *ExecutionEngine) MessageIndexToBlockNumber(msgIdx arbutil.MessageIndex)
 }
 
 // must hold createBlockMutex
-func (s *ExecutionEngine) createBlockFromNextMessage(msg *arbostypes.MessageWithMetadata, isMsgForPrefetch bool) (*types.Block, *state.StateDB, types.Receipts, error) {
+func (s *ExecutionEngine) createBlockFromNextMessage(ctx context.Context, msg *arbostypes.MessageWithMetadata, isMsgForPrefetch bool) (*types.Block, *state.StateDB, types.Receipts, error) {
 	currentHeader := s.bc.CurrentBlock()
 	if currentHeader == nil {
 		return nil, nil, nil, errors.New("failed to get current block header")
@@ -776,7 +781,8 @@ func (s *ExecutionEngine) createBlockFromNextMessage(msg *arbostypes.MessageWith
 	} else {
 		runCtx = core.NewMessageCommitContext(s.wasmTargets)
 	}
-	block, receipts, err := arbos.ProduceBlock(
+	block, receipts, err := arbos.ProduceBlockWithContext(
+		ctx,
 		msg.Message,
 		msg.DelayedMessagesRead,
 		currentHeader,
@@ -970,15 +976,18 @@ func (s *ExecutionEngine) digestMessageWithBlockMutex(msgIdxToDigest arbutil.Mes
 
 	startTime := time.Now()
 	if s.prefetchBlock && msgForPrefetch != nil {
+		// The prefetch only warms up caches for the next block, so it's of no use once this block is done
+		prefetchCtx, cancelPrefetch := context.WithCancel(context.Background())
+		defer cancelPrefetch()
 		go func() {
-			_, _, _, err := s.createBlockFromNextMessage(msgForPrefetch, true)
+			_, _, _, err := s.createBlockFromNextMessage(prefetchCtx, msgForPrefetch, true)
 			if err != nil {
 				return
 			}
 		}()
 	}
 
-	block, statedb, receipts, err := s.createBlockFromNextMessage(msg, false)
+	block, statedb, receipts, err := s.createBlockFromNextMessage(context.Background(), msg, false)
 	if err != nil {
 		return nil, err
 	}
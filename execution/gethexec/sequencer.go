@@ -889,6 +889,7 @@ func (s *Sequencer) makeSequencingHooks() *arbos.SequencingHooks {
 		PreTxFilter:             s.preTxFilter,
 		PostTxFilter:            s.postTxFilter,
 		DiscardInvalidTxsEarly:  true,
+		AllowOversizedFirstTx:   true,
 		TxErrors:                []error{},
 		ConditionalOptionsForTx: nil,
 	}
@@ -1265,6 +1266,11 @@ func (s *Sequencer) createBlock(ctx context.Context) (returnValue bool) {
 				continue
 			}
 		}
+		var filterErr *arbos.TxFilterError
+		if errors.As(err, &filterErr) {
+			// Return the filter's own error, which may carry an RPC error code or revert data.
+			err = filterErr.Err
+		}
 		if errors.Is(err, core.ErrIntrinsicGas) {
 			// Strip additional information, as it's incorrect due to L1 data gas.
 			err = core.ErrIntrinsicGas
@@ -0,0 +1,205 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbtest
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+
+	"github.com/offchainlabs/nitro/arbos"
+	"github.com/offchainlabs/nitro/arbos/arbosState"
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+	"github.com/offchainlabs/nitro/arbos/l1pricing"
+	"github.com/offchainlabs/nitro/arbos/util"
+	"github.com/offchainlabs/nitro/cmd/chaininfo"
+	"github.com/offchainlabs/nitro/util/testhelpers"
+)
+
+func submitRetryableTx(t *testing.T, chainConfig *params.ChainConfig, gas uint64, to common.Address, data []byte) *types.Transaction {
+	t.Helper()
+	return types.NewTx(&types.ArbitrumSubmitRetryableTx{
+		ChainId:          chainConfig.ChainID,
+		RequestId:        testhelpers.RandomHash(),
+		From:             testhelpers.RandomAddress(),
+		L1BaseFee:        big.NewInt(1),
+		DepositValue:     big.NewInt(params.Ether),
+		GasFeeCap:        big.NewInt(params.GWei),
+		Gas:              gas,
+		RetryTo:          &to,
+		RetryValue:       common.Big0,
+		Beneficiary:      testhelpers.RandomAddress(),
+		MaxSubmissionFee: big.NewInt(params.GWei),
+		FeeRefundAddr:    testhelpers.RandomAddress(),
+		RetryData:        data,
+	})
+}
+
+// redeemChainTxs returns retryables that redeem each other when the last one is auto-redeemed:
+// the last retryable's redeem redeems the one before it, and so on until the first, which just calls an EOA.
+func redeemChainTxs(t *testing.T, chainConfig *params.ChainConfig, length int) types.Transactions {
+	t.Helper()
+	txes := types.Transactions{submitRetryableTx(t, chainConfig, 0, testhelpers.RandomAddress(), nil)}
+	for len(txes) < length {
+		gas := uint64(0)
+		if len(txes) == length-1 {
+			gas = 5_000_000
+		}
+		redeem, err := util.PackArbRetryableTxRedeem(txes[len(txes)-1].Hash())
+		Require(t, err)
+		txes = append(txes, submitRetryableTx(t, chainConfig, gas, types.ArbRetryableTxAddress, redeem))
+	}
+	return txes
+}
+
+func produceRedeemTestBlock(t *testing.T, txes types.Transactions, hooks *arbos.SequencingHooks) *types.Block {
+	t.Helper()
+	_, statedb := arbosState.NewArbosMemoryBackedArbOSState()
+	chainConfig := chaininfo.ArbitrumDevTestChainConfig()
+	genesis := arbosState.MakeGenesisBlock(common.Hash{}, 0, 0, statedb.IntermediateRoot(true), chainConfig)
+	l1Header := &arbostypes.L1IncomingMessageHeader{
+		Kind:        arbostypes.L1MessageType_L2Message,
+		Poster:      l1pricing.BatchPosterAddress,
+		BlockNumber: 1,
+		Timestamp:   genesis.Time() + 1,
+	}
+	block, _, _, err := arbos.ProduceBlockAdvanced(
+		context.Background(), l1Header, txes, genesis.Nonce(), genesis.Header(), statedb, noopChainContext{chainConfig: chainConfig}, hooks, false, core.NewMessageReplayContext(),
+	)
+	Require(t, err)
+	return block
+}
+
+func TestOnScheduledTx(t *testing.T) {
+	chainConfig := chaininfo.ArbitrumDevTestChainConfig()
+	txes := redeemChainTxs(t, chainConfig, 3)
+
+	var parents, scheduled types.Transactions
+	hooks := arbos.NoopSequencingHooks()
+	hooks.OnScheduledTx = func(parent *types.Transaction, tx *types.Transaction) {
+		parents = append(parents, parent)
+		scheduled = append(scheduled, tx)
+	}
+	block := produceRedeemTestBlock(t, txes, hooks)
+
+	// The last retryable is auto-redeemed, and each redeem then redeems the retryable before it
+	if len(scheduled) != len(txes) {
+		Fatal(t, "expected", len(txes), "scheduled redeems, got", len(scheduled))
+	}
+	for i, tx := range scheduled {
+		retry, ok := tx.GetInner().(*types.ArbitrumRetryTx)
+		if !ok {
+			Fatal(t, "scheduled tx", i, "isn't a retry tx")
+		}
+		if expected := txes[len(txes)-1-i].Hash(); retry.TicketId != expected {
+			Fatal(t, "scheduled tx", i, "redeems", retry.TicketId, "instead of", expected)
+		}
+		expectedParent := txes[len(txes)-1]
+		if i > 0 {
+			expectedParent = scheduled[i-1]
+		}
+		if parents[i].Hash() != expectedParent.Hash() {
+			Fatal(t, "scheduled tx", i, "has parent", parents[i].Hash(), "instead of", expectedParent.Hash())
+		}
+	}
+	// The start block tx, every submission, and every scheduled redeem made it into the block
+	if len(block.Transactions()) != 1+len(txes)+len(scheduled) {
+		Fatal(t, "unexpected number of txs in block", len(block.Transactions()))
+	}
+}
+
+func TestMaxRedeemDepth(t *testing.T) {
+	chainConfig := chaininfo.ArbitrumDevTestChainConfig()
+	// Two independent chains, which should each get their own depth budget
+	first := redeemChainTxs(t, chainConfig, 3)
+	second := redeemChainTxs(t, chainConfig, 3)
+	txes := append(append(types.Transactions{}, first...), second...)
+
+	var scheduled types.Transactions
+	hooks := arbos.NoopSequencingHooks()
+	hooks.MaxRedeemDepth = 2
+	hooks.OnScheduledTx = func(_ *types.Transaction, tx *types.Transaction) {
+		scheduled = append(scheduled, tx)
+	}
+	produceRedeemTestBlock(t, txes, hooks)
+
+	if len(scheduled) != 4 {
+		Fatal(t, "expected two redeems to run from each chain, got", len(scheduled))
+	}
+	skipped := hooks.Result.SkippedRedeems
+	if len(skipped) != 2 {
+		Fatal(t, "expected one skipped redeem per chain, got", len(skipped))
+	}
+	for i, chain := range []types.Transactions{first, second} {
+		expected := arbos.RedeemDepthError{
+			OriginTx: chain[len(chain)-1].Hash(),
+			TicketId: chain[0].Hash(),
+			Depth:    3,
+		}
+		if *skipped[i] != expected {
+			Fatal(t, "skipped redeem", i, "is", skipped[i], "instead of", &expected)
+		}
+		if !errors.Is(skipped[i], arbos.ErrRedeemDepthExceeded) {
+			Fatal(t, "skipped redeem", i, "doesn't wrap ErrRedeemDepthExceeded")
+		}
+	}
+	if len(hooks.TxErrors) != len(txes) {
+		Fatal(t, "expected a tx error entry per tx, got", len(hooks.TxErrors))
+	}
+	for i, err := range hooks.TxErrors {
+		if err != nil {
+			Fatal(t, "tx", i, "unexpectedly failed:", err)
+		}
+	}
+}
+
+func TestRedeemOrdering(t *testing.T) {
+	chainConfig := chaininfo.ArbitrumDevTestChainConfig()
+	// Two independent chains of redeems, each started by its last retryable's auto-redeem
+	first := redeemChainTxs(t, chainConfig, 3)
+	second := redeemChainTxs(t, chainConfig, 2)
+	txes := append(append(types.Transactions{}, first...), second...)
+
+	var scheduled types.Transactions
+	hooks := arbos.NoopSequencingHooks()
+	hooks.OnScheduledTx = func(_ *types.Transaction, tx *types.Transaction) {
+		scheduled = append(scheduled, tx)
+	}
+	block := produceRedeemTestBlock(t, txes, hooks)
+
+	// Each submission must be directly followed by every redeem it transitively scheduled, in scheduling order,
+	// before the next submission is applied
+	var expected []common.Hash
+	for _, chain := range []types.Transactions{first, second} {
+		for _, tx := range chain {
+			expected = append(expected, tx.Hash())
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			// The redeem of chain[i], identified by its ticket
+			expected = append(expected, chain[i].Hash())
+		}
+	}
+	blockTxs := block.Transactions()[1:] // skip the start block tx
+	if len(blockTxs) != len(expected) {
+		Fatal(t, "expected", len(expected), "txs after the start block tx, got", len(blockTxs))
+	}
+	for i, tx := range blockTxs {
+		id := tx.Hash()
+		if retry, ok := tx.GetInner().(*types.ArbitrumRetryTx); ok {
+			id = retry.TicketId
+		}
+		if id != expected[i] {
+			Fatal(t, "tx", i, "is", id, "instead of", expected[i])
+		}
+	}
+	if len(scheduled) != len(txes) {
+		Fatal(t, "expected", len(txes), "scheduled redeems, got", len(scheduled))
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2021-2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE.md
+
+package arbtest
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/offchainlabs/nitro/arbnode"
+	"github.com/offchainlabs/nitro/solgen/go/bridgegen"
+)
+
+func TestLookupBatchBySequenceNumber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	builder := NewNodeBuilder(ctx).DefaultConfig(t, true)
+	builder.nodeConfig.BatchPoster.Enable = false
+	cleanup := builder.Build(t)
+	defer cleanup()
+
+	seqInboxAddr := builder.L1Info.GetAddress("SequencerInbox")
+	seqInboxBinding, err := bridgegen.NewSequencerInbox(seqInboxAddr, builder.L1.Client)
+	Require(t, err)
+	seqOpts := builder.L1Info.GetDefaultTransactOpts("Sequencer", ctx)
+
+	// Post a couple of empty batches with other parent chain blocks in between
+	var batchBlocks []uint64
+	for seqNum := int64(1); seqNum <= 2; seqNum++ {
+		builder.L1.TransferBalance(t, "Faucet", "Faucet", common.Big1, builder.L1Info)
+		tx, err := seqInboxBinding.AddSequencerL2BatchFromOrigin8f111f3c(&seqOpts, big.NewInt(seqNum), nil, big.NewInt(1), common.Address{}, common.Big0, common.Big0)
+		Require(t, err)
+		receipt, err := builder.L1.EnsureTxSucceeded(tx)
+		Require(t, err)
+		batchBlocks = append(batchBlocks, receipt.BlockNumber.Uint64())
+		builder.L1.TransferBalance(t, "Faucet", "Faucet", common.Big1, builder.L1Info)
+	}
+
+	seqInbox, err := arbnode.NewSequencerInbox(builder.L1.Client, seqInboxAddr, 0)
+	Require(t, err)
+	for i, blockNumber := range batchBlocks {
+		seqNum := uint64(i + 1)
+		batch, err := seqInbox.LookupBatchBySequenceNumber(ctx, seqNum)
+		Require(t, err)
+		if batch.SequenceNumber != seqNum || batch.ParentChainBlockNumber != blockNumber {
+			Fatal(t, "expected batch", seqNum, "in block", blockNumber, "got batch", batch.SequenceNumber, "in block", batch.ParentChainBlockNumber)
+		}
+	}
+
+	_, err = seqInbox.LookupBatchBySequenceNumber(ctx, 3)
+	if !errors.Is(err, arbnode.ErrBatchNotFound) {
+		Fatal(t, "expected a batch that wasn't posted yet not to be found, got", err)
+	}
+}
+
+func TestVerifyBatchAccumulator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	builder := NewNodeBuilder(ctx).DefaultConfig(t, true)
+	builder.nodeConfig.BatchPoster.Enable = false
+	cleanup := builder.Build(t)
+	defer cleanup()
+
+	seqInboxAddr := builder.L1Info.GetAddress("SequencerInbox")
+	seqInboxBinding, err := bridgegen.NewSequencerInbox(seqInboxAddr, builder.L1.Client)
+	Require(t, err)
+	seqOpts := builder.L1Info.GetDefaultTransactOpts("Sequencer", ctx)
+	tx, err := seqInboxBinding.AddSequencerL2BatchFromOrigin8f111f3c(&seqOpts, big.NewInt(1), nil, big.NewInt(1), common.Address{}, common.Big0, common.Big0)
+	Require(t, err)
+	receipt, err := builder.L1.EnsureTxSucceeded(tx)
+	Require(t, err)
+
+	seqInbox, err := arbnode.NewSequencerInbox(builder.L1.Client, seqInboxAddr, 0)
+	Require(t, err)
+	batches, err := seqInbox.LookupBatchesInRange(ctx, receipt.BlockNumber, receipt.BlockNumber)
+	Require(t, err)
+	if len(batches) != 1 {
+		Fatal(t, "expected one batch, got", len(batches))
+	}
+	batch := batches[0]
+
+	matches, err := seqInbox.VerifyBatchAccumulator(ctx, batch.SequenceNumber, batch.AfterInboxAcc, receipt.BlockNumber)
+	Require(t, err)
+	if !matches {
+		Fatal(t, "batch accumulator didn't match")
+	}
+	matches, err = seqInbox.VerifyBatchAccumulator(ctx, batch.SequenceNumber, common.Hash{1}, receipt.BlockNumber)
+	Require(t, err)
+	if matches {
+		Fatal(t, "wrong accumulator matched")
+	}
+	// The batch didn't exist yet in the block before it was posted
+	before := new(big.Int).Sub(receipt.BlockNumber, common.Big1)
+	matches, err = seqInbox.VerifyBatchAccumulator(ctx, batch.SequenceNumber, batch.AfterInboxAcc, before)
+	Require(t, err)
+	if matches {
+		Fatal(t, "batch matched before it was posted")
+	}
+}
+
+func TestGetAccumulators(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	builder := NewNodeBuilder(ctx).DefaultConfig(t, true)
+	builder.nodeConfig.BatchPoster.Enable = false
+	cleanup := builder.Build(t)
+	defer cleanup()
+
+	seqInboxAddr := builder.L1Info.GetAddress("SequencerInbox")
+	seqInboxBinding, err := bridgegen.NewSequencerInbox(seqInboxAddr, builder.L1.Client)
+	Require(t, err)
+	seqOpts := builder.L1Info.GetDefaultTransactOpts("Sequencer", ctx)
+	for seqNum := int64(1); seqNum <= 2; seqNum++ {
+		tx, err := seqInboxBinding.AddSequencerL2BatchFromOrigin8f111f3c(&seqOpts, big.NewInt(seqNum), nil, big.NewInt(1), common.Address{}, common.Big0, common.Big0)
+		Require(t, err)
+		_, err = builder.L1.EnsureTxSucceeded(tx)
+		Require(t, err)
+	}
+
+	seqInbox, err := arbnode.NewSequencerInbox(builder.L1.Client, seqInboxAddr, 0)
+	Require(t, err)
+	seqNums := []uint64{2, 0, 1}
+	accs, err := seqInbox.GetAccumulators(ctx, seqNums, nil)
+	Require(t, err)
+	if len(accs) != len(seqNums) {
+		Fatal(t, "expected", len(seqNums), "accumulators, got", len(accs))
+	}
+	for i, seqNum := range seqNums {
+		expected, err := seqInbox.GetAccumulator(ctx, seqNum, nil)
+		Require(t, err)
+		if accs[i] != expected {
+			Fatal(t, "accumulator of batch", seqNum, "is", accs[i], "instead of", expected)
+		}
+	}
+
+	// Batch 5 doesn't exist yet, so reading its accumulator reverts
+	_, err = seqInbox.GetAccumulators(ctx, []uint64{1, 5}, nil)
+	var readErr *arbnode.AccumulatorReadError
+	if !errors.As(err, &readErr) || readErr.Index != 1 || readErr.SequenceNumber != 5 {
+		Fatal(t, "expected the read of batch 5 to fail, got", err)
+	}
+}
@@ -29,6 +29,10 @@ import (
 	"github.com/offchainlabs/nitro/util/pretty"
 )
 
+// ErrBlobDataUnavailable is returned when blobs can't be fetched because they're past the beacon chain's
+// retention window, so only an archive endpoint (or another DA source) can still provide them.
+var ErrBlobDataUnavailable = errors.New("blob data is past the retention window and unavailable")
+
 type BlobClient struct {
 	ec                 *ethclient.Client
 	beaconUrl          *url.URL
@@ -203,7 +207,7 @@ func (b *BlobClient) blobSidecars(ctx context.Context, slot uint64, versionedHas
 		// #nosec G115
 		roughAgeOfSlot := uint64(time.Now().Unix()) - (b.genesisTime + slot*b.secondsPerSlot)
 		if roughAgeOfSlot > b.secondsPerSlot*32*4096 {
-			return nil, fmt.Errorf("beacon client in blobSidecars got error or empty response fetching older blobs in slot: %d, an archive endpoint is required, please refer to https://docs.arbitrum.io/run-arbitrum-node/l1-ethereum-beacon-chain-rpc-providers, err: %w", slot, err)
+			return nil, fmt.Errorf("%w: beacon client in blobSidecars got error or empty response fetching older blobs in slot: %d, an archive endpoint is required, please refer to https://docs.arbitrum.io/run-arbitrum-node/l1-ethereum-beacon-chain-rpc-providers, err: %w", ErrBlobDataUnavailable, slot, err)
 		} else {
 			return nil, fmt.Errorf("beacon client in blobSidecars got error or empty response fetching non-expired blobs in slot: %d, if using a prysm endpoint, try --enable-experimental-backfill flag, err: %w", slot, err)
 		}
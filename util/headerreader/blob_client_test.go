@@ -4,12 +4,17 @@
 package headerreader
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/r3labs/diff/v3"
 
@@ -59,6 +64,42 @@ func TestSaveBlobsToDisk(t *testing.T) {
 	}
 }
 
+func TestBlobDataUnavailable(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"not found", http.StatusNotFound, `{"message":"not found"}`},
+		{"empty response", http.StatusOK, `{}`},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(tc.status)
+			_, _ = w.Write([]byte(tc.body))
+		}))
+		blobClient, err := NewBlobClient(BlobClientConfig{BeaconUrl: server.URL}, nil)
+		Require(t, err)
+		blobClient.secondsPerSlot = 12
+		// #nosec G115
+		now := uint64(time.Now().Unix())
+
+		// Slot 0 is far past the retention window, so an archive endpoint is required
+		blobClient.genesisTime = now - blobClient.secondsPerSlot*32*4096*2
+		_, err = blobClient.blobSidecars(context.Background(), 0, nil)
+		if !errors.Is(err, ErrBlobDataUnavailable) {
+			Fail(t, tc.name, "expected blobs past the retention window to be unavailable, got", err)
+		}
+
+		// A recent slot's blobs should still be available, so failing to fetch them is a different error
+		blobClient.genesisTime = now - blobClient.secondsPerSlot*10
+		_, err = blobClient.blobSidecars(context.Background(), 0, nil)
+		if err == nil || errors.Is(err, ErrBlobDataUnavailable) {
+			Fail(t, tc.name, "expected recent blobs to fail without being unavailable, got", err)
+		}
+		server.Close()
+	}
+}
+
 func Require(t *testing.T, err error, printables ...interface{}) {
 	t.Helper()
 	testhelpers.RequireImpl(t, err, printables...)